@@ -0,0 +1,177 @@
+package archive
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// ChangeKind says how a path differs from the image.
+type ChangeKind int
+
+const (
+	ChangeModify ChangeKind = iota
+	ChangeAdd
+	ChangeDelete
+)
+
+func (k ChangeKind) String() string {
+	switch k {
+	case ChangeAdd:
+		return "A"
+	case ChangeDelete:
+		return "D"
+	default:
+		return "C"
+	}
+}
+
+// Change is one path that was added, modified or deleted.
+type Change struct {
+	Kind ChangeKind
+	Path string
+}
+
+func (c Change) String() string {
+	return c.Kind.String() + " " + c.Path
+}
+
+// Diff compares the directory root with base by metadata alone: type, mode,
+// ownership, size, link target and modification time. Paths in exclude, as
+// well as anything mounted from another file system, are left out.
+func Diff(base Tree, root string, exclude []string) ([]Change, error) {
+	rootInfo, err := os.Lstat(root)
+	if err != nil {
+		return nil, err
+	}
+	rootDev := rootInfo.Sys().(*syscall.Stat_t).Dev
+
+	var changes []Change
+	seen := map[string]bool{"/": true}
+	var skipped []string
+	err = filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		name := "/" + filepath.ToSlash(mustRel(root, p))
+		if name == "/." {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		st := fi.Sys().(*syscall.Stat_t)
+		if excluded(name, exclude) || st.Dev != rootDev {
+			skipped = append(skipped, name)
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		seen[name] = true
+		old, ok := base[name]
+		switch {
+		case !ok:
+			changes = append(changes, Change{ChangeAdd, name})
+		case changed(old, fi, p):
+			changes = append(changes, Change{ChangeModify, name})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan %s: %v", root, err)
+	}
+
+	for name := range base {
+		if seen[name] || excluded(name, skipped) || excluded(name, exclude) {
+			continue
+		}
+		// Only report the top of a deleted subtree.
+		if seen[path.Dir(name)] {
+			changes = append(changes, Change{ChangeDelete, name})
+		}
+	}
+	sortChanges(changes)
+	return changes, nil
+}
+
+// WriteChanges writes changes as a layer tar to w, taking added and modified
+// content from root and recording deletions as whiteout files.
+func WriteChanges(w io.Writer, root string, changes []Change) error {
+	tw := NewWriter(w)
+	for _, c := range changes {
+		rel := strings.TrimPrefix(c.Path, "/")
+		if c.Kind == ChangeDelete {
+			dir, base := path.Split(rel)
+			hdr := &tar.Header{
+				Typeflag: tar.TypeReg,
+				Name:     dir + WhiteoutPrefix + base,
+				ModTime:  time.Unix(0, 0),
+			}
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := tw.writeEntry(filepath.Join(root, rel), rel); err != nil {
+			return fmt.Errorf("failed to archive %s: %v", c.Path, err)
+		}
+	}
+	return tw.Close()
+}
+
+// changed reports whether the file at p, described by fi, differs from old.
+func changed(old *Entry, fi os.FileInfo, p string) bool {
+	st := fi.Sys().(*syscall.Stat_t)
+	if old.Mode != fi.Mode() || old.Uid != int(st.Uid) || old.Gid != int(st.Gid) {
+		return true
+	}
+	// Tar headers usually only carry whole seconds.
+	if old.ModTime.Unix() != fi.ModTime().Unix() {
+		return true
+	}
+	switch {
+	case fi.Mode().IsRegular():
+		return old.Size != fi.Size()
+	case fi.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(p)
+		return err != nil || target != old.Linkname
+	case fi.Mode()&os.ModeDevice != 0:
+		rdev := uint64(st.Rdev)
+		return old.Devmajor != int64(unix.Major(rdev)) || old.Devminor != int64(unix.Minor(rdev))
+	}
+	return false
+}
+
+// excluded reports whether name is one of paths or lies below one of them.
+func excluded(name string, paths []string) bool {
+	for _, p := range paths {
+		if name == p || strings.HasPrefix(name, strings.TrimSuffix(p, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func mustRel(root, p string) string {
+	rel, err := filepath.Rel(root, p)
+	if err != nil {
+		return p
+	}
+	return rel
+}
+
+func sortChanges(changes []Change) {
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+}
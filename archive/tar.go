@@ -0,0 +1,161 @@
+package archive
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"syscall"
+)
+
+// Tar writes the tree rooted at dir to w. Paths in the archive are relative
+// to dir, ownership and modes are preserved, and files sharing an inode are
+// written once and then as hard links.
+func Tar(w io.Writer, dir string) error {
+	tw := NewWriter(w)
+	if err := tw.AddTree(dir, "", nil); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// TarPath writes the file or directory src to w under the archive path name,
+// so that extracting it creates name with the content of src.
+func TarPath(w io.Writer, src, name string) error {
+	tw := NewWriter(w)
+	if err := tw.AddTree(src, path.Clean(name), nil); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// Writer builds a tar archive from files on the host, possibly from several
+// trees, writing each inode's content only once.
+type Writer struct {
+	tw     *tar.Writer
+	inodes map[uint64]string
+	owner  *[2]int
+}
+
+// NewWriter returns a Writer that writes the archive to w.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{tw: tar.NewWriter(w), inodes: map[uint64]string{}}
+}
+
+// SetOwner makes every entry written from now on owned by uid:gid instead of
+// the owner of the file on the host.
+func (w *Writer) SetOwner(uid, gid int) {
+	w.owner = &[2]int{uid, gid}
+}
+
+// AddTree archives src with its paths rebased onto name. An empty name
+// leaves out src itself and writes only its contents. Paths for which
+// exclude, given their slash-separated path relative to src, returns true
+// are skipped together with everything below them.
+func (w *Writer) AddTree(src, name string, exclude func(string) bool) error {
+	err := filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if rel == "." && name == "" {
+			return nil
+		}
+		if rel != "." && exclude != nil && exclude(rel) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		return w.writeEntry(p, path.Join(name, rel))
+	})
+	if err != nil {
+		return fmt.Errorf("failed to archive %s: %v", src, err)
+	}
+	return nil
+}
+
+// AddDir writes a directory entry for name without a source on the host.
+func (w *Writer) AddDir(name string, mode int64, uid, gid int) error {
+	return w.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeDir,
+		Name:     name + "/",
+		Mode:     mode,
+		Uid:      uid,
+		Gid:      gid,
+	})
+}
+
+// WriteHeader writes a raw header, for entries such as whiteouts that have
+// no source on the host, or that are followed by content from elsewhere.
+func (w *Writer) WriteHeader(hdr *tar.Header) error {
+	return w.tw.WriteHeader(hdr)
+}
+
+// Write writes content for the last header written with WriteHeader.
+func (w *Writer) Write(p []byte) (int, error) {
+	return w.tw.Write(p)
+}
+
+// Close finishes the archive.
+func (w *Writer) Close() error {
+	return w.tw.Close()
+}
+
+// writeEntry writes one file system object under name.
+func (w *Writer) writeEntry(src, name string) error {
+	fi, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	link := ""
+	if fi.Mode()&os.ModeSymlink != 0 {
+		if link, err = os.Readlink(src); err != nil {
+			return err
+		}
+	}
+	hdr, err := tar.FileInfoHeader(fi, link)
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	if fi.IsDir() {
+		hdr.Name += "/"
+	}
+	// Host user names mean nothing inside the image; only ids are kept.
+	hdr.Uname, hdr.Gname = "", ""
+	if w.owner != nil {
+		hdr.Uid, hdr.Gid = w.owner[0], w.owner[1]
+	}
+
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok && fi.Mode().IsRegular() && st.Nlink > 1 {
+		if first, seen := w.inodes[st.Ino]; seen {
+			hdr.Typeflag = tar.TypeLink
+			hdr.Linkname = first
+			hdr.Size = 0
+			return w.tw.WriteHeader(hdr)
+		}
+		w.inodes[st.Ino] = name
+	}
+
+	if err := w.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if hdr.Typeflag != tar.TypeReg {
+		return nil
+	}
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w.tw, f)
+	return err
+}
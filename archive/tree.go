@@ -0,0 +1,131 @@
+package archive
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// Whiteout markers used by OCI and Docker layers to record deletions.
+const (
+	WhiteoutPrefix = ".wh."
+	WhiteoutOpaque = WhiteoutPrefix + WhiteoutPrefix + ".opq"
+)
+
+// Entry is the metadata of one path in a layered file system.
+type Entry struct {
+	Mode     os.FileMode
+	Uid      int
+	Gid      int
+	Size     int64
+	ModTime  time.Time
+	Linkname string
+	Devmajor int64
+	Devminor int64
+}
+
+// Tree maps absolute, cleaned paths to their metadata. It is built by
+// applying image layers in order and stands in for the unpacked image when
+// comparing it to a container's file system.
+type Tree map[string]*Entry
+
+// ApplyLayer applies an uncompressed layer tar to t, honouring whiteouts.
+func (t Tree) ApplyLayer(r io.Reader) error {
+	idx := t.index()
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read layer: %v", err)
+		}
+		name := path.Clean("/" + hdr.Name)
+		if name == "/" {
+			continue
+		}
+		dir, base := path.Split(name)
+		dir = path.Clean(dir)
+		switch {
+		case base == WhiteoutOpaque:
+			t.removeChildren(idx, dir)
+			continue
+		case strings.HasPrefix(base, WhiteoutPrefix):
+			target := path.Join(dir, strings.TrimPrefix(base, WhiteoutPrefix))
+			delete(t, target)
+			t.removeChildren(idx, target)
+			delete(idx[dir], target)
+			continue
+		}
+
+		e := &Entry{
+			Mode:     hdr.FileInfo().Mode(),
+			Uid:      hdr.Uid,
+			Gid:      hdr.Gid,
+			ModTime:  hdr.ModTime,
+			Devmajor: hdr.Devmajor,
+			Devminor: hdr.Devminor,
+		}
+		switch hdr.Typeflag {
+		case tar.TypeReg:
+			e.Size = hdr.Size
+		case tar.TypeSymlink:
+			e.Linkname = hdr.Linkname
+		case tar.TypeLink:
+			// A hard link shares everything with its target.
+			if target, ok := t[path.Clean("/"+hdr.Linkname)]; ok {
+				copied := *target
+				e = &copied
+			}
+		}
+		if !e.Mode.IsDir() {
+			t.removeChildren(idx, name)
+		}
+		t[name] = e
+		idx.add(name)
+	}
+}
+
+// treeIndex maps each directory of a Tree to the paths directly below it,
+// so whiteouts and replaced directories only visit what they remove. Every
+// ancestor of a path is indexed, whether or not the tree has an entry for it.
+type treeIndex map[string]map[string]struct{}
+
+// index builds the directory index of t.
+func (t Tree) index() treeIndex {
+	idx := treeIndex{}
+	for p := range t {
+		idx.add(p)
+	}
+	return idx
+}
+
+// add records p and its ancestors in the index.
+func (idx treeIndex) add(p string) {
+	for p != "/" {
+		parent := path.Dir(p)
+		children := idx[parent]
+		if children == nil {
+			children = map[string]struct{}{}
+			idx[parent] = children
+		} else if _, ok := children[p]; ok {
+			return
+		}
+		children[p] = struct{}{}
+		p = parent
+	}
+}
+
+// removeChildren deletes every entry below dir.
+func (t Tree) removeChildren(idx treeIndex, dir string) {
+	for child := range idx[dir] {
+		delete(t, child)
+		t.removeChildren(idx, child)
+	}
+	delete(idx, dir)
+}
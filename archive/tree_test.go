@@ -0,0 +1,107 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// layer builds an uncompressed layer tar. Names ending in "/" are
+// directories, "name->target" is a symlink and anything else a file.
+func layer(t *testing.T, names ...string) *bytes.Reader {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, name := range names {
+		hdr := &tar.Header{Name: name, Mode: 0644, Typeflag: tar.TypeReg}
+		if strings.HasSuffix(name, "/") {
+			hdr.Mode, hdr.Typeflag = 0755, tar.TypeDir
+		} else if link, target, ok := strings.Cut(name, "->"); ok {
+			hdr.Name, hdr.Linkname, hdr.Typeflag = link, target, tar.TypeSymlink
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return bytes.NewReader(buf.Bytes())
+}
+
+func paths(tree Tree) []string {
+	var out []string
+	for p := range tree {
+		out = append(out, p)
+	}
+	sort.Strings(out)
+	return out
+}
+
+func TestTreeApplyLayer(t *testing.T) {
+	base := []string{"etc/", "etc/passwd", "etc/ssl/", "etc/ssl/certs/", "etc/ssl/certs/ca.pem", "usr/", "usr/bin/", "usr/bin/sh", "var/lib/x/y"}
+	tests := []struct {
+		name  string
+		layer []string
+		want  []string
+	}{
+		{
+			name:  "whiteout of a directory",
+			layer: []string{"etc/.wh.ssl"},
+			want:  []string{"/etc", "/etc/passwd", "/usr", "/usr/bin", "/usr/bin/sh", "/var/lib/x/y"},
+		},
+		{
+			name:  "opaque directory",
+			layer: []string{"etc/", "etc/.wh..wh..opq", "etc/hosts"},
+			want:  []string{"/etc", "/etc/hosts", "/usr", "/usr/bin", "/usr/bin/sh", "/var/lib/x/y"},
+		},
+		{
+			name:  "directory replaced by a file",
+			layer: []string{"usr/bin"},
+			want:  []string{"/etc", "/etc/passwd", "/etc/ssl", "/etc/ssl/certs", "/etc/ssl/certs/ca.pem", "/usr", "/usr/bin", "/var/lib/x/y"},
+		},
+		{
+			name:  "directory replaced by a symlink",
+			layer: []string{"etc/ssl->/usr"},
+			want:  []string{"/etc", "/etc/passwd", "/etc/ssl", "/usr", "/usr/bin", "/usr/bin/sh", "/var/lib/x/y"},
+		},
+		{
+			// Parents need not have entries of their own
+			name:  "whiteout of a directory without an entry",
+			layer: []string{"var/.wh.lib"},
+			want:  []string{"/etc", "/etc/passwd", "/etc/ssl", "/etc/ssl/certs", "/etc/ssl/certs/ca.pem", "/usr", "/usr/bin", "/usr/bin/sh"},
+		},
+		{
+			name:  "whiteout then recreate",
+			layer: []string{"etc/.wh.ssl", "etc/ssl/", "etc/ssl/new.pem"},
+			want:  []string{"/etc", "/etc/passwd", "/etc/ssl", "/etc/ssl/new.pem", "/usr", "/usr/bin", "/usr/bin/sh", "/var/lib/x/y"},
+		},
+	}
+	for _, tt := range tests {
+		tree := Tree{}
+		if err := tree.ApplyLayer(layer(t, base...)); err != nil {
+			t.Fatal(err)
+		}
+		if err := tree.ApplyLayer(layer(t, tt.layer...)); err != nil {
+			t.Errorf("%s: ApplyLayer failed: %v", tt.name, err)
+			continue
+		}
+		if got := paths(tree); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: tree = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestTreeApplyLayerWhiteoutInSameLayer(t *testing.T) {
+	// A later entry of the same layer can remove what an earlier one added
+	tree := Tree{}
+	if err := tree.ApplyLayer(layer(t, "a/", "a/b/", "a/b/c", "a/.wh.b", "d/e", "d")); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := paths(tree), []string{"/a", "/d"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("tree = %q, want %q", got, want)
+	}
+}
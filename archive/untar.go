@@ -0,0 +1,193 @@
+package archive
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// maxSymlinks bounds symlink resolution, as the kernel's ELOOP does.
+const maxSymlinks = 255
+
+// HostPath maps a path inside a root file system, such as a container's, to
+// the host path where it is stored.
+type HostPath func(string) string
+
+// InDir returns a HostPath that stores the root file system in dir.
+func InDir(dir string) HostPath {
+	return func(p string) string {
+		return filepath.Join(dir, filepath.FromSlash(path.Clean("/"+p)))
+	}
+}
+
+// ResolveInRoot resolves p inside the root file system mapped by hostPath,
+// following symlinks the way a process chrooted into it would: absolute
+// targets restart at the root and ".." never climbs above it. The result is
+// a cleaned path inside the root. A trailing symlink is only followed when
+// followLast is set. Components that do not exist are taken as directories,
+// so the rest of the path, ".." included, is still resolved against them.
+func ResolveInRoot(p string, hostPath HostPath, followLast bool) (string, error) {
+	resolved := "/"
+	rest := strings.Split(p, "/")
+	links := 0
+	for len(rest) > 0 {
+		c := rest[0]
+		rest = rest[1:]
+		switch c {
+		case "", ".":
+			continue
+		case "..":
+			resolved = path.Dir(resolved)
+			continue
+		}
+		next := path.Join(resolved, c)
+		if len(rest) == 0 && !followLast {
+			return next, nil
+		}
+		fi, err := os.Lstat(hostPath(next))
+		if os.IsNotExist(err) {
+			// Resolving on rather than joining the rest keeps a later ".."
+			// and symlinks in check.
+			resolved = next
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if fi.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+		if links++; links > maxSymlinks {
+			return "", fmt.Errorf("%s: too many levels of symbolic links", p)
+		}
+		target, err := os.Readlink(hostPath(next))
+		if err != nil {
+			return "", err
+		}
+		if path.IsAbs(target) {
+			resolved = "/"
+		}
+		rest = append(strings.Split(target, "/"), rest...)
+	}
+	return resolved, nil
+}
+
+// Untar extracts the tar stream r into dir, a directory of the root file
+// system mapped by hostPath. Entry paths are resolved with ResolveInRoot, so
+// neither ".." nor symlinks, including ones created by the archive itself,
+// can place files outside that root. Ownership is restored when chown is set
+// and otherwise left to the extracting user.
+func Untar(r io.Reader, dir string, hostPath HostPath, chown bool) error {
+	type dirTime struct {
+		path  string
+		mtime time.Time
+	}
+	var dirs []dirTime
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read archive: %v", err)
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir, tar.TypeReg, tar.TypeSymlink, tar.TypeLink, tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		default:
+			continue
+		}
+		name := path.Join(dir, path.Clean("/"+hdr.Name))
+		parent, err := ResolveInRoot(path.Dir(name), hostPath, true)
+		if err != nil {
+			return err
+		}
+		dst := hostPath(path.Join(parent, path.Base(name)))
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return err
+		}
+		if err := extractEntry(tr, hdr, dst, dir, hostPath); err != nil {
+			return fmt.Errorf("failed to extract %s: %v", hdr.Name, err)
+		}
+		if hdr.Typeflag == tar.TypeLink {
+			continue
+		}
+		if chown {
+			if err := os.Lchown(dst, hdr.Uid, hdr.Gid); err != nil {
+				return fmt.Errorf("failed to extract %s: %v", hdr.Name, err)
+			}
+		}
+		if hdr.Typeflag == tar.TypeSymlink {
+			continue
+		}
+		// Applied after chown, which clears the setuid and setgid bits.
+		mode := hdr.FileInfo().Mode()
+		if err := os.Chmod(dst, mode.Perm()|mode&(os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+			return fmt.Errorf("failed to extract %s: %v", hdr.Name, err)
+		}
+		if hdr.Typeflag == tar.TypeDir {
+			// Adding children would bump the time again; set it last.
+			dirs = append(dirs, dirTime{dst, hdr.ModTime})
+		} else {
+			os.Chtimes(dst, hdr.ModTime, hdr.ModTime)
+		}
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		os.Chtimes(dirs[i].path, dirs[i].mtime, dirs[i].mtime)
+	}
+	return nil
+}
+
+// extractEntry creates the file system object hdr describes at dst,
+// replacing whatever non-directory was there. Permissions are applied by
+// the caller.
+func extractEntry(tr *tar.Reader, hdr *tar.Header, dst, dir string, hostPath HostPath) error {
+	if fi, err := os.Lstat(dst); err == nil && !(fi.IsDir() && hdr.Typeflag == tar.TypeDir) {
+		if err := os.RemoveAll(dst); err != nil {
+			return err
+		}
+	}
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := os.Mkdir(dst, 0700); err != nil && !os.IsExist(err) {
+			return err
+		}
+	case tar.TypeReg:
+		f, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, tr)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		return err
+	case tar.TypeSymlink:
+		return os.Symlink(hdr.Linkname, dst)
+	case tar.TypeLink:
+		target := path.Join(dir, path.Clean("/"+hdr.Linkname))
+		resolved, err := ResolveInRoot(target, hostPath, false)
+		if err != nil {
+			return err
+		}
+		return os.Link(hostPath(resolved), dst)
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		kind := uint32(unix.S_IFIFO)
+		if hdr.Typeflag == tar.TypeChar {
+			kind = unix.S_IFCHR
+		} else if hdr.Typeflag == tar.TypeBlock {
+			kind = unix.S_IFBLK
+		}
+		dev := unix.Mkdev(uint32(hdr.Devmajor), uint32(hdr.Devminor))
+		return unix.Mknod(dst, kind|0600, int(dev))
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package archive
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveInRoot(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "file"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	for link, target := range map[string]string{
+		"hostroot": "/",
+		"x":        "missing/../hostroot",
+		"abs":      "/etc/../../..",
+		"dotdot":   "../../..",
+		"etc/link": "../../../etc/passwd",
+		"etc/rel":  "passwd",
+		"loop":     "loop",
+		"deep":     "missing/a/b/../../../../../../hostroot/etc",
+		"dangling": "/nowhere/../../etc",
+		"through":  "file/../etc",
+		"chain":    "x",
+		"relchain": "etc/../chain/etc/rel",
+	} {
+		if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		in         string
+		followLast bool
+		want       string
+		wantErr    bool
+	}{
+		{in: "/", followLast: true, want: "/"},
+		{in: "/etc/", followLast: true, want: "/etc"},
+		{in: "../../etc/passwd", followLast: true, want: "/etc/passwd"},
+		{in: "/etc/link", followLast: true, want: "/etc/passwd"},
+		{in: "/etc/link", want: "/etc/link"},
+		{in: "/etc/rel", followLast: true, want: "/etc/passwd"},
+		{in: "/hostroot/etc", followLast: true, want: "/etc"},
+		{in: "/abs/etc", followLast: true, want: "/etc"},
+		{in: "/dotdot/etc", followLast: true, want: "/etc"},
+		{in: "/deep", followLast: true, want: "/etc"},
+		{in: "/dangling/passwd", followLast: true, want: "/etc/passwd"},
+		{in: "/chain/tmp", followLast: true, want: "/tmp"},
+		{in: "/relchain", followLast: true, want: "/etc/passwd"},
+		{in: "/through", followLast: true, want: "/etc"},
+		// Missing components do not end resolution
+		{in: "/x/tmp/esc/outside", followLast: true, want: "/tmp/esc/outside"},
+		{in: "/missing/../../etc", followLast: true, want: "/etc"},
+		{in: "/missing/a/../b", followLast: true, want: "/missing/b"},
+		{in: "/missing/../x/etc", followLast: true, want: "/etc"},
+		{in: "/missing/x", followLast: true, want: "/missing/x"},
+		{in: "/loop", followLast: true, wantErr: true},
+		{in: "/loop", want: "/loop"},
+		{in: "/file/a", followLast: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ResolveInRoot(tt.in, InDir(root), tt.followLast)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ResolveInRoot(%q, %v) = %q, want an error", tt.in, tt.followLast, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ResolveInRoot(%q, %v) failed: %v", tt.in, tt.followLast, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ResolveInRoot(%q, %v) = %q, want %q", tt.in, tt.followLast, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,459 @@
+package build
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"mydocker/image"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Process is the command a RUN step executes.
+type Process struct {
+	Args       []string
+	Env        []string
+	WorkingDir string
+	User       string
+}
+
+// RunFunc runs proc in a new container created from the image name refers
+// to and returns the container's changes as a layer tar stream. Closing the
+// stream removes the container.
+type RunFunc func(name string, proc Process) (io.ReadCloser, error)
+
+// Options configures a build.
+type Options struct {
+	// ContextDir is the directory COPY and ADD read from.
+	ContextDir string
+	// Dockerfile is the path of the Dockerfile; <ContextDir>/Dockerfile
+	// when empty.
+	Dockerfile string
+	// Tag names the resulting image.
+	Tag image.Reference
+	// BuildArgs override ARG defaults.
+	BuildArgs map[string]string
+	// Run executes RUN instructions.
+	Run RunFunc
+	// NoCache rebuilds every step instead of reusing cached results.
+	NoCache bool
+	// Out receives the build progress.
+	Out io.Writer
+}
+
+// builder holds the state of one build as it steps through the Dockerfile.
+type builder struct {
+	opts   Options
+	ignore *ignoreMatcher
+	draft  *image.Draft
+	// globalArgs are the ARGs declared before FROM, usable in FROM and
+	// re-declarable after it; args are the ARGs in scope after FROM.
+	globalArgs map[string]string
+	args       map[string]string
+	usedArgs   map[string]bool
+}
+
+// Build runs the Dockerfile in opts and tags the result as opts.Tag.
+func Build(opts Options) (image.Summary, error) {
+	if opts.Dockerfile == "" {
+		opts.Dockerfile = filepath.Join(opts.ContextDir, "Dockerfile")
+	}
+	f, err := os.Open(opts.Dockerfile)
+	if err != nil {
+		return image.Summary{}, fmt.Errorf("failed to read Dockerfile: %v", err)
+	}
+	instructions, err := Parse(f)
+	f.Close()
+	if err != nil {
+		return image.Summary{}, err
+	}
+	ignore, err := readIgnore(opts.ContextDir)
+	if err != nil {
+		return image.Summary{}, fmt.Errorf("failed to read .dockerignore: %v", err)
+	}
+
+	removeStaleStepTags(opts.Tag.Repository)
+	b := &builder{
+		opts:       opts,
+		ignore:     ignore,
+		globalArgs: map[string]string{},
+		usedArgs:   map[string]bool{},
+	}
+	return b.run(instructions)
+}
+
+func (b *builder) run(instructions []Instruction) (image.Summary, error) {
+	for i, in := range instructions {
+		fmt.Fprintf(b.opts.Out, "Step %d/%d : %s\n", i+1, len(instructions), in)
+		if b.draft == nil && in.Command != "FROM" && in.Command != "ARG" {
+			return image.Summary{}, fmt.Errorf("line %d: %s before FROM", in.Line, in.Command)
+		}
+		if err := b.cachedStep(in); err != nil {
+			return image.Summary{}, fmt.Errorf("line %d: %s: %v", in.Line, in.Command, err)
+		}
+		if b.draft != nil {
+			fmt.Fprintf(b.opts.Out, " ---> %s\n", shortID(b.draft.ID().Encoded()))
+		}
+	}
+	if b.draft == nil {
+		return image.Summary{}, fmt.Errorf("the Dockerfile has no FROM instruction")
+	}
+
+	var unused []string
+	for name := range b.opts.BuildArgs {
+		if !b.usedArgs[name] {
+			unused = append(unused, name)
+		}
+	}
+	if len(unused) > 0 {
+		sort.Strings(unused)
+		fmt.Fprintf(b.opts.Out, "[Warning] One or more build-args %v were not consumed\n", unused)
+	}
+
+	s, err := b.draft.Tag(b.opts.Tag.Tag)
+	if err != nil {
+		return s, err
+	}
+	fmt.Fprintf(b.opts.Out, "Successfully built %s\n", shortID(s.ID.Encoded()))
+	fmt.Fprintf(b.opts.Out, "Successfully tagged %s\n", b.opts.Tag)
+	return s, nil
+}
+
+// cachedStep executes one instruction, or reuses the image a previous build
+// produced for it, and records the result in the build cache.
+func (b *builder) cachedStep(in Instruction) error {
+	if in.Command == "ARG" {
+		if err := b.declareArgs(in); err != nil {
+			return err
+		}
+	}
+	if b.draft == nil || in.Command == "FROM" {
+		return b.step(in)
+	}
+
+	key, err := b.cacheKey(in)
+	if err != nil {
+		return err
+	}
+	if !b.opts.NoCache {
+		cached, err := image.CachedDraft(b.opts.Tag.Repository, key)
+		if err != nil {
+			return err
+		}
+		if cached != nil {
+			fmt.Fprintln(b.opts.Out, " ---> Using cache")
+			b.draft = cached
+			return nil
+		}
+	}
+	if err := b.step(in); err != nil {
+		return err
+	}
+	if _, err := b.draft.Write(); err != nil {
+		return err
+	}
+	return b.draft.Cache(key)
+}
+
+// step executes one instruction against the draft.
+func (b *builder) step(in Instruction) error {
+	switch in.Command {
+	case "FROM":
+		return b.from(in)
+	case "ARG":
+		if b.draft != nil {
+			b.draft.AddHistory(ocispec.History{CreatedBy: "/bin/sh -c #(nop)  ARG " + in.Args})
+		}
+		return nil
+	case "RUN":
+		return b.runCommand(in)
+	case "COPY", "ADD":
+		return b.copy(in)
+	case "CMD", "ENTRYPOINT":
+		// Exec and shell forms are taken literally; the shell expands
+		// variables when the container starts.
+		return b.change(in.Command + " " + in.Args)
+	default:
+		args, err := b.expandChange(in)
+		if err != nil {
+			return err
+		}
+		return b.change(in.Command + " " + args)
+	}
+}
+
+// expandChange expands the arguments of a metadata instruction the way
+// Docker does for each one, and renders them again for image.ApplyChange.
+func (b *builder) expandChange(in Instruction) (string, error) {
+	switch in.Command {
+	case "WORKDIR", "USER", "STOPSIGNAL":
+		return b.expand(in.Args)
+	case "VOLUME":
+		var words []string
+		if err := json.Unmarshal([]byte(in.Args), &words); err == nil && strings.HasPrefix(in.Args, "[") {
+			for i, w := range words {
+				if words[i], err = b.expand(w); err != nil {
+					return "", err
+				}
+			}
+		} else if words, err = expandWords(in.Args, b.lookup); err != nil {
+			return "", err
+		}
+		list, err := json.Marshal(words)
+		return string(list), err
+	case "ENV", "LABEL":
+		raw, err := image.SplitWords(in.Args)
+		if err != nil {
+			return "", err
+		}
+		// The legacy `key value` form takes the rest of the line as one
+		// value.
+		if len(raw) > 0 && !strings.Contains(raw[0], "=") {
+			first := strings.Fields(in.Args)[0]
+			key, err := b.expand(first)
+			if err != nil {
+				return "", err
+			}
+			value, err := b.expand(strings.TrimSpace(strings.TrimPrefix(in.Args, first)))
+			if err != nil {
+				return "", err
+			}
+			return quoteWord(key + "=" + value), nil
+		}
+		words, err := expandWords(in.Args, b.lookup)
+		if err != nil {
+			return "", err
+		}
+		for i, w := range words {
+			words[i] = quoteWord(w)
+		}
+		return strings.Join(words, " "), nil
+	}
+	words, err := expandWords(in.Args, b.lookup)
+	return strings.Join(words, " "), err
+}
+
+// from starts the image. Only single-stage builds are supported.
+func (b *builder) from(in Instruction) error {
+	if b.draft != nil {
+		return fmt.Errorf("multi-stage builds are not supported")
+	}
+	words := strings.Fields(in.Args)
+	if len(words) == 3 && strings.EqualFold(words[1], "AS") {
+		words = words[:1]
+	}
+	if len(words) != 1 {
+		return fmt.Errorf("expected FROM <image> [AS <name>]")
+	}
+	base, err := expand(words[0], b.lookupGlobal)
+	if err != nil {
+		return err
+	}
+	if base == "scratch" {
+		base = ""
+	}
+	draft, err := image.NewDraft(b.opts.Tag.Repository, base)
+	if err != nil {
+		if base != "" {
+			return fmt.Errorf("%v (pull the base image first with `mydocker pull %s`)", err, base)
+		}
+		return err
+	}
+	b.draft = draft
+	b.args = map[string]string{}
+	return nil
+}
+
+// declareArgs brings the build arguments of `ARG name[=default] ...` into
+// scope.
+func (b *builder) declareArgs(in Instruction) error {
+	lookup := b.lookupGlobal
+	if b.draft != nil {
+		lookup = b.lookup
+	}
+	words, err := expandWords(in.Args, lookup)
+	if err != nil {
+		return err
+	}
+	for _, w := range words {
+		name, value, hasDefault := strings.Cut(w, "=")
+		if v, ok := b.opts.BuildArgs[name]; ok {
+			value, hasDefault = v, true
+			b.usedArgs[name] = true
+		} else if v, ok := b.globalArgs[name]; ok && !hasDefault && b.draft != nil {
+			value, hasDefault = v, true
+		}
+		if b.draft == nil {
+			if hasDefault {
+				b.globalArgs[name] = value
+			}
+			continue
+		}
+		if hasDefault {
+			b.args[name] = value
+		}
+	}
+	return nil
+}
+
+// change applies a metadata-only instruction to the config.
+func (b *builder) change(line string) error {
+	if err := image.ApplyChange(&b.draft.Image.Config, line); err != nil {
+		return err
+	}
+	b.draft.AddHistory(ocispec.History{CreatedBy: "/bin/sh -c #(nop)  " + line})
+	return nil
+}
+
+// runCommand executes RUN in a container and commits what it changed.
+func (b *builder) runCommand(in Instruction) error {
+	cfg := b.draft.Image.Config
+	var args []string
+	if err := json.Unmarshal([]byte(in.Args), &args); err != nil || !strings.HasPrefix(in.Args, "[") {
+		args = []string{"/bin/sh", "-c", in.Args}
+	}
+
+	// Build arguments are visible to RUN but not kept in the image.
+	env := append([]string(nil), cfg.Env...)
+	var argEnv []string
+	for _, name := range sortedKeys(b.args) {
+		if _, ok := b.lookupEnv(name); !ok {
+			argEnv = append(argEnv, name+"="+b.args[name])
+		}
+	}
+	env = append(env, argEnv...)
+	createdBy := strings.Join(args, " ")
+	if len(argEnv) > 0 {
+		createdBy = fmt.Sprintf("|%d %s %s", len(argEnv), strings.Join(argEnv, " "), createdBy)
+	}
+
+	// The container is created from the image as it stands, which needs a
+	// name; tag it for the duration of the step.
+	tag := fmt.Sprintf("%s%d-%s", stepTagPrefix, os.Getpid(), randomHex(6))
+	if _, err := b.draft.Tag(tag); err != nil {
+		return err
+	}
+	ref := image.Reference{Repository: b.opts.Tag.Repository, Tag: tag}
+	defer image.Untag(ref)
+
+	layer, err := b.opts.Run(ref.String(), Process{
+		Args:       args,
+		Env:        env,
+		WorkingDir: cfg.WorkingDir,
+		User:       cfg.User,
+	})
+	if err != nil {
+		return fmt.Errorf("the command '%s' failed: %v", strings.Join(args, " "), err)
+	}
+	err = b.draft.AddLayer(layer, ocispec.History{CreatedBy: createdBy})
+	if cerr := layer.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// cacheKey identifies what a step's result depends on: the image it starts
+// from, the instruction text, the build arguments in scope and, for COPY and
+// ADD, the content of the copied files. Variables are expanded from the
+// parent's environment and the arguments, so both are covered already.
+func (b *builder) cacheKey(in Instruction) (string, error) {
+	h := sha256.New()
+	fmt.Fprintf(h, "parent %s\n", b.draft.ID())
+	fmt.Fprintf(h, "instruction %s\n", in)
+	for _, name := range sortedKeys(b.args) {
+		fmt.Fprintf(h, "arg %s=%s\n", name, b.args[name])
+	}
+	if in.Command == "COPY" || in.Command == "ADD" {
+		spec, err := b.parseCopy(in)
+		if err != nil {
+			return "", err
+		}
+		sum, err := b.contentSum(spec.sources)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "content %s\n", sum)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// expand substitutes variables from the config's environment and the ARGs
+// in scope.
+func (b *builder) expand(s string) (string, error) {
+	return expand(s, b.lookup)
+}
+
+func (b *builder) lookup(name string) (string, bool) {
+	if v, ok := b.lookupEnv(name); ok {
+		return v, true
+	}
+	v, ok := b.args[name]
+	return v, ok
+}
+
+func (b *builder) lookupEnv(name string) (string, bool) {
+	env := b.draft.Image.Config.Env
+	for i := len(env) - 1; i >= 0; i-- {
+		if k, v, _ := strings.Cut(env[i], "="); k == name {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+func (b *builder) lookupGlobal(name string) (string, bool) {
+	v, ok := b.globalArgs[name]
+	return v, ok
+}
+
+func shortID(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
+
+// stepTagPrefix starts the tags RUN steps give the image they run. The tag
+// carries the builder's PID, build-<pid>-<hex>, so that tags left behind by
+// a build that died can be told from those of builds still running.
+const stepTagPrefix = "build-"
+
+// removeStaleStepTags untags the step images in repository whose build is
+// no longer running.
+func removeStaleStepTags(repository string) {
+	images, err := image.List()
+	if err != nil {
+		return
+	}
+	for _, img := range images {
+		if img.Repository != repository || !strings.HasPrefix(img.Tag, stepTagPrefix) {
+			continue
+		}
+		pid, suffix, ok := strings.Cut(strings.TrimPrefix(img.Tag, stepTagPrefix), "-")
+		n, err := strconv.Atoi(pid)
+		if !ok || err != nil || n <= 0 || len(suffix) != 12 || strings.Trim(suffix, "0123456789abcdef") != "" {
+			continue
+		}
+		// EPERM means the process exists under another user
+		if err := syscall.Kill(n, 0); err == nil || err == syscall.EPERM {
+			continue
+		}
+		image.Untag(image.Reference{Repository: repository, Tag: img.Tag})
+	}
+}
+
+func randomHex(n int) string {
+	buf := make([]byte, n)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
@@ -0,0 +1,383 @@
+package build
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/bzip2"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"mydocker/archive"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// source is a file or directory of the build context named by COPY or ADD.
+type source struct {
+	// rel is the slash-separated path relative to the context.
+	rel string
+	// path is the host path, with symlinks resolved.
+	path string
+	info os.FileInfo
+	// archive is set for ADD sources that are tar archives to extract.
+	archive bool
+}
+
+// copySpec is a parsed COPY or ADD instruction.
+type copySpec struct {
+	sources []source
+	// dest is the absolute destination, keeping a trailing slash.
+	dest     string
+	uid, gid int
+	chown    bool
+	// expanded is the argument words after variable substitution.
+	expanded string
+}
+
+// parseCopy parses the flags and arguments of COPY and ADD and resolves the
+// sources in the build context.
+func (b *builder) parseCopy(in Instruction) (copySpec, error) {
+	var spec copySpec
+	for name, value := range in.Flags {
+		if name != "chown" {
+			return spec, fmt.Errorf("unsupported flag --%s", name)
+		}
+		var err error
+		if spec.uid, spec.gid, err = parseChown(value); err != nil {
+			return spec, err
+		}
+		spec.chown = true
+	}
+
+	var words []string
+	err := json.Unmarshal([]byte(in.Args), &words)
+	if err == nil && strings.HasPrefix(in.Args, "[") {
+		for i, w := range words {
+			if words[i], err = b.expand(w); err != nil {
+				return spec, err
+			}
+		}
+	} else if words, err = expandWords(in.Args, b.lookup); err != nil {
+		return spec, err
+	}
+	spec.expanded = strings.Join(words, " ")
+	if len(words) < 2 {
+		return spec, fmt.Errorf("requires at least two arguments")
+	}
+	dest := words[len(words)-1]
+	if !path.IsAbs(dest) {
+		wd := b.draft.Image.Config.WorkingDir
+		if wd == "" {
+			wd = "/"
+		}
+		trailing := strings.HasSuffix(dest, "/") || dest == "."
+		dest = path.Join(wd, dest)
+		if trailing {
+			dest += "/"
+		}
+	}
+	spec.dest = dest
+
+	spec.sources, err = b.sources(words[:len(words)-1], in.Command == "ADD")
+	return spec, err
+}
+
+// copy executes COPY and ADD, writing the copied files as a new layer.
+func (b *builder) copy(in Instruction) error {
+	spec, err := b.parseCopy(in)
+	if err != nil {
+		return err
+	}
+	tree, err := b.draft.Tree()
+	if err != nil {
+		return err
+	}
+	destClean := path.Clean(spec.dest)
+	existing, exists := tree[destClean]
+	destIsDir := strings.HasSuffix(spec.dest, "/") || exists && existing.Mode.IsDir()
+	if len(spec.sources) > 1 && !destIsDir {
+		return fmt.Errorf("when copying more than one source the destination must be a directory and end with a /")
+	}
+	for _, src := range spec.sources {
+		if src.info.IsDir() || src.archive {
+			destIsDir = true
+		}
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(b.writeCopy(pw, spec.sources, destClean, destIsDir, tree, spec.uid, spec.gid, spec.chown))
+	}()
+	shown := in
+	shown.Args = spec.expanded
+	err = b.draft.AddLayer(pr, ocispec.History{CreatedBy: "/bin/sh -c #(nop) " + shown.String()})
+	pr.CloseWithError(err)
+	return err
+}
+
+// contentSum digests the files COPY or ADD would copy: their paths, modes,
+// sizes, link targets and contents. Modification times are left out so that
+// a fresh checkout of the same files still hits the cache.
+func (b *builder) contentSum(sources []source) (string, error) {
+	h := sha256.New()
+	for _, src := range sources {
+		fmt.Fprintf(h, "source %s archive=%t\n", src.rel, src.archive)
+		err := filepath.Walk(src.path, func(p string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			inner, err := filepath.Rel(src.path, p)
+			if err != nil {
+				return err
+			}
+			rel := path.Join(src.rel, filepath.ToSlash(inner))
+			if p != src.path && b.ignore.excluded(rel) {
+				if fi.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			fmt.Fprintf(h, "%s %o %d", filepath.ToSlash(inner), fi.Mode(), fi.Size())
+			switch {
+			case fi.Mode()&os.ModeSymlink != 0:
+				target, err := os.Readlink(p)
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(h, " -> %s", target)
+			case fi.Mode().IsRegular():
+				f, err := os.Open(p)
+				if err != nil {
+					return err
+				}
+				fh := sha256.New()
+				_, err = io.Copy(fh, f)
+				f.Close()
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(h, " %x", fh.Sum(nil))
+			}
+			fmt.Fprintln(h)
+			return nil
+		})
+		if err != nil {
+			return "", fmt.Errorf("failed to checksum %s: %v", src.rel, err)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// sources resolves COPY and ADD source arguments, which may be globs, to
+// files in the context that .dockerignore does not exclude.
+func (b *builder) sources(args []string, add bool) ([]source, error) {
+	contextDir, err := filepath.Abs(b.opts.ContextDir)
+	if err == nil {
+		contextDir, err = filepath.EvalSymlinks(contextDir)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read build context: %v", err)
+	}
+	var sources []source
+	for _, arg := range args {
+		if add && strings.Contains(arg, "://") {
+			return nil, fmt.Errorf("ADD from a URL is not supported: %s", arg)
+		}
+		rel := strings.TrimPrefix(path.Clean("/"+arg), "/")
+		matches, err := filepath.Glob(filepath.Join(contextDir, filepath.FromSlash(rel)))
+		if err != nil {
+			return nil, fmt.Errorf("bad pattern %s: %v", arg, err)
+		}
+		found := 0
+		for _, match := range matches {
+			matchRel, err := filepath.Rel(contextDir, match)
+			if err != nil {
+				return nil, err
+			}
+			matchRel = filepath.ToSlash(matchRel)
+			if matchRel != "." && b.ignore.excluded(matchRel) {
+				continue
+			}
+			resolved, err := filepath.EvalSymlinks(match)
+			if err != nil {
+				return nil, err
+			}
+			if resolved != contextDir && !strings.HasPrefix(resolved, contextDir+string(filepath.Separator)) {
+				return nil, fmt.Errorf("forbidden path outside the build context: %s", arg)
+			}
+			fi, err := os.Stat(resolved)
+			if err != nil {
+				return nil, err
+			}
+			src := source{rel: matchRel, path: resolved, info: fi}
+			if add && fi.Mode().IsRegular() {
+				src.archive = isArchive(resolved)
+			}
+			sources = append(sources, src)
+			found++
+		}
+		if found == 0 {
+			return nil, fmt.Errorf("file not found in build context or excluded by .dockerignore: %s", arg)
+		}
+	}
+	return sources, nil
+}
+
+// writeCopy writes the layer for a COPY or ADD to w.
+func (b *builder) writeCopy(w io.Writer, sources []source, dest string, destIsDir bool, tree archive.Tree, uid, gid int, chown bool) error {
+	tw := archive.NewWriter(w)
+	tw.SetOwner(uid, gid)
+
+	// Create missing parents of the destination as the image lacks them.
+	dir := dest
+	if !destIsDir {
+		dir = path.Dir(dest)
+	}
+	var missing []string
+	for d := dir; d != "/"; d = path.Dir(d) {
+		if _, ok := tree[d]; !ok {
+			missing = append([]string{d}, missing...)
+		}
+	}
+	for _, d := range missing {
+		if err := tw.AddDir(strings.TrimPrefix(d, "/"), 0755, uid, gid); err != nil {
+			return err
+		}
+	}
+
+	destRel := strings.TrimPrefix(dest, "/")
+	for _, src := range sources {
+		switch {
+		case src.archive:
+			if err := extractInto(tw, src.path, destRel, uid, gid, chown); err != nil {
+				return err
+			}
+		case src.info.IsDir():
+			// A directory's contents are copied, not the directory itself.
+			entries, err := os.ReadDir(src.path)
+			if err != nil {
+				return err
+			}
+			for _, e := range entries {
+				childRel := path.Join(src.rel, e.Name())
+				if src.rel == "." {
+					childRel = e.Name()
+				}
+				if b.ignore.excluded(childRel) {
+					continue
+				}
+				exclude := func(rel string) bool { return b.ignore.excluded(path.Join(childRel, rel)) }
+				if err := tw.AddTree(filepath.Join(src.path, e.Name()), path.Join(destRel, e.Name()), exclude); err != nil {
+					return err
+				}
+			}
+		default:
+			name := destRel
+			if destIsDir {
+				name = path.Join(destRel, path.Base(src.rel))
+			}
+			if err := tw.AddTree(src.path, name, nil); err != nil {
+				return err
+			}
+		}
+	}
+	return tw.Close()
+}
+
+// isArchive reports whether the file at p is a tar archive, optionally gzip
+// or bzip2 compressed, that ADD should extract.
+func isArchive(p string) bool {
+	f, err := os.Open(p)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	r, err := decompressArchive(f)
+	if err != nil {
+		return false
+	}
+	_, err = tar.NewReader(r).Next()
+	return err == nil
+}
+
+func decompressArchive(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(3)
+	switch {
+	case len(magic) >= 2 && magic[0] == 0x1f && magic[1] == 0x8b:
+		return gzip.NewReader(br)
+	case len(magic) == 3 && string(magic) == "BZh":
+		return bzip2.NewReader(br), nil
+	}
+	return br, nil
+}
+
+// extractInto copies the entries of the archive at p into the layer below
+// destRel. The archive's ownership is kept unless --chown was given.
+func extractInto(tw *archive.Writer, p, destRel string, uid, gid int, chown bool) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r, err := decompressArchive(f)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %v", filepath.Base(p), err)
+		}
+		rel := strings.TrimPrefix(path.Clean("/"+hdr.Name), "/")
+		if rel == "" {
+			continue
+		}
+		hdr.Name = path.Join(destRel, rel)
+		if hdr.Typeflag == tar.TypeDir {
+			hdr.Name += "/"
+		}
+		if hdr.Typeflag == tar.TypeLink {
+			hdr.Linkname = strings.TrimPrefix(path.Join(destRel, path.Clean("/"+hdr.Linkname)), "/")
+		}
+		if chown {
+			hdr.Uid, hdr.Gid = uid, gid
+		}
+		hdr.Uname, hdr.Gname = "", ""
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// parseChown parses a numeric --chown=uid[:gid] value.
+func parseChown(value string) (int, int, error) {
+	userPart, groupPart, hasGroup := strings.Cut(value, ":")
+	uid, err := strconv.Atoi(userPart)
+	if err != nil {
+		return 0, 0, fmt.Errorf("--chown only supports numeric ids, got %q", value)
+	}
+	gid := uid
+	if hasGroup {
+		if gid, err = strconv.Atoi(groupPart); err != nil {
+			return 0, 0, fmt.Errorf("--chown only supports numeric ids, got %q", value)
+		}
+	}
+	return uid, gid, nil
+}
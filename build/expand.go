@@ -0,0 +1,203 @@
+package build
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// expand processes s as one Dockerfile word: $NAME, ${NAME},
+// ${NAME:-default} and ${NAME:+alt} are substituted using lookup, quotes are
+// removed and backslash escapes applied. Nothing is substituted in single
+// quotes, and whitespace is kept.
+func expand(s string, lookup func(string) (string, bool)) (string, error) {
+	words, err := processWords(s, lookup, false)
+	if err != nil {
+		return "", err
+	}
+	return strings.Join(words, ""), nil
+}
+
+// expandWords processes s like expand but splits it into words on unquoted
+// whitespace, including whitespace in the values of unquoted variables.
+func expandWords(s string, lookup func(string) (string, bool)) ([]string, error) {
+	return processWords(s, lookup, true)
+}
+
+func processWords(s string, lookup func(string) (string, bool), split bool) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	// add appends unquoted text, which ends the word at whitespace when
+	// splitting.
+	add := func(text string) {
+		for i := 0; i < len(text); i++ {
+			if c := text[i]; split && (c == ' ' || c == '\t' || c == '\n') {
+				if inWord {
+					words = append(words, word.String())
+					word.Reset()
+					inWord = false
+				}
+				continue
+			}
+			word.WriteByte(text[i])
+			inWord = true
+		}
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch c {
+		case '\\':
+			inWord = true
+			if i+1 < len(s) {
+				i++
+			}
+			word.WriteByte(s[i])
+		case '\'':
+			end := strings.IndexByte(s[i+1:], '\'')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated single quote in %s", s)
+			}
+			word.WriteString(s[i+1 : i+1+end])
+			inWord = true
+			i += end + 1
+		case '"':
+			n, err := doubleQuoted(&word, s[i+1:], lookup)
+			if err != nil {
+				return nil, fmt.Errorf("%v in %s", err, s)
+			}
+			inWord = true
+			i += n
+		case '$':
+			if i+1 == len(s) {
+				add("$")
+				continue
+			}
+			value, n, err := expandVar(s[i+1:], lookup)
+			if err != nil {
+				return nil, err
+			}
+			if n == 0 {
+				add("$")
+				continue
+			}
+			add(value)
+			i += n
+		default:
+			add(s[i : i+1])
+		}
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+// doubleQuoted writes the text of a double-quoted string, which s starts
+// just inside, substituting variables. A backslash only escapes '"', '$' and
+// itself. It returns how many bytes of s, the closing quote included, were
+// consumed.
+func doubleQuoted(word *strings.Builder, s string, lookup func(string) (string, bool)) (int, error) {
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '"':
+			return i + 1, nil
+		case '\\':
+			if i+1 < len(s) && strings.IndexByte(`"$\`, s[i+1]) >= 0 {
+				i++
+			}
+			word.WriteByte(s[i])
+		case '$':
+			if i+1 == len(s) {
+				word.WriteByte(c)
+				continue
+			}
+			value, n, err := expandVar(s[i+1:], lookup)
+			if err != nil {
+				return 0, err
+			}
+			if n == 0 {
+				word.WriteByte(c)
+				continue
+			}
+			word.WriteString(value)
+			i += n
+		default:
+			word.WriteByte(c)
+		}
+	}
+	return 0, fmt.Errorf("unterminated double quote")
+}
+
+// expandVar expands the variable reference at the start of s, which follows
+// a '$'. It returns the value and how many bytes of s were consumed; zero
+// means s does not start with a reference.
+func expandVar(s string, lookup func(string) (string, bool)) (string, int, error) {
+	if s[0] != '{' {
+		n := 0
+		for n < len(s) && isNameChar(s[n], n == 0) {
+			n++
+		}
+		if n == 0 {
+			return "", 0, nil
+		}
+		value, _ := lookup(s[:n])
+		return value, n, nil
+	}
+
+	end := strings.IndexByte(s, '}')
+	if end < 0 {
+		return "", 0, fmt.Errorf("missing '}' in ${%s", s[1:])
+	}
+	body := s[1:end]
+	name, word, op := body, "", ""
+	if i := strings.Index(body, ":"); i >= 0 {
+		if i+2 > len(body) {
+			return "", 0, fmt.Errorf("unsupported modifier in ${%s}", body)
+		}
+		name, op, word = body[:i], body[i:i+2], body[i+2:]
+	}
+	if name == "" {
+		return "", 0, fmt.Errorf("bad substitution ${%s}", body)
+	}
+	for i := 0; i < len(name); i++ {
+		if !isNameChar(name[i], i == 0) {
+			return "", 0, fmt.Errorf("bad substitution ${%s}", body)
+		}
+	}
+	value, ok := lookup(name)
+	switch op {
+	case "":
+	case ":-":
+		if !ok || value == "" {
+			value = word
+		}
+	case ":+":
+		if ok && value != "" {
+			value = word
+		} else {
+			value = ""
+		}
+	default:
+		return "", 0, fmt.Errorf("unsupported modifier in ${%s}", body)
+	}
+	return value, end + 1, nil
+}
+
+// quoteWord double-quotes w so image.SplitWords reads it back as one word.
+func quoteWord(w string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(w) + `"`
+}
+
+func isNameChar(c byte, first bool) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || !first && c >= '0' && c <= '9'
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
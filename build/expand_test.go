@@ -0,0 +1,162 @@
+package build
+
+import (
+	"reflect"
+	"testing"
+
+	"mydocker/image"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestExpand(t *testing.T) {
+	vars := map[string]string{"A": "a", "B": "b c", "EMPTY": ""}
+	lookup := func(name string) (string, bool) {
+		v, ok := vars[name]
+		return v, ok
+	}
+	tests := []struct {
+		in, want string
+		wantErr  bool
+	}{
+		{in: "plain", want: "plain"},
+		{in: "$A", want: "a"},
+		{in: "${A}", want: "a"},
+		{in: "x$A/y", want: "xa/y"},
+		{in: "$A$B", want: "ab c"},
+		{in: "${A}_1", want: "a_1"},
+		{in: "$A_1", want: ""},
+		{in: "$UNSET", want: ""},
+		{in: "${UNSET:-def}", want: "def"},
+		{in: "${EMPTY:-def}", want: "def"},
+		{in: "${A:-def}", want: "a"},
+		{in: "${A:+alt}", want: "alt"},
+		{in: "${EMPTY:+alt}", want: ""},
+		{in: "${UNSET:+alt}", want: ""},
+		{in: "'$A'", want: "$A"},
+		{in: `"$A"`, want: "a"},
+		{in: `"$B"`, want: "b c"},
+		{in: `\$A`, want: "$A"},
+		{in: `"\$A"`, want: "$A"},
+		{in: `'\$A'`, want: `\$A`},
+		{in: `"it's $A"`, want: "it's a"},
+		{in: `'say "$A"'`, want: `say "$A"`},
+		{in: `"a\"b\\c\d"`, want: `a"b\c\d`},
+		{in: `a\ b\c`, want: "a bc"},
+		{in: `a\`, want: `a\`},
+		{in: `x"$A"'$A'y`, want: "xa$Ay"},
+		{in: `""`, want: ""},
+		{in: "a  b", want: "a  b"},
+		{in: "$", want: "$"},
+		{in: `"$"`, want: "$"},
+		{in: "a$ b", want: "a$ b"},
+		{in: "$1", want: "$1"},
+		{in: "é$A", want: "éa"},
+		{in: "'$A", wantErr: true},
+		{in: `"$A`, wantErr: true},
+		{in: `"${A"`, wantErr: true},
+		{in: "${A", wantErr: true},
+		{in: "${}", wantErr: true},
+		{in: "${1}", wantErr: true},
+		{in: "${A:}", wantErr: true},
+		{in: "${A:?err}", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := expand(tt.in, lookup)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("expand(%q) = %q, want an error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("expand(%q) failed: %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("expand(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestExpandWords(t *testing.T) {
+	vars := map[string]string{"A": "a", "B": "b  c", "SPACE": " "}
+	lookup := func(name string) (string, bool) {
+		v, ok := vars[name]
+		return v, ok
+	}
+	tests := []struct {
+		in      string
+		want    []string
+		wantErr bool
+	}{
+		{in: "a b\tc", want: []string{"a", "b", "c"}},
+		{in: "  a  ", want: []string{"a"}},
+		{in: `"a b" 'c d' e\ f`, want: []string{"a b", "c d", "e f"}},
+		{in: "$B x", want: []string{"b", "c", "x"}},
+		{in: `"$B" x`, want: []string{"b  c", "x"}},
+		{in: "x${SPACE}y", want: []string{"x", "y"}},
+		{in: `'$A' "$A" \$A`, want: []string{"$A", "a", "$A"}},
+		{in: `"" a`, want: []string{"", "a"}},
+		{in: `KEY="va lue" K2=$A`, want: []string{"KEY=va lue", "K2=a"}},
+		{in: "$UNSET", want: nil},
+		{in: `"a b`, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := expandWords(tt.in, lookup)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("expandWords(%q) = %q, want an error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("expandWords(%q) failed: %v", tt.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("expandWords(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestExpandChange(t *testing.T) {
+	b := &builder{draft: &image.Draft{}, args: map[string]string{"A": "a", "B": "b c"}}
+	b.draft.Image.Config.Env = []string{"HOME=/root"}
+	tests := []struct {
+		line string
+		want ocispec.ImageConfig
+	}{
+		{line: `ENV X="$A b" Y='$A' Z=\$A`, want: ocispec.ImageConfig{Env: []string{"HOME=/root", "X=a b", "Y=$A", "Z=$A"}}},
+		{line: `ENV X $B  "q" \"`, want: ocispec.ImageConfig{Env: []string{"HOME=/root", `X=b c  q "`}}},
+		{line: `ENV W=a\\b`, want: ocispec.ImageConfig{Env: []string{"HOME=/root", `W=a\b`}}},
+		{line: `LABEL "my label"="$B" other=1`, want: ocispec.ImageConfig{Labels: map[string]string{"my label": "b c", "other": "1"}}},
+		{line: `WORKDIR "$HOME/my dir"`, want: ocispec.ImageConfig{WorkingDir: "/root/my dir"}},
+		{line: `USER '$A'`, want: ocispec.ImageConfig{User: "$A"}},
+		{line: `VOLUME "/a b" $B`, want: ocispec.ImageConfig{Volumes: map[string]struct{}{"/a b": {}, "b": {}, "c": {}}}},
+		{line: `VOLUME ["/$A", "/x y"]`, want: ocispec.ImageConfig{Volumes: map[string]struct{}{"/a": {}, "/x y": {}}}},
+		{line: `EXPOSE "80" 53/udp`, want: ocispec.ImageConfig{ExposedPorts: map[string]struct{}{"80/tcp": {}, "53/udp": {}}}},
+	}
+	for _, tt := range tests {
+		in, err := parseInstruction(tt.line, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		args, err := b.expandChange(in)
+		if err != nil {
+			t.Errorf("%s: expandChange failed: %v", tt.line, err)
+			continue
+		}
+		var got ocispec.ImageConfig
+		if in.Command == "ENV" {
+			got.Env = []string{"HOME=/root"}
+		}
+		if err := image.ApplyChange(&got, in.Command+" "+args); err != nil {
+			t.Errorf("%s: ApplyChange(%q) failed: %v", tt.line, args, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: config = %+v, want %+v", tt.line, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package build
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// ignorePattern is one line of a .dockerignore file.
+type ignorePattern struct {
+	re     *regexp.Regexp
+	negate bool
+}
+
+// ignoreMatcher decides which context paths COPY and ADD may not see.
+type ignoreMatcher struct {
+	patterns []ignorePattern
+}
+
+// readIgnore loads <context>/.dockerignore. A missing file ignores nothing.
+func readIgnore(contextDir string) (*ignoreMatcher, error) {
+	m := &ignoreMatcher{}
+	f, err := os.Open(filepath.Join(contextDir, ".dockerignore"))
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		p := ignorePattern{}
+		if strings.HasPrefix(line, "!") {
+			p.negate = true
+			line = strings.TrimSpace(line[1:])
+		}
+		line = strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(line)), "/")
+		if line == "" {
+			continue
+		}
+		p.re = globRegexp(line)
+		m.patterns = append(m.patterns, p)
+	}
+	return m, scanner.Err()
+}
+
+// excluded reports whether the slash-separated context path rel is ignored.
+// A pattern matching a directory also matches everything inside it, and the
+// last matching pattern wins, so "!" lines can re-include paths.
+func (m *ignoreMatcher) excluded(rel string) bool {
+	rel = strings.TrimPrefix(path.Clean("/"+rel), "/")
+	ignored := false
+	for _, p := range m.patterns {
+		if p.matches(rel) {
+			ignored = !p.negate
+		}
+	}
+	return ignored
+}
+
+func (p ignorePattern) matches(rel string) bool {
+	for candidate := rel; candidate != "." && candidate != ""; candidate = path.Dir(candidate) {
+		if p.re.MatchString(candidate) {
+			return true
+		}
+	}
+	return false
+}
+
+// globRegexp translates a .dockerignore glob to a regexp. "**" matches any
+// number of directories, "*" and "?" stay within one path element.
+func globRegexp(glob string) *regexp.Regexp {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch {
+		case c == '*' && i+1 < len(glob) && glob[i+1] == '*':
+			i++
+			if i+1 < len(glob) && glob[i+1] == '/' {
+				i++
+				b.WriteString("(.*/)?")
+			} else {
+				b.WriteString(".*")
+			}
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(glob[i:], ']')
+			if end < 0 {
+				b.WriteString(regexp.QuoteMeta(glob[i:]))
+				i = len(glob)
+				continue
+			}
+			class := glob[i+1 : i+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + class + "]")
+			i += end
+		case c == '\\' && i+1 < len(glob):
+			i++
+			b.WriteString(regexp.QuoteMeta(string(glob[i])))
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	re, err := regexp.Compile(b.String())
+	if err != nil {
+		return regexp.MustCompile("^" + regexp.QuoteMeta(glob) + "$")
+	}
+	return re
+}
@@ -0,0 +1,120 @@
+package build
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Instruction is one Dockerfile instruction with its continuation lines
+// joined.
+type Instruction struct {
+	// Command is the upper-cased keyword, e.g. "RUN".
+	Command string
+	// Flags are the leading --name=value options of COPY and ADD.
+	Flags map[string]string
+	// Args is the rest of the instruction, unexpanded.
+	Args string
+	// Line is where the instruction starts in the Dockerfile.
+	Line int
+}
+
+// String renders the instruction the way build output and history show it.
+func (in Instruction) String() string {
+	var b strings.Builder
+	b.WriteString(in.Command)
+	for _, name := range sortedKeys(in.Flags) {
+		fmt.Fprintf(&b, " --%s=%s", name, in.Flags[name])
+	}
+	if in.Args != "" {
+		b.WriteString(" " + in.Args)
+	}
+	return b.String()
+}
+
+// supported lists the instructions the builder implements.
+var supported = map[string]bool{
+	"FROM": true, "RUN": true, "COPY": true, "ADD": true, "ENV": true,
+	"WORKDIR": true, "USER": true, "ENTRYPOINT": true, "CMD": true,
+	"EXPOSE": true, "LABEL": true, "ARG": true, "VOLUME": true,
+	"STOPSIGNAL": true,
+}
+
+// Parse reads a Dockerfile. Comments and blank lines are dropped and lines
+// ending in a backslash are joined with the next one.
+func Parse(r io.Reader) ([]Instruction, error) {
+	var instructions []Instruction
+	var current strings.Builder
+	start := 0
+	lineNo := 0
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		if line == "" && current.Len() == 0 {
+			continue
+		}
+		if current.Len() == 0 {
+			start = lineNo
+		}
+		if strings.HasSuffix(line, "\\") {
+			current.WriteString(strings.TrimSuffix(line, "\\"))
+			continue
+		}
+		current.WriteString(line)
+		in, err := parseInstruction(current.String(), start)
+		if err != nil {
+			return nil, err
+		}
+		instructions = append(instructions, in)
+		current.Reset()
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read Dockerfile: %v", err)
+	}
+	if current.Len() > 0 {
+		in, err := parseInstruction(current.String(), start)
+		if err != nil {
+			return nil, err
+		}
+		instructions = append(instructions, in)
+	}
+	if len(instructions) == 0 {
+		return nil, fmt.Errorf("the Dockerfile has no instructions")
+	}
+	if instructions[0].Command != "FROM" && instructions[0].Command != "ARG" {
+		return nil, fmt.Errorf("line %d: the first instruction must be FROM", instructions[0].Line)
+	}
+	return instructions, nil
+}
+
+func parseInstruction(text string, line int) (Instruction, error) {
+	keyword, args, _ := strings.Cut(strings.TrimSpace(text), " ")
+	in := Instruction{Command: strings.ToUpper(keyword), Args: strings.TrimSpace(args), Line: line}
+	if !supported[in.Command] {
+		return in, fmt.Errorf("line %d: unsupported instruction %s", line, keyword)
+	}
+	if in.Command == "COPY" || in.Command == "ADD" {
+		for strings.HasPrefix(in.Args, "--") {
+			flag, rest, _ := strings.Cut(in.Args, " ")
+			name, value, ok := strings.Cut(strings.TrimPrefix(flag, "--"), "=")
+			if !ok {
+				return in, fmt.Errorf("line %d: flag %s needs a value", line, flag)
+			}
+			if in.Flags == nil {
+				in.Flags = map[string]string{}
+			}
+			in.Flags[name] = value
+			in.Args = strings.TrimSpace(rest)
+		}
+	}
+	if in.Args == "" {
+		return in, fmt.Errorf("line %d: %s requires at least one argument", line, in.Command)
+	}
+	return in, nil
+}
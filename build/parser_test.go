@@ -0,0 +1,104 @@
+package build
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name       string
+		dockerfile string
+		want       []Instruction
+	}{
+		{
+			name:       "basic",
+			dockerfile: "FROM alpine\nRUN echo hi\n",
+			want: []Instruction{
+				{Command: "FROM", Args: "alpine", Line: 1},
+				{Command: "RUN", Args: "echo hi", Line: 2},
+			},
+		},
+		{
+			name:       "comments, blank lines and lower case",
+			dockerfile: "# syntax\n\nfrom alpine\n\n  # indented comment\ncmd [\"sh\"]\n",
+			want: []Instruction{
+				{Command: "FROM", Args: "alpine", Line: 3},
+				{Command: "CMD", Args: `["sh"]`, Line: 6},
+			},
+		},
+		{
+			name:       "continuation lines",
+			dockerfile: "FROM alpine\nRUN apk add \\\n    curl \\\n    git\nUSER nobody\n",
+			want: []Instruction{
+				{Command: "FROM", Args: "alpine", Line: 1},
+				{Command: "RUN", Args: "apk add curl git", Line: 2},
+				{Command: "USER", Args: "nobody", Line: 5},
+			},
+		},
+		{
+			name:       "comment inside a continuation",
+			dockerfile: "FROM alpine\nRUN a \\\n# note\n  b\n",
+			want: []Instruction{
+				{Command: "FROM", Args: "alpine", Line: 1},
+				{Command: "RUN", Args: "a b", Line: 2},
+			},
+		},
+		{
+			name:       "trailing continuation",
+			dockerfile: "FROM alpine\nRUN a \\",
+			want: []Instruction{
+				{Command: "FROM", Args: "alpine", Line: 1},
+				{Command: "RUN", Args: "a", Line: 2},
+			},
+		},
+		{
+			name:       "copy flags",
+			dockerfile: "ARG V=1\nFROM alpine\nCOPY --chown=1:1 --from=x a b\n",
+			want: []Instruction{
+				{Command: "ARG", Args: "V=1", Line: 1},
+				{Command: "FROM", Args: "alpine", Line: 2},
+				{Command: "COPY", Flags: map[string]string{"chown": "1:1", "from": "x"}, Args: "a b", Line: 3},
+			},
+		},
+	}
+	for _, tt := range tests {
+		got, err := Parse(strings.NewReader(tt.dockerfile))
+		if err != nil {
+			t.Errorf("%s: Parse failed: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: Parse = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		dockerfile string
+		wantErr    string
+	}{
+		{"empty", "# nothing\n\n", "no instructions"},
+		{"not FROM first", "RUN echo\n", "first instruction must be FROM"},
+		{"unsupported", "FROM alpine\nHEALTHCHECK NONE\n", "line 2: unsupported instruction HEALTHCHECK"},
+		{"missing argument", "FROM alpine\nWORKDIR\n", "line 2: WORKDIR requires at least one argument"},
+		{"flag without value", "FROM alpine\nCOPY --chown a b\n", "line 2: flag --chown needs a value"},
+		{"only flags", "FROM alpine\nCOPY --chown=1\n", "COPY requires at least one argument"},
+	}
+	for _, tt := range tests {
+		_, err := Parse(strings.NewReader(tt.dockerfile))
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: Parse error = %v, want one containing %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestInstructionString(t *testing.T) {
+	in := Instruction{Command: "COPY", Flags: map[string]string{"from": "x", "chown": "1:1"}, Args: "a b"}
+	if got, want := in.String(), "COPY --chown=1:1 --from=x a b"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+}
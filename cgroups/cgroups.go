@@ -61,3 +61,27 @@ func RemoveCgroup(id string) error {
 
 	return nil
 }
+
+// Freeze suspends every process in the container's cgroup.
+func Freeze(id string) error {
+	mgr, err := cgroup2.Load("/" + id)
+	if err != nil {
+		return fmt.Errorf("failed to load cgroup: %v", err)
+	}
+	if err := mgr.Freeze(); err != nil {
+		return fmt.Errorf("failed to freeze cgroup: %v", err)
+	}
+	return nil
+}
+
+// Thaw resumes the processes suspended by Freeze.
+func Thaw(id string) error {
+	mgr, err := cgroup2.Load("/" + id)
+	if err != nil {
+		return fmt.Errorf("failed to load cgroup: %v", err)
+	}
+	if err := mgr.Thaw(); err != nil {
+		return fmt.Errorf("failed to thaw cgroup: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"mydocker/image"
+
+	"golang.org/x/sys/unix"
+)
+
+/* ───────────────────────────  SAVE / LOAD  ────────────────────────── */
+
+// runSave implements `mydocker save [-o FILE] [--format FORMAT] IMAGE...`.
+func runSave(args []string) error {
+	saveCmd := flag.NewFlagSet("save", flag.ExitOnError)
+	output := saveCmd.String("o", "", "Write to a file instead of stdout")
+	format := saveCmd.String("format", image.FormatDockerArchive, "Archive format: docker-archive or oci-archive")
+	saveCmd.Parse(args)
+	if saveCmd.NArg() == 0 {
+		return fmt.Errorf("usage: mydocker save [-o file] [--format docker-archive|oci-archive] <image> [<image>...]")
+	}
+
+	if *output == "" {
+		if isTerminal(os.Stdout) {
+			return fmt.Errorf("refusing to write an archive to a terminal; use -o or redirect stdout")
+		}
+		return image.Save(os.Stdout, *format, saveCmd.Args())
+	}
+
+	// Write next to the destination and rename, so a failed save never
+	// leaves a truncated archive behind.
+	tmp, err := os.CreateTemp(filepath.Dir(*output), ".mydocker-save-")
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %v", *output, err)
+	}
+	defer os.Remove(tmp.Name())
+	if err := image.Save(tmp, *format, saveCmd.Args()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write %s: %v", *output, err)
+	}
+	if err := os.Rename(tmp.Name(), *output); err != nil {
+		return fmt.Errorf("failed to write %s: %v", *output, err)
+	}
+	return nil
+}
+
+// runLoad implements `mydocker load [-i FILE] [-q]`.
+func runLoad(args []string) error {
+	loadCmd := flag.NewFlagSet("load", flag.ExitOnError)
+	input := loadCmd.String("i", "", "Read from a file instead of stdin")
+	quiet := loadCmd.Bool("q", false, "Suppress the load output")
+	loadCmd.Parse(args)
+
+	var r io.Reader = os.Stdin
+	if *input != "" {
+		f, err := os.Open(*input)
+		if err != nil {
+			return fmt.Errorf("failed to open %s: %v", *input, err)
+		}
+		defer f.Close()
+		r = f
+	} else if isTerminal(os.Stdin) {
+		return fmt.Errorf("requested load from stdin, but stdin is a terminal; use -i or redirect stdin")
+	}
+
+	loaded, err := image.Load(r)
+	for _, ref := range loaded {
+		if !*quiet {
+			fmt.Printf("Loaded image: %s\n", ref)
+		}
+	}
+	return err
+}
+
+// isTerminal reports whether f is attached to a terminal.
+func isTerminal(f *os.File) bool {
+	_, err := unix.IoctlGetTermios(int(f.Fd()), unix.TCGETS)
+	return err == nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"mydocker/archive"
+	"mydocker/build"
+	"mydocker/image"
+
+	"github.com/google/uuid"
+)
+
+/* ───────────────────────────────  BUILD  ──────────────────────────── */
+
+// runBuild implements
+// `mydocker build -t REF [-f DOCKERFILE] [--build-arg NAME[=VALUE]]... [--no-cache] CONTEXT`.
+func runBuild(args []string) error {
+	buildCmd := flag.NewFlagSet("build", flag.ExitOnError)
+	tag := buildCmd.String("t", "", "Name and tag of the image to build")
+	dockerfile := buildCmd.String("f", "", "Path of the Dockerfile (default <context>/Dockerfile)")
+	var buildArgs stringSlice
+	buildCmd.Var(&buildArgs, "build-arg", "Set a build argument, NAME=VALUE or NAME to take it from the environment (repeatable)")
+	noCache := buildCmd.Bool("no-cache", false, "Do not use cached results of previous builds")
+	buildCmd.Parse(args)
+	if buildCmd.NArg() != 1 || *tag == "" {
+		return fmt.Errorf("usage: mydocker build -t <image> [-f Dockerfile] [--build-arg NAME=VALUE]... [--no-cache] <context>")
+	}
+	ref, err := image.ParseReference(*tag)
+	if err != nil {
+		return err
+	}
+	values := map[string]string{}
+	for _, arg := range buildArgs {
+		name, value, ok := strings.Cut(arg, "=")
+		if !ok {
+			if value, ok = os.LookupEnv(name); !ok {
+				continue
+			}
+		}
+		values[name] = value
+	}
+
+	_, err = build.Build(build.Options{
+		ContextDir: buildCmd.Arg(0),
+		Dockerfile: *dockerfile,
+		Tag:        ref,
+		BuildArgs:  values,
+		NoCache:    *noCache,
+		Run:        runBuildStep,
+		Out:        os.Stdout,
+	})
+	return err
+}
+
+// runBuilder implements `mydocker builder prune`, which drops the build
+// cache and the blobs only it referenced.
+func runBuilder(args []string) error {
+	if len(args) == 0 || args[0] != "prune" {
+		return fmt.Errorf("usage: mydocker builder prune")
+	}
+	pruneCmd := flag.NewFlagSet("builder prune", flag.ExitOnError)
+	pruneCmd.Bool("a", false, "Accepted for compatibility; all cache entries are removed")
+	pruneCmd.Bool("f", false, "Accepted for compatibility; no confirmation is asked")
+	pruneCmd.Parse(args[1:])
+
+	removed, reclaimed, err := image.PruneBuildCache()
+	busy := errors.Is(err, image.ErrStoreBusy)
+	if err != nil && !busy {
+		return err
+	}
+	fmt.Printf("Deleted build cache objects: %d\n", removed)
+	fmt.Printf("Total reclaimed space: %s\n", humanSize(reclaimed))
+	if busy {
+		fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+	}
+	return nil
+}
+
+// runBuildStep runs a RUN instruction in a throwaway container and streams
+// back what it changed. Closing the stream removes the container.
+func runBuildStep(name string, proc build.Process) (io.ReadCloser, error) {
+	id := uuid.New().String()
+	spec := containerSpec{
+		ID:         id,
+		Image:      name,
+		Cmd:        proc.Args,
+		Env:        proc.Env,
+		WorkingDir: proc.WorkingDir,
+		User:       proc.User,
+	}
+	if _, err := startContainer(spec); err != nil {
+		removeContainer(id)
+		return nil, err
+	}
+	c, err := findContainer(id)
+	if err != nil {
+		removeContainer(id)
+		return nil, err
+	}
+	root, changes, err := containerChanges(c)
+	if err != nil {
+		removeContainer(id)
+		return nil, err
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(archive.WriteChanges(pw, root, changes))
+	}()
+	return &stepLayer{PipeReader: pr, id: id}, nil
+}
+
+// stepLayer is the layer stream of a finished RUN container.
+type stepLayer struct {
+	*io.PipeReader
+	id string
+}
+
+func (l *stepLayer) Close() error {
+	l.PipeReader.Close()
+	return removeContainer(l.id)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"mydocker/archive"
+	"mydocker/cgroups"
+	"mydocker/image"
+)
+
+/* ──────────────────────────  COMMIT / DIFF  ───────────────────────── */
+
+// runCommit implements
+// `mydocker commit [-a AUTHOR] [-m MESSAGE] [-c CHANGE]... [--pause=false] CONTAINER REF`.
+func runCommit(args []string) error {
+	commitCmd := flag.NewFlagSet("commit", flag.ExitOnError)
+	author := commitCmd.String("a", "", "Author of the new image")
+	message := commitCmd.String("m", "", "Commit message recorded in the image history")
+	pause := commitCmd.Bool("pause", true, "Pause the container while committing")
+	var changes stringSlice
+	commitCmd.Var(&changes, "c", "Apply a Dockerfile instruction to the image (repeatable)")
+	commitCmd.Var(&changes, "change", "Apply a Dockerfile instruction to the image (repeatable)")
+	commitCmd.Parse(args)
+	if commitCmd.NArg() != 2 {
+		return fmt.Errorf("usage: mydocker commit [-a author] [-m message] [-c change]... [--pause=false] <container> <image>")
+	}
+	c, err := findContainer(commitCmd.Arg(0))
+	if err != nil {
+		return err
+	}
+	ref, err := image.ParseReference(commitCmd.Arg(1))
+	if err != nil {
+		return err
+	}
+
+	if *pause && containerRunning(c) {
+		if err := cgroups.Freeze(c.ID); err != nil {
+			return err
+		}
+		defer func() {
+			if err := cgroups.Thaw(c.ID); err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+			}
+		}()
+	}
+
+	root, diff, err := containerChanges(c)
+	if err != nil {
+		return err
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(archive.WriteChanges(pw, root, diff))
+	}()
+	s, err := image.Commit(c.Image, pr, ref, image.CommitOptions{
+		Changes:   changes,
+		Message:   *message,
+		Author:    *author,
+		CreatedBy: strings.Join(c.Cmd, " "),
+		Cmd:       c.Cmd,
+	})
+	pr.CloseWithError(err)
+	if err != nil {
+		return err
+	}
+	fmt.Println(s.ID)
+	return nil
+}
+
+// containerChanges compares container c with its image. It returns the
+// container's root file system, which holds the changed content, along with
+// the changes. The generated /etc files and the mount points created for
+// them and for volumes are not part of the changes.
+func containerChanges(c ContainerInfo) (string, []archive.Change, error) {
+	base, err := image.FileTree(c.Image)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to read image %s: %v", c.Image, err)
+	}
+	rootfs := containerRootfs(c.ID)
+	changes, err := archive.Diff(base, rootfs, volumeTargets(c))
+	if err != nil {
+		return "", nil, err
+	}
+	changes, err = withoutMountPoints(c.ID, withoutEtcFiles(changes))
+	return rootfs, changes, err
+}
+
+// volumeTargets returns the container paths of c's bind-mounted volumes.
+func volumeTargets(c ContainerInfo) []string {
+	var targets []string
+	for _, vol := range c.Volumes {
+		parts := strings.Split(vol, ":")
+		if len(parts) == 2 {
+			targets = append(targets, filepath.Clean("/"+parts[1]))
+		}
+	}
+	return targets
+}
+
+// containerRunning reports whether c's init process is still alive. Its PID
+// may have been reused after it exited, so the process must also have the
+// start time recorded for the container.
+func containerRunning(c ContainerInfo) bool {
+	if c.PID <= 0 {
+		return false
+	}
+	start, err := processStartTime(c.PID)
+	if err != nil {
+		return false
+	}
+	// Containers recorded before start times were kept only have the PID
+	return c.StartTime == 0 || start == c.StartTime
+}
+
+// processStartTime returns when process pid started, in clock ticks after
+// boot, from field 22 of /proc/<pid>/stat.
+func processStartTime(pid int) (uint64, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, err
+	}
+	// The command name may contain spaces and parentheses; fields are
+	// counted from the state after its closing parenthesis
+	i := strings.LastIndexByte(string(data), ')')
+	if i < 0 {
+		return 0, fmt.Errorf("malformed /proc/%d/stat", pid)
+	}
+	fields := strings.Fields(string(data[i+1:]))
+	if len(fields) < 20 {
+		return 0, fmt.Errorf("malformed /proc/%d/stat", pid)
+	}
+	return strconv.ParseUint(fields[19], 10, 64)
+}
+
+// runDiff implements `mydocker diff CONTAINER`.
+func runDiff(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: mydocker diff <container>")
+	}
+	c, err := findContainer(args[0])
+	if err != nil {
+		return err
+	}
+	_, changes, err := containerChanges(c)
+	if err != nil {
+		return err
+	}
+	for _, change := range changes {
+		fmt.Println(change)
+	}
+	return nil
+}
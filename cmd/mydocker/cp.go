@@ -0,0 +1,210 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"mydocker/archive"
+)
+
+/* ────────────────────────────────  CP  ────────────────────────────── */
+
+// runCp implements `mydocker cp [-a] [-L] SRC DEST`, where exactly one of
+// SRC and DEST is CONTAINER:PATH and the other a host path or "-" for a tar
+// stream on stdin or stdout.
+func runCp(args []string) error {
+	cpCmd := flag.NewFlagSet("cp", flag.ExitOnError)
+	archiveMode := cpCmd.Bool("a", false, "Archive mode: keep the uid/gid of the copied files")
+	follow := cpCmd.Bool("L", false, "Follow a symlink given as the source path")
+	cpCmd.Parse(args)
+	if cpCmd.NArg() != 2 {
+		return fmt.Errorf("usage: mydocker cp [-a] [-L] <container>:<path> <host path|->\n       mydocker cp [-a] [-L] <host path|-> <container>:<path>")
+	}
+	srcID, src := splitCpArg(cpCmd.Arg(0))
+	dstID, dst := splitCpArg(cpCmd.Arg(1))
+	switch {
+	case srcID != "" && dstID != "":
+		return fmt.Errorf("copying between containers is not supported")
+	case srcID != "":
+		c, err := findContainer(srcID)
+		if err != nil {
+			return err
+		}
+		return copyFromContainer(c, src, dst, *follow, *archiveMode)
+	case dstID != "":
+		c, err := findContainer(dstID)
+		if err != nil {
+			return err
+		}
+		return copyToContainer(src, c, dst, *follow, *archiveMode)
+	default:
+		return fmt.Errorf("one of the paths must be <container>:<path>")
+	}
+}
+
+// splitCpArg splits CONTAINER:PATH. Arguments that look like local paths,
+// such as ./a:b or /tmp/a:b, are never taken for container references.
+func splitCpArg(arg string) (string, string) {
+	if strings.HasPrefix(arg, "/") || strings.HasPrefix(arg, ".") {
+		return "", arg
+	}
+	id, p, ok := strings.Cut(arg, ":")
+	if !ok || strings.Contains(id, "/") {
+		return "", arg
+	}
+	return id, p
+}
+
+// containerHostPath maps paths inside container c to the host, sending the
+// targets of bind-mounted volumes to their sources, and the generated /etc
+// files to the container's copies, so copies see what the container sees,
+// whether or not it is running.
+func containerHostPath(c ContainerInfo) archive.HostPath {
+	rootfs := archive.InDir(containerRootfs(c.ID))
+	type mount struct{ target, source string }
+	var mounts []mount
+	for _, vol := range c.Volumes {
+		parts := strings.Split(vol, ":")
+		if len(parts) == 2 {
+			mounts = append(mounts, mount{path.Clean("/" + parts[1]), parts[0]})
+		}
+	}
+	return func(p string) string {
+		p = path.Clean("/" + p)
+		best := -1
+		for i, m := range mounts {
+			if (p == m.target || strings.HasPrefix(p, m.target+"/")) &&
+				(best < 0 || len(m.target) > len(mounts[best].target)) {
+				best = i
+			}
+		}
+		if best < 0 {
+			if name, ok := etcFileName(p); ok {
+				generated := filepath.Join("/var/lib/mydocker/containers", c.ID, name)
+				if _, err := os.Stat(generated); err == nil {
+					return generated
+				}
+			}
+			return rootfs(p)
+		}
+		rel := strings.TrimPrefix(p, mounts[best].target)
+		return archive.InDir(mounts[best].source)(rel)
+	}
+}
+
+// copyTarget works out where a copy of src lands given the destination the
+// user named. dstDir reports whether dst is an existing directory and
+// dstExists whether it exists at all. It returns the directory to extract
+// into and the archive name to give the copy.
+func copyTarget(src string, srcIsDir bool, dst string, dstExists, dstDir bool) (string, string, error) {
+	contents := strings.HasSuffix(src, "/.")
+	switch {
+	case dstDir && contents:
+		return dst, ".", nil
+	case dstDir:
+		return dst, path.Base(path.Clean(src)), nil
+	case dstExists && srcIsDir:
+		return "", "", fmt.Errorf("cannot copy a directory to a file: %s", dst)
+	case !dstExists && !srcIsDir && strings.HasSuffix(dst, "/"):
+		return "", "", fmt.Errorf("destination directory %s does not exist", dst)
+	}
+	return path.Dir(path.Clean(dst)), path.Base(path.Clean(dst)), nil
+}
+
+// copyFromContainer copies src out of container c to the host path dst, or
+// as a tar stream to stdout when dst is "-".
+func copyFromContainer(c ContainerInfo, src, dst string, follow, chown bool) error {
+	hostPath := containerHostPath(c)
+	resolved, err := archive.ResolveInRoot(src, hostPath, follow)
+	if err != nil {
+		return err
+	}
+	srcHost := hostPath(resolved)
+	fi, err := os.Lstat(srcHost)
+	if err != nil {
+		return fmt.Errorf("could not find %s in container %s", src, c.ID)
+	}
+	if dst == "-" {
+		name := path.Base(resolved)
+		if strings.HasSuffix(src, "/.") {
+			name = "."
+		}
+		return archive.TarPath(os.Stdout, srcHost, name)
+	}
+
+	dstInfo, err := os.Stat(dst)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	dir, name, err := copyTarget(src, fi.IsDir(), filepath.ToSlash(dst), err == nil, err == nil && dstInfo.IsDir())
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(dir); err != nil {
+		return fmt.Errorf("destination directory %s does not exist", dir)
+	}
+	return streamCopy(srcHost, name, "/", archive.InDir(dir), chown)
+}
+
+// copyToContainer copies the host path src, or a tar stream on stdin when
+// src is "-", into container c at dst.
+func copyToContainer(src string, c ContainerInfo, dst string, follow, chown bool) error {
+	hostPath := containerHostPath(c)
+	resolved, err := archive.ResolveInRoot(dst, hostPath, true)
+	if err != nil {
+		return err
+	}
+	dstInfo, err := os.Stat(hostPath(resolved))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	dstExists, dstDir := err == nil, err == nil && dstInfo.IsDir()
+
+	if src == "-" {
+		if !dstDir {
+			return fmt.Errorf("destination %s must be a directory when copying from stdin", dst)
+		}
+		return archive.Untar(os.Stdin, resolved, hostPath, chown)
+	}
+
+	srcHost := src
+	if follow {
+		if srcHost, err = filepath.EvalSymlinks(src); err != nil {
+			return err
+		}
+	}
+	fi, err := os.Lstat(srcHost)
+	if err != nil {
+		return fmt.Errorf("could not find %s: %v", src, err)
+	}
+	// Keep a trailing slash so a missing directory destination is reported.
+	target := resolved
+	if strings.HasSuffix(dst, "/") {
+		target += "/"
+	}
+	dir, name, err := copyTarget(filepath.ToSlash(src), fi.IsDir(), target, dstExists, dstDir)
+	if err != nil {
+		return err
+	}
+	if fi, err := os.Stat(hostPath(dir)); err != nil || !fi.IsDir() {
+		return fmt.Errorf("destination directory %s does not exist in container %s", dir, c.ID)
+	}
+	return streamCopy(srcHost, name, dir, hostPath, chown)
+}
+
+// streamCopy archives src under name and extracts it into dir of the root
+// file system hostPath maps, without an intermediate file.
+func streamCopy(src, name, dir string, hostPath archive.HostPath, chown bool) error {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(archive.TarPath(pw, src, name))
+	}()
+	err := archive.Untar(pr, dir, hostPath, chown)
+	pr.CloseWithError(err)
+	return err
+}
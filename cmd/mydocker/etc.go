@@ -0,0 +1,276 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"mydocker/archive"
+	"mydocker/network"
+)
+
+/* ─────────────────────────────  /etc FILES  ───────────────────────────── */
+
+// etcFiles are the files of the container's /etc that mydocker generates in
+// the container directory and bind-mounts over the image's.
+var etcFiles = []string{"hosts", "hostname", "resolv.conf"}
+
+// containerHostname is the hostname of a container's UTS namespace.
+func containerHostname(id string) string {
+	return id[:5]
+}
+
+// parseExtraHost parses an --add-host value, host:ip or host=ip.
+func parseExtraHost(s string) (network.HostEntry, error) {
+	sep := strings.IndexAny(s, ":=")
+	if sep <= 0 {
+		return network.HostEntry{}, fmt.Errorf("invalid --add-host %q, expected host:ip", s)
+	}
+	host, ip := s[:sep], strings.Trim(s[sep+1:], "[]")
+	if net.ParseIP(ip) == nil {
+		return network.HostEntry{}, fmt.Errorf("invalid IP address %q in --add-host %s", ip, s)
+	}
+	return network.HostEntry{IP: ip, Names: []string{host}}, nil
+}
+
+// writeEtcFiles generates a container's hosts, hostname and resolv.conf for
+// child() to mount. ip is the address the container's hostname resolves to,
+// empty when it has none of its own. Containers on the host's network see
+// the host's hostname and hosts entries and may use its loopback resolvers;
+// those joining another container's network (mode "container:<id>") share
+// its hostname and hosts entries.
+func writeEtcFiles(spec containerSpec, ip, mode string) error {
+	containerPath := filepath.Join("/var/lib/mydocker/containers", spec.ID)
+	hostNetwork := mode == "host"
+	hostname := containerHostname(spec.ID)
+
+	var hosts []byte
+	switch {
+	case hostNetwork:
+		name, err := os.Hostname()
+		if err != nil {
+			return fmt.Errorf("failed to read hostname: %v", err)
+		}
+		hostname = name
+		data, err := os.ReadFile("/etc/hosts")
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to read /etc/hosts: %v", err)
+		}
+		hosts = withExtraHosts(data, spec.ExtraHosts)
+	case strings.HasPrefix(mode, "container:"):
+		targetID := strings.TrimPrefix(mode, "container:")
+		targetPath := filepath.Join("/var/lib/mydocker/containers", targetID)
+		name, nameErr := os.ReadFile(filepath.Join(targetPath, "hostname"))
+		data, hostsErr := os.ReadFile(filepath.Join(targetPath, "hosts"))
+		if os.IsNotExist(nameErr) || os.IsNotExist(hostsErr) {
+			// The target predates generated /etc files
+			hostname = containerHostname(targetID)
+			entries := append([]network.HostEntry(nil), spec.ExtraHosts...)
+			if ip != "" {
+				entries = append(entries, network.HostEntry{IP: ip, Names: []string{hostname, targetID}})
+			}
+			hosts = network.Hosts(entries)
+			break
+		}
+		if nameErr != nil {
+			return fmt.Errorf("failed to read hostname of container %s: %v", targetID, nameErr)
+		}
+		if hostsErr != nil {
+			return fmt.Errorf("failed to read hosts of container %s: %v", targetID, hostsErr)
+		}
+		hostname = strings.TrimSpace(string(name))
+		hosts = withExtraHosts(data, spec.ExtraHosts)
+	default:
+		entries := append([]network.HostEntry(nil), spec.ExtraHosts...)
+		if ip != "" {
+			entries = append(entries, network.HostEntry{IP: ip, Names: []string{hostname, spec.ID}})
+		}
+		hosts = network.Hosts(entries)
+	}
+
+	resolv, err := network.ResolvConf(spec.DNS, spec.DNSSearch, spec.DNSOptions, hostNetwork)
+	if err != nil {
+		return err
+	}
+
+	for name, data := range map[string][]byte{
+		"hosts":       hosts,
+		"hostname":    []byte(hostname + "\n"),
+		"resolv.conf": resolv,
+	} {
+		if err := os.WriteFile(filepath.Join(containerPath, name), data, 0644); err != nil {
+			return fmt.Errorf("failed to write %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// withExtraHosts appends the --add-host entries to an existing hosts file.
+func withExtraHosts(hosts []byte, extra []network.HostEntry) []byte {
+	hosts = append([]byte(nil), hosts...)
+	if len(hosts) > 0 && !strings.HasSuffix(string(hosts), "\n") {
+		hosts = append(hosts, '\n')
+	}
+	for _, e := range extra {
+		hosts = append(hosts, e.String()+"\n"...)
+	}
+	return hosts
+}
+
+// mountEtcFiles bind-mounts the generated files of the container at
+// containerPath over those of rootfs. A target that is missing, or is not a
+// regular file, is replaced with an empty file first so the mount cannot be
+// redirected out of the rootfs.
+func mountEtcFiles(containerPath, rootfs string) error {
+	etc := filepath.Join(rootfs, "etc")
+	fi, err := os.Lstat(etc)
+	if err == nil && !fi.IsDir() {
+		return fmt.Errorf("/etc of the container is not a directory")
+	}
+	if err == nil {
+		// Creating mount points must not show up as a change to /etc
+		mtime := fi.ModTime()
+		defer os.Chtimes(etc, mtime, mtime)
+	}
+	for _, name := range etcFiles {
+		src := filepath.Join(containerPath, name)
+		if _, err := os.Stat(src); os.IsNotExist(err) {
+			continue
+		}
+		dst := filepath.Join(etc, name)
+		if fi, err := os.Lstat(dst); err == nil && !fi.Mode().IsRegular() {
+			if err := os.Remove(dst); err != nil {
+				return fmt.Errorf("failed to replace /etc/%s: %v", name, err)
+			}
+		}
+		if err := makeMountPoint(containerPath, rootfs, "/etc/"+name, false); err != nil {
+			return err
+		}
+		if err := syscall.Mount(src, dst, "", syscall.MS_BIND, ""); err != nil {
+			return fmt.Errorf("failed to bind mount /etc/%s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// mountPointsFile, in the container directory, lists the paths child()
+// created in the rootfs only to mount over them, one per line.
+const mountPointsFile = "mountpoints"
+
+// makeMountPoint creates container path target in rootfs, as a directory or
+// else as an empty file, along with any missing parent directories, and
+// records what it created in the container's mountPointsFile. The
+// modification time of the directory it creates in is kept, so none of it
+// counts as a change of the container.
+func makeMountPoint(containerPath, rootfs, target string, dir bool) error {
+	target = path.Clean("/" + target)
+	existing := target
+	for existing != "/" {
+		if _, err := os.Lstat(filepath.Join(rootfs, existing)); err == nil {
+			break
+		}
+		existing = path.Dir(existing)
+	}
+	if existing == target {
+		return nil
+	}
+	if fi, err := os.Stat(filepath.Join(rootfs, existing)); err == nil {
+		mtime := fi.ModTime()
+		defer os.Chtimes(filepath.Join(rootfs, existing), mtime, mtime)
+	}
+
+	var created []string
+	for p := target; p != existing; p = path.Dir(p) {
+		created = append(created, p+"\n")
+	}
+	f, err := os.OpenFile(filepath.Join(containerPath, mountPointsFile), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to record mount point %s: %v", target, err)
+	}
+	_, err = f.WriteString(strings.Join(created, ""))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to record mount point %s: %v", target, err)
+	}
+
+	dirPath := target
+	if !dir {
+		dirPath = path.Dir(target)
+	}
+	if err := os.MkdirAll(filepath.Join(rootfs, dirPath), 0755); err != nil {
+		return fmt.Errorf("failed to create mount point %s: %v", target, err)
+	}
+	if !dir {
+		f, err := os.OpenFile(filepath.Join(rootfs, target), os.O_CREATE|os.O_RDONLY, 0644)
+		if err != nil {
+			return fmt.Errorf("failed to create mount point %s: %v", target, err)
+		}
+		f.Close()
+	}
+	return nil
+}
+
+// withoutMountPoints drops the mount points child() created for container
+// id from its changes, unless something else was added below them.
+func withoutMountPoints(id string, changes []archive.Change) ([]archive.Change, error) {
+	data, err := os.ReadFile(filepath.Join("/var/lib/mydocker/containers", id, mountPointsFile))
+	if os.IsNotExist(err) {
+		return changes, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read mount points: %v", err)
+	}
+	mountPoints := map[string]bool{}
+	for _, p := range strings.Split(string(data), "\n") {
+		if p != "" {
+			mountPoints[p] = true
+		}
+	}
+	// A mount point holding other changes is kept for their sake
+	needed := map[string]bool{}
+	for _, c := range changes {
+		if c.Kind == archive.ChangeAdd && mountPoints[c.Path] {
+			continue
+		}
+		for p := path.Dir(c.Path); p != "/"; p = path.Dir(p) {
+			needed[p] = true
+		}
+	}
+	kept := changes[:0]
+	for _, c := range changes {
+		if c.Kind != archive.ChangeAdd || !mountPoints[c.Path] || needed[c.Path] {
+			kept = append(kept, c)
+		}
+	}
+	return kept, nil
+}
+
+// withoutEtcFiles drops the generated files from a container's changes;
+// they belong to the container, not its file system.
+func withoutEtcFiles(changes []archive.Change) []archive.Change {
+	kept := changes[:0]
+	for _, c := range changes {
+		if _, ok := etcFileName(c.Path); !ok {
+			kept = append(kept, c)
+		}
+	}
+	return kept
+}
+
+// etcFileName returns the name of the generated file at container path p,
+// if it is one.
+func etcFileName(p string) (string, bool) {
+	p = path.Clean("/" + p)
+	for _, name := range etcFiles {
+		if p == "/etc/"+name {
+			return name, true
+		}
+	}
+	return "", false
+}
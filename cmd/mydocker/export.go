@@ -0,0 +1,120 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"mydocker/archive"
+	"mydocker/image"
+)
+
+/* ─────────────────────────  IMPORT / EXPORT  ──────────────────────── */
+
+// runExport implements `mydocker export [-o FILE] CONTAINER`.
+func runExport(args []string) error {
+	exportCmd := flag.NewFlagSet("export", flag.ExitOnError)
+	output := exportCmd.String("o", "", "Write to a file instead of stdout")
+	exportCmd.Parse(args)
+	if exportCmd.NArg() != 1 {
+		return fmt.Errorf("usage: mydocker export [-o file] <container>")
+	}
+	c, err := findContainer(exportCmd.Arg(0))
+	if err != nil {
+		return err
+	}
+	rootfs := containerRootfs(c.ID)
+	if _, err := os.Stat(rootfs); err != nil {
+		return fmt.Errorf("container %s has no root file system: %v", c.ID, err)
+	}
+
+	if *output == "" {
+		if isTerminal(os.Stdout) {
+			return fmt.Errorf("refusing to write an archive to a terminal; use -o or redirect stdout")
+		}
+		return archive.Tar(os.Stdout, rootfs)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(*output), ".mydocker-export-")
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %v", *output, err)
+	}
+	defer os.Remove(tmp.Name())
+	if err := archive.Tar(tmp, rootfs); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write %s: %v", *output, err)
+	}
+	if err := os.Rename(tmp.Name(), *output); err != nil {
+		return fmt.Errorf("failed to write %s: %v", *output, err)
+	}
+	return nil
+}
+
+// runImport implements
+// `mydocker import [-c CHANGE]... [-m MESSAGE] [--platform P] FILE|URL|- REF`.
+func runImport(args []string) error {
+	importCmd := flag.NewFlagSet("import", flag.ExitOnError)
+	var changes stringSlice
+	importCmd.Var(&changes, "c", "Apply a Dockerfile instruction to the image (repeatable)")
+	importCmd.Var(&changes, "change", "Apply a Dockerfile instruction to the image (repeatable)")
+	message := importCmd.String("m", "", "Commit message recorded in the image history")
+	platformName := importCmd.String("platform", "", "Record os/arch[/variant] instead of the host platform")
+	importCmd.Parse(args)
+	if importCmd.NArg() != 2 {
+		return fmt.Errorf("usage: mydocker import [-c change]... [-m message] <file|url|-> <image>")
+	}
+	src := importCmd.Arg(0)
+	ref, err := image.ParseReference(importCmd.Arg(1))
+	if err != nil {
+		return err
+	}
+	opts := image.ImportOptions{Changes: changes, Message: *message, Source: src}
+	if *platformName != "" {
+		p, err := image.ParsePlatform(*platformName)
+		if err != nil {
+			return err
+		}
+		opts.Platform = &p
+	}
+
+	var r io.Reader
+	switch {
+	case src == "-":
+		if isTerminal(os.Stdin) {
+			return fmt.Errorf("requested import from stdin, but stdin is a terminal")
+		}
+		r = os.Stdin
+		opts.Source = "stdin"
+	case strings.HasPrefix(src, "http://") || strings.HasPrefix(src, "https://"):
+		resp, err := http.Get(src)
+		if err != nil {
+			return fmt.Errorf("failed to download %s: %v", src, err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("failed to download %s: %s", src, resp.Status)
+		}
+		r = resp.Body
+	default:
+		f, err := os.Open(src)
+		if err != nil {
+			return fmt.Errorf("failed to open %s: %v", src, err)
+		}
+		defer f.Close()
+		r = f
+	}
+
+	s, err := image.Import(r, ref, opts)
+	if err != nil {
+		return err
+	}
+	fmt.Println(s.ID)
+	return nil
+}
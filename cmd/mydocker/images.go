@@ -0,0 +1,529 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"text/template"
+	"time"
+
+	"mydocker/image"
+)
+
+/* ───────────────────────────  IMAGES  ────────────────────────── */
+
+// runImages implements `mydocker images [options] [REPOSITORY[:TAG]]`.
+func runImages(args []string) error {
+	imagesCmd := flag.NewFlagSet("images", flag.ExitOnError)
+	quiet := imagesCmd.Bool("q", false, "Only show image IDs")
+	digests := imagesCmd.Bool("digests", false, "Show digests")
+	noTrunc := imagesCmd.Bool("no-trunc", false, "Don't truncate output")
+	format := imagesCmd.String("format", "", "Output format (json)")
+	var filters stringSlice
+	imagesCmd.Var(&filters, "filter", "Filter output (reference=, dangling=, label=, before=, since=)")
+	imagesCmd.Var(&filters, "f", "Shorthand for --filter")
+	imagesCmd.Parse(args)
+
+	images, err := image.List()
+	if err != nil {
+		return err
+	}
+	if imagesCmd.NArg() > 0 {
+		filters = append(filters, "reference="+imagesCmd.Arg(0))
+	}
+	images, err = filterImages(images, filters)
+	if err != nil {
+		return err
+	}
+	sort.SliceStable(images, func(i, j int) bool { return images[i].Created.After(images[j].Created) })
+
+	if *format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "    ")
+		if images == nil {
+			images = []image.Summary{}
+		}
+		return enc.Encode(images)
+	} else if *format != "" {
+		return fmt.Errorf("unsupported format %q", *format)
+	}
+
+	if *quiet {
+		seen := map[string]bool{}
+		for _, img := range images {
+			id := imageID(img, *noTrunc)
+			if !seen[id] {
+				seen[id] = true
+				fmt.Println(id)
+			}
+		}
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	if *digests {
+		fmt.Fprintln(w, "REPOSITORY\tTAG\tDIGEST\tIMAGE ID\tCREATED\tSIZE")
+	} else {
+		fmt.Fprintln(w, "REPOSITORY\tTAG\tIMAGE ID\tCREATED\tSIZE")
+	}
+	for _, img := range images {
+		tag := img.Tag
+		if tag == "" {
+			tag = "<none>"
+		}
+		if *digests {
+			fmt.Fprintf(w, "%s\t%s\t%s\t", img.Repository, tag, img.Digest)
+		} else {
+			fmt.Fprintf(w, "%s\t%s\t", img.Repository, tag)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", imageID(img, *noTrunc), humanCreated(img.Created), humanSize(img.Size))
+	}
+	return w.Flush()
+}
+
+// filterImages applies `--filter key=value` expressions to images.
+func filterImages(images []image.Summary, filters []string) ([]image.Summary, error) {
+	for _, f := range filters {
+		key, value, ok := strings.Cut(f, "=")
+		if !ok && key != "label" {
+			return nil, fmt.Errorf("invalid filter %q, expected key=value", f)
+		}
+		var keep func(image.Summary) bool
+		switch key {
+		case "reference":
+			keep = func(img image.Summary) bool {
+				for _, name := range []string{img.Repository, img.Repository + ":" + img.Tag} {
+					if ok, _ := path.Match(value, name); ok {
+						return true
+					}
+				}
+				return false
+			}
+		case "dangling":
+			dangling, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid dangling filter %q: %v", value, err)
+			}
+			keep = func(img image.Summary) bool { return (img.Tag == "") == dangling }
+		case "label":
+			k, v, hasValue := strings.Cut(value, "=")
+			keep = func(img image.Summary) bool {
+				got, ok := img.Labels[k]
+				return ok && (!hasValue || got == v)
+			}
+		case "before", "since":
+			ref, err := findImage(images, value)
+			if err != nil {
+				return nil, err
+			}
+			if key == "before" {
+				keep = func(img image.Summary) bool { return img.Created.Before(ref.Created) }
+			} else {
+				keep = func(img image.Summary) bool { return img.Created.After(ref.Created) }
+			}
+		default:
+			return nil, fmt.Errorf("unsupported filter %q", key)
+		}
+		var kept []image.Summary
+		for _, img := range images {
+			if keep(img) {
+				kept = append(kept, img)
+			}
+		}
+		images = kept
+	}
+	return images, nil
+}
+
+// findImage looks an image up by repository[:tag] or (short) image ID.
+func findImage(images []image.Summary, name string) (image.Summary, error) {
+	if name == "" {
+		return image.Summary{}, fmt.Errorf("no such image: %s", name)
+	}
+	ref, refErr := image.ParseReference(name)
+	for _, img := range images {
+		if refErr == nil && img.Repository == ref.Repository && img.Tag == ref.Tag {
+			return img, nil
+		}
+		if strings.HasPrefix(img.ID.Encoded(), strings.TrimPrefix(name, "sha256:")) {
+			return img, nil
+		}
+	}
+	return image.Summary{}, fmt.Errorf("no such image: %s", name)
+}
+
+// imageID returns the image ID (config digest) in short or full form.
+func imageID(img image.Summary, noTrunc bool) string {
+	if noTrunc {
+		return img.ID.String()
+	}
+	id := img.ID.Encoded()
+	if len(id) > 12 {
+		id = id[:12]
+	}
+	return id
+}
+
+// humanCreated renders a creation time relative to now, e.g. "3 days ago".
+func humanCreated(t time.Time) string {
+	if t.IsZero() {
+		return "N/A"
+	}
+	d := time.Since(t)
+	switch {
+	case d < time.Minute:
+		return "Less than a minute ago"
+	case d < time.Hour:
+		return plural(int(d.Minutes()), "minute") + " ago"
+	case d < 48*time.Hour:
+		return plural(int(d.Hours()), "hour") + " ago"
+	case d < 14*24*time.Hour:
+		return plural(int(d.Hours()/24), "day") + " ago"
+	case d < 60*24*time.Hour:
+		return plural(int(d.Hours()/24/7), "week") + " ago"
+	case d < 2*365*24*time.Hour:
+		return plural(int(d.Hours()/24/30), "month") + " ago"
+	}
+	return plural(int(d.Hours()/24/365), "year") + " ago"
+}
+
+func plural(n int, unit string) string {
+	if n == 1 {
+		return "1 " + unit
+	}
+	return fmt.Sprintf("%d %ss", n, unit)
+}
+
+// humanSize formats a byte count with decimal units, e.g. "72.8MB".
+func humanSize(size int64) string {
+	units := []string{"B", "kB", "MB", "GB", "TB"}
+	f := float64(size)
+	i := 0
+	for f >= 1000 && i < len(units)-1 {
+		f /= 1000
+		i++
+	}
+	return fmt.Sprintf("%.4g%s", f, units[i])
+}
+
+/* ───────────────────────────  RMI / TAG / PRUNE  ────────────────────────── */
+
+// runRmi implements `mydocker rmi [-f] IMAGE [IMAGE...]`.
+func runRmi(args []string) error {
+	rmiCmd := flag.NewFlagSet("rmi", flag.ExitOnError)
+	force := rmiCmd.Bool("f", false, "Force removal of images used by containers")
+	rmiCmd.Parse(args)
+	if rmiCmd.NArg() == 0 {
+		return fmt.Errorf("usage: mydocker rmi [-f] <image> [<image>...]")
+	}
+
+	containers, err := readContainers()
+	if err != nil {
+		return err
+	}
+	for _, name := range rmiCmd.Args() {
+		matches, err := image.Lookup(name)
+		if err != nil {
+			return err
+		}
+		if len(matches) > 1 && !*force {
+			return fmt.Errorf("unable to delete %s (must be forced) - image is referenced in multiple repositories", name)
+		}
+		for _, img := range matches {
+			if user := imageUser(containers, img); user != "" && !*force {
+				return fmt.Errorf("unable to remove %s (must be forced) - image is being used by container %s", summaryRef(img), user)
+			}
+		}
+		for _, img := range matches {
+			if err := removeImage(img); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// removeImage untags img and garbage-collects its layout.
+func removeImage(img image.Summary) error {
+	ref := summaryRef(img)
+	if _, err := image.Untag(ref); err != nil {
+		return err
+	}
+	if img.Tag != "" {
+		fmt.Printf("Untagged: %s\n", ref)
+	}
+	l := &image.Layout{Repository: img.Repository, Path: filepath.Join(image.Root, filepath.FromSlash(img.Repository))}
+	_, err := l.GC()
+	deferred := errors.Is(err, image.ErrStoreBusy)
+	if err != nil && !deferred {
+		return err
+	}
+	if deferred {
+		fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+	}
+	remaining, err := image.List()
+	if err != nil {
+		return err
+	}
+	for _, other := range remaining {
+		if other.ID == img.ID {
+			return nil
+		}
+	}
+	fmt.Printf("Deleted: %s\n", img.ID)
+	return nil
+}
+
+// runTag implements `mydocker tag SOURCE TARGET`.
+func runTag(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage: mydocker tag <source> <target>")
+	}
+	matches, err := image.Lookup(args[0])
+	if err != nil {
+		return err
+	}
+	dst, err := image.ParseReference(args[1])
+	if err != nil {
+		return err
+	}
+	return image.Tag(summaryRef(matches[0]), dst)
+}
+
+// runImagePrune implements `mydocker image prune [-a]`. Without -a only
+// untagged images are removed; with -a every image no container uses.
+func runImagePrune(args []string) error {
+	pruneCmd := flag.NewFlagSet("image prune", flag.ExitOnError)
+	all := pruneCmd.Bool("a", false, "Remove all images not used by any container")
+	pruneCmd.Parse(args)
+
+	containers, err := readContainers()
+	if err != nil {
+		return err
+	}
+	images, err := image.List()
+	if err != nil {
+		return err
+	}
+	fmt.Println("Deleted Images:")
+	for _, img := range images {
+		if (img.Tag != "" && !*all) || imageUser(containers, img) != "" {
+			continue
+		}
+		if _, err := image.Untag(summaryRef(img)); err != nil {
+			return err
+		}
+		if img.Tag != "" {
+			fmt.Printf("untagged: %s\n", summaryRef(img))
+		}
+		fmt.Printf("deleted: %s\n", img.Digest)
+	}
+
+	layouts, err := image.Layouts()
+	if err != nil {
+		return err
+	}
+	var reclaimed int64
+	var busy error
+	for _, l := range layouts {
+		n, err := l.GC()
+		reclaimed += n
+		if errors.Is(err, image.ErrStoreBusy) {
+			busy = err
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	fmt.Printf("\nTotal reclaimed space: %s\n", humanSize(reclaimed))
+	if busy != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %v\n", busy)
+	}
+	return nil
+}
+
+// summaryRef returns the reference naming a listed image: its tag, or its
+// manifest digest when it is untagged.
+func summaryRef(img image.Summary) image.Reference {
+	if img.Tag == "" {
+		return image.Reference{Repository: img.Repository, Digest: img.Digest}
+	}
+	return image.Reference{Repository: img.Repository, Tag: img.Tag}
+}
+
+// imageUser returns the ID of a container created from img, or "" if none.
+// Containers may name their image by tag, by digest or by image ID.
+func imageUser(containers []ContainerInfo, img image.Summary) string {
+	for _, c := range containers {
+		if ref, err := image.ParseReference(c.Image); err == nil && ref.Repository == img.Repository {
+			if ref.Digest != "" && ref.Digest == img.Digest || ref.Digest == "" && ref.Tag == img.Tag {
+				return c.ID
+			}
+		}
+		id := strings.TrimPrefix(c.Image, "sha256:")
+		if len(id) >= 4 && strings.Trim(id, "0123456789abcdef") == "" && strings.HasPrefix(img.ID.Encoded(), id) {
+			return c.ID
+		}
+	}
+	return ""
+}
+
+/* ───────────────────────────  INSPECT / HISTORY  ────────────────────────── */
+
+// runImageInspect implements `mydocker image inspect [--format TEMPLATE] IMAGE...`.
+func runImageInspect(args []string) error {
+	inspectCmd := flag.NewFlagSet("image inspect", flag.ExitOnError)
+	format := inspectCmd.String("format", "", "Format the output using a Go template")
+	inspectCmd.Parse(args)
+	if inspectCmd.NArg() == 0 {
+		return fmt.Errorf("usage: mydocker image inspect [--format TEMPLATE] <image> [<image>...]")
+	}
+
+	var details []*image.Details
+	for _, name := range inspectCmd.Args() {
+		d, err := image.Inspect(name)
+		if err != nil {
+			return err
+		}
+		details = append(details, d)
+	}
+	if *format != "" {
+		tmpl, err := parseFormat(*format)
+		if err != nil {
+			return err
+		}
+		for _, d := range details {
+			if err := tmpl.Execute(os.Stdout, d); err != nil {
+				return fmt.Errorf("failed to execute template: %v", err)
+			}
+			fmt.Println()
+		}
+		return nil
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "    ")
+	return enc.Encode(details)
+}
+
+// runHistory implements `mydocker history [options] IMAGE`.
+func runHistory(args []string) error {
+	historyCmd := flag.NewFlagSet("history", flag.ExitOnError)
+	noTrunc := historyCmd.Bool("no-trunc", false, "Don't truncate output")
+	quiet := historyCmd.Bool("q", false, "Only show layer digests")
+	format := historyCmd.String("format", "", "Format the output using a Go template, or json")
+	historyCmd.Parse(args)
+	if historyCmd.NArg() != 1 {
+		return fmt.Errorf("usage: mydocker history [options] <image>")
+	}
+
+	entries, err := image.History(historyCmd.Arg(0))
+	if err != nil {
+		return err
+	}
+	switch {
+	case *format == "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "    ")
+		return enc.Encode(entries)
+	case *format != "":
+		tmpl, err := parseFormat(*format)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if err := tmpl.Execute(os.Stdout, e); err != nil {
+				return fmt.Errorf("failed to execute template: %v", err)
+			}
+			fmt.Println()
+		}
+		return nil
+	case *quiet:
+		for _, e := range entries {
+			fmt.Println(shortLayer(e, *noTrunc))
+		}
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "LAYER\tCREATED\tCREATED BY\tSIZE\tCOMMENT")
+	for _, e := range entries {
+		created := "N/A"
+		if e.Created != nil {
+			created = humanCreated(*e.Created)
+		}
+		createdBy := strings.Join(strings.Fields(e.CreatedBy), " ")
+		if r := []rune(createdBy); !*noTrunc && len(r) > 45 {
+			createdBy = string(r[:44]) + "…"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", shortLayer(e, *noTrunc), created, createdBy, humanSize(e.Size), e.Comment)
+	}
+	return w.Flush()
+}
+
+// shortLayer names a history entry by its layer digest, or <missing> for
+// steps that produced no layer.
+func shortLayer(e image.HistoryEntry, noTrunc bool) string {
+	if e.Layer == "" {
+		return "<missing>"
+	}
+	if noTrunc {
+		return e.Layer.String()
+	}
+	return e.Layer.Encoded()[:12]
+}
+
+// parseFormat parses a --format template. The json function renders a value
+// as JSON, e.g. '{{json .Config.Env}}'.
+func parseFormat(format string) (*template.Template, error) {
+	tmpl, err := template.New("format").Funcs(template.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			data, err := json.Marshal(v)
+			return string(data), err
+		},
+		"join": strings.Join,
+	}).Parse(format)
+	if err != nil {
+		return nil, fmt.Errorf("invalid format template: %v", err)
+	}
+	return tmpl, nil
+}
+
+// localImage resolves name, a reference or an image ID, to one stored
+// image, preferring a tagged entry when an ID matches several.
+func localImage(name string) (image.Summary, error) {
+	matches, err := image.Lookup(name)
+	if err != nil {
+		return image.Summary{}, err
+	}
+	for _, m := range matches {
+		if m.Tag != "" {
+			return m, nil
+		}
+	}
+	return matches[0], nil
+}
+
+// imagePlatform returns the platform a local image was built for. When want
+// is non-empty the image must match it.
+func imagePlatform(img image.Summary, want string) (string, error) {
+	if want != "" {
+		platform, err := image.ParsePlatform(want)
+		if err != nil {
+			return "", err
+		}
+		if !image.MatchPlatform(platform, img.Platform) {
+			return "", fmt.Errorf("image %s is %s, not %s; pull it with --platform %s",
+				summaryRef(img), image.FormatPlatform(img.Platform), image.FormatPlatform(platform), want)
+		}
+	}
+	return image.FormatPlatform(img.Platform), nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"mydocker/registry"
+
+	"golang.org/x/sys/unix"
+)
+
+/* ───────────────────────────  LOGIN / LOGOUT  ────────────────────────── */
+
+// runLogin implements `mydocker login [-u USER] [-p PASS | --password-stdin] [SERVER]`.
+func runLogin(args []string) error {
+	loginCmd := flag.NewFlagSet("login", flag.ExitOnError)
+	username := loginCmd.String("u", "", "Username")
+	password := loginCmd.String("p", "", "Password")
+	passwordStdin := loginCmd.Bool("password-stdin", false, "Take the password from stdin")
+	loginCmd.Parse(args)
+
+	host := registry.DefaultHost
+	if loginCmd.NArg() > 0 {
+		host = registry.NormalizeHost(loginCmd.Arg(0))
+	}
+
+	stdin := bufio.NewReader(os.Stdin)
+	if *passwordStdin {
+		if *password != "" {
+			return fmt.Errorf("--password and --password-stdin are mutually exclusive")
+		}
+		if *username == "" {
+			return fmt.Errorf("must provide --username with --password-stdin")
+		}
+		data, err := io.ReadAll(stdin)
+		if err != nil {
+			return fmt.Errorf("failed to read password from stdin: %v", err)
+		}
+		*password = strings.TrimRight(string(data), "\r\n")
+	}
+	if *username == "" {
+		fmt.Print("Username: ")
+		line, err := stdin.ReadString('\n')
+		if err != nil && line == "" {
+			return fmt.Errorf("failed to read username: %v", err)
+		}
+		*username = strings.TrimSpace(line)
+	}
+	if *password == "" {
+		fmt.Print("Password: ")
+		pass, err := readPassword(stdin)
+		fmt.Println()
+		if err != nil {
+			return err
+		}
+		*password = pass
+	}
+	if *username == "" || *password == "" {
+		return fmt.Errorf("username and password are required")
+	}
+
+	auth := registry.AuthConfig{Username: *username, Password: *password}
+	client, err := registry.NewClient(host, auth)
+	if err != nil {
+		return err
+	}
+	if err := client.Ping(); err != nil {
+		return err
+	}
+	cfg, err := registry.LoadConfig()
+	if err != nil {
+		return err
+	}
+	if err := cfg.Store(host, auth); err != nil {
+		return err
+	}
+	fmt.Println("Login Succeeded")
+	return nil
+}
+
+// runLogout implements `mydocker logout [SERVER]`.
+func runLogout(args []string) error {
+	host := registry.DefaultHost
+	if len(args) > 0 {
+		host = registry.NormalizeHost(args[0])
+	}
+	cfg, err := registry.LoadConfig()
+	if err != nil {
+		return err
+	}
+	found, err := cfg.Erase(host)
+	if err != nil {
+		return err
+	}
+	if !found {
+		fmt.Printf("Not logged in to %s\n", host)
+		return nil
+	}
+	fmt.Printf("Removing login credentials for %s\n", host)
+	return nil
+}
+
+// readPassword reads a line from the terminal with echo disabled, or a plain
+// line when stdin is not a terminal.
+func readPassword(stdin *bufio.Reader) (string, error) {
+	fd := int(os.Stdin.Fd())
+	termios, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err == nil {
+		noEcho := *termios
+		noEcho.Lflag &^= unix.ECHO
+		if err := unix.IoctlSetTermios(fd, unix.TCSETS, &noEcho); err != nil {
+			return "", fmt.Errorf("failed to disable echo: %v", err)
+		}
+		defer unix.IoctlSetTermios(fd, unix.TCSETS, termios)
+	}
+	line, err := stdin.ReadString('\n')
+	if err != nil && line == "" {
+		return "", fmt.Errorf("failed to read password: %v", err)
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
@@ -5,17 +5,23 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"runtime"
 	"strconv"
 	"strings"
 	"syscall"
 
 	"mydocker/cgroups"
+	"mydocker/config"
+	"mydocker/image"
 	"mydocker/network"
+	"mydocker/registry"
 
 	"github.com/google/uuid"
+	"github.com/vishvananda/netns"
 )
 
 type stringSlice []string
@@ -26,19 +32,28 @@ func (s *stringSlice) Set(val string) error {
 	return nil
 }
 
-type PortMapping struct {
-	HostPort      int `json:"hostPort"`
-	ContainerPort int `json:"containerPort"`
-}
-
 type ContainerInfo struct {
-	ID      string        `json:"id"`
-	Image   string        `json:"image"`
-	Cmd     []string      `json:"cmd"`
-	Volumes []string      `json:"volumes"`
-	Ports   []PortMapping `json:"ports"`
-	IP      string        `json:"ip"`
-	PID     int           `json:"pid"`
+	ID       string                `json:"id"`
+	Image    string                `json:"image"`
+	Cmd      []string              `json:"cmd"`
+	Volumes  []string              `json:"volumes"`
+	Ports    []network.PortMapping `json:"ports"`
+	IP       string                `json:"ip"`
+	MAC      string                `json:"mac,omitempty"`
+	PID      int                   `json:"pid"`
+	Platform string                `json:"platform,omitempty"`
+	// StartTime is when the init process started, in clock ticks after
+	// boot; it tells the container's process from a later one reusing PID.
+	StartTime uint64 `json:"startTime,omitempty"`
+	// NetworkMode is the network the container was started on, or "none",
+	// "host" or "container:<id>" when it has no interfaces of its own.
+	NetworkMode string `json:"networkMode,omitempty"`
+	// UserlandProxy is set when Ports are served by the proxy in the
+	// container's mydocker process rather than by firewall rules.
+	UserlandProxy bool `json:"userlandProxy,omitempty"`
+	// Networks maps the names of the networks the container is attached
+	// to to its endpoint on each.
+	Networks map[string]EndpointInfo `json:"networks,omitempty"`
 }
 
 /* ─────────────────────────────  MAIN  ────────────────────────────────────── */
@@ -54,7 +69,15 @@ func main() {
 		var volumes stringSlice
 		var ports stringSlice
 		runCmd.Var(&volumes, "v", "Volume mounts (host:container)")
-		runCmd.Var(&ports, "p", "Port mappings (host:container)")
+		runCmd.Var(&ports, "p", "Publish ports, [hostIP:][hostPort[-end]:]containerPort[-end][/tcp|udp]")
+		publishAll := runCmd.Bool("P", false, "Publish every port the image exposes on a random host port")
+		platform := runCmd.String("platform", "", "Require the image to match os/arch[/variant]")
+		netName := runCmd.String("network", network.DefaultNetwork, "Network to connect to, or none, host or container:<id>")
+		var addHosts, dns, dnsSearch, dnsOptions stringSlice
+		runCmd.Var(&addHosts, "add-host", "Add a host:ip entry to /etc/hosts (repeatable)")
+		runCmd.Var(&dns, "dns", "Nameserver for /etc/resolv.conf (repeatable)")
+		runCmd.Var(&dnsSearch, "dns-search", "Search domain for /etc/resolv.conf (repeatable)")
+		runCmd.Var(&dnsOptions, "dns-option", "Resolver option for /etc/resolv.conf (repeatable)")
 		runCmd.Parse(os.Args[2:]) // parse flags after "run"
 
 		// Positional args: image and command
@@ -64,45 +87,134 @@ func main() {
 		}
 		image := args[0]
 		cmdArgs := args[1:]
+		img, err := localImage(image)
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+		if _, err := imagePlatform(img, *platform); err != nil {
+			log.Fatalf("Error: %v", err)
+		}
 
 		// maps the ports
-		var portMappings []PortMapping
-		for _, port := range ports {
-			parts := strings.Split(port, ":")
-			if len(parts) != 2 {
-				log.Fatalf("Invalid port mapping %s, expected host:container", port)
+		var portMappings []network.PortMapping
+		if *publishAll {
+			exposed, err := exposedPorts(img)
+			if err != nil {
+				log.Fatalf("Error: %v", err)
 			}
-			hostPort, err := strconv.Atoi(parts[0])
+			portMappings = append(portMappings, exposed...)
+		}
+		for _, port := range ports {
+			mappings, err := parsePortSpec(port)
 			if err != nil {
-				log.Fatalf("Invalid host port %s: %v", parts[0], err)
+				log.Fatalf("Error: %v", err)
 			}
-			containerPort, err := strconv.Atoi(parts[1])
+			portMappings = append(portMappings, mappings...)
+		}
+
+		// Entries and resolvers for the generated /etc files
+		var extraHosts []network.HostEntry
+		for _, h := range addHosts {
+			entry, err := parseExtraHost(h)
 			if err != nil {
-				log.Fatalf("Invalid container port %s: %v", parts[1], err)
+				log.Fatalf("Error: %v", err)
+			}
+			extraHosts = append(extraHosts, entry)
+		}
+		for _, ns := range dns {
+			if net.ParseIP(ns) == nil {
+				log.Fatalf("Error: invalid --dns %q, expected an IP address", ns)
 			}
-			portMappings = append(portMappings, PortMapping{
-				HostPort:      hostPort,
-				ContainerPort: containerPort,
-			})
 		}
 
 		// Generate random container ID and start container
 		id := uuid.New().String()
-		if _, err := startContainer(id, image, cmdArgs, volumes, portMappings); err != nil {
+		spec := containerSpec{ID: id, Image: image, Resolved: &img, Cmd: cmdArgs, Volumes: volumes, Ports: portMappings, Network: *netName,
+			ExtraHosts: extraHosts, DNS: dns, DNSSearch: dnsSearch, DNSOptions: dnsOptions}
+		if _, err := startContainer(spec); err != nil {
 			log.Fatalf("Error: %v", err)
 		}
 		fmt.Println(id)
 	case "pull":
-		if len(os.Args) < 3 {
-			fmt.Println("Usage: mydocker pull <image>")
+		pullCmd := flag.NewFlagSet("pull", flag.ExitOnError)
+		platform := pullCmd.String("platform", "", "Pull for os/arch[/variant] instead of the host platform")
+		maxDownloads := pullCmd.Int("max-concurrent-downloads", registry.DefaultMaxConcurrentDownloads, "Number of layers downloaded in parallel")
+		pullCmd.Parse(os.Args[2:])
+		if pullCmd.NArg() < 1 {
+			fmt.Println("Usage: mydocker pull [--platform os/arch[/variant]] <image>")
 			os.Exit(1)
 		}
-		image := os.Args[2]
-		if err := pullImage(image); err != nil {
+		image := pullCmd.Arg(0)
+		if err := pullImage(image, *platform, *maxDownloads); err != nil {
 			fmt.Printf("Error pulling image %s: %v\n", image, err)
 			os.Exit(1)
 		}
 		fmt.Printf("Image %s pulled successfully\n", image)
+	case "push":
+		if len(os.Args) < 3 {
+			fmt.Println("Usage: mydocker push <image>")
+			os.Exit(1)
+		}
+		image := os.Args[2]
+		if err := pushImage(image); err != nil {
+			fmt.Printf("Error pushing image %s: %v\n", image, err)
+			os.Exit(1)
+		}
+	case "save":
+		if err := runSave(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error saving images: %v\n", err)
+			os.Exit(1)
+		}
+	case "load":
+		if err := runLoad(os.Args[2:]); err != nil {
+			fmt.Printf("Error loading images: %v\n", err)
+			os.Exit(1)
+		}
+	case "export":
+		if err := runExport(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error exporting container: %v\n", err)
+			os.Exit(1)
+		}
+	case "import":
+		if err := runImport(os.Args[2:]); err != nil {
+			fmt.Printf("Error importing image: %v\n", err)
+			os.Exit(1)
+		}
+	case "commit":
+		if err := runCommit(os.Args[2:]); err != nil {
+			fmt.Printf("Error committing container: %v\n", err)
+			os.Exit(1)
+		}
+	case "diff":
+		if err := runDiff(os.Args[2:]); err != nil {
+			fmt.Printf("Error diffing container: %v\n", err)
+			os.Exit(1)
+		}
+	case "cp":
+		if err := runCp(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error copying: %v\n", err)
+			os.Exit(1)
+		}
+	case "build":
+		if err := runBuild(os.Args[2:]); err != nil {
+			fmt.Printf("Error building image: %v\n", err)
+			os.Exit(1)
+		}
+	case "builder":
+		if err := runBuilder(os.Args[2:]); err != nil {
+			fmt.Printf("Error pruning build cache: %v\n", err)
+			os.Exit(1)
+		}
+	case "login":
+		if err := runLogin(os.Args[2:]); err != nil {
+			fmt.Printf("Error logging in: %v\n", err)
+			os.Exit(1)
+		}
+	case "logout":
+		if err := runLogout(os.Args[2:]); err != nil {
+			fmt.Printf("Error logging out: %v\n", err)
+			os.Exit(1)
+		}
 	case "ps":
 		containers, err := listContainers()
 		if err != nil {
@@ -137,18 +249,60 @@ func main() {
 		}
 		fmt.Printf("Command executed successfully in container %s\n", containerID)
 	case "images":
-		images, err := listImages()
-		if err != nil {
+		if err := runImages(os.Args[2:]); err != nil {
 			fmt.Printf("Error listing images: %v\n", err)
 			os.Exit(1)
 		}
-		if len(images) == 0 {
-			fmt.Println("No images found")
-		} else {
-			fmt.Println("Available images:")
-			for _, img := range images {
-				fmt.Println(img)
-			}
+	case "rmi":
+		if err := runRmi(os.Args[2:]); err != nil {
+			fmt.Printf("Error removing image: %v\n", err)
+			os.Exit(1)
+		}
+	case "tag":
+		if err := runTag(os.Args[2:]); err != nil {
+			fmt.Printf("Error tagging image: %v\n", err)
+			os.Exit(1)
+		}
+	case "history":
+		if err := runHistory(os.Args[2:]); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+	case "port":
+		if err := runPort(os.Args[2:]); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+	case "network":
+		if err := runNetwork(os.Args[2:]); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+	case "image":
+		if len(os.Args) < 3 {
+			fmt.Println("Usage: mydocker image <ls|rm|tag|prune|inspect|history> [options]")
+			os.Exit(1)
+		}
+		var err error
+		switch os.Args[2] {
+		case "ls":
+			err = runImages(os.Args[3:])
+		case "rm":
+			err = runRmi(os.Args[3:])
+		case "tag":
+			err = runTag(os.Args[3:])
+		case "prune":
+			err = runImagePrune(os.Args[3:])
+		case "inspect":
+			err = runImageInspect(os.Args[3:])
+		case "history":
+			err = runHistory(os.Args[3:])
+		default:
+			err = fmt.Errorf("unknown image command %q", os.Args[2])
+		}
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
 		}
 	case "child":
 		if len(os.Args) < 3 {
@@ -163,33 +317,142 @@ func main() {
 		fmt.Println("mydocker version 0.1.0")
 	default:
 		fmt.Printf("Unknown command: %s\n", os.Args[1])
-		fmt.Println("Available commands: run, pull, ps, stop")
+		fmt.Println("Available commands: run, build, builder, pull, push, ps, stop, exec, port, images, rmi, tag, history, image, network, save, load, import, export, commit, diff, cp, login, logout")
 		os.Exit(1)
 	}
 }
 
-/*// ───────────────────────────  images  ────────────────────────── */
-func listImages() ([]string, error) {
-	imagesDir := "/var/lib/mydocker/images"
-	files, err := os.ReadDir(imagesDir)
+// containerSpec describes a container for startContainer to create.
+type containerSpec struct {
+	ID      string
+	Image   string
+	Cmd     []string
+	Volumes []string
+	Ports   []network.PortMapping
+	// Resolved is the local image Image names, when the caller has already
+	// looked it up; otherwise startContainer does.
+	Resolved *image.Summary
+	// Env is the environment of the container process; when nil it
+	// inherits mydocker's own environment.
+	Env []string
+	// WorkingDir is created if needed and used as the process's cwd.
+	WorkingDir string
+	// User is a user name or uid[:gid] from the container's /etc/passwd.
+	User string
+	// Network is the network to attach the container to, DefaultNetwork
+	// when empty, or one of the modes "none", "host" and "container:<id>".
+	Network string
+	// ExtraHosts are added to the generated /etc/hosts.
+	ExtraHosts []network.HostEntry
+	// DNS, DNSSearch and DNSOptions replace the host's nameservers, search
+	// domains and options in the generated /etc/resolv.conf.
+	DNS, DNSSearch, DNSOptions []string
+}
+
+func startContainer(spec containerSpec) (_ int, err error) {
+	id, cmd, volumes, ports := spec.ID, spec.Cmd, spec.Volumes, spec.Ports
+	basePath := "/var/lib/mydocker"
+	containerPath := filepath.Join(basePath, "containers", id)
+	bundlePath := filepath.Join(containerPath, "bundle")
+
+	// Resolve the image once; what umoci unpacks and the platform recorded
+	// for the container come from the same store entry
+	var img image.Summary
+	if spec.Resolved != nil {
+		img = *spec.Resolved
+	} else {
+		var err error
+		if img, err = localImage(spec.Image); err != nil {
+			return 0, err
+		}
+	}
+	if img.Tag == "" {
+		return 0, fmt.Errorf("image %s is untagged; tag it to run it", spec.Image)
+	}
+	layout, err := image.OpenLayout(img.Repository)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read images directory: %v", err)
+		return 0, err
 	}
 
-	var images []string
-	for _, file := range files {
-		if file.IsDir() {
-			images = append(images, file.Name())
+	// Resolve the network mode before starting anything
+	mode := spec.Network
+	if mode == "" {
+		mode = network.DefaultNetwork
+	}
+	var nw *network.Network
+	var sharedNetns *os.File
+	var sharedIP string
+	switch {
+	case mode == "host" || mode == "none":
+	case strings.HasPrefix(mode, "container:"):
+		target, err := findContainer(strings.TrimPrefix(mode, "container:"))
+		if err != nil {
+			return 0, err
 		}
+		if !containerRunning(target) {
+			return 0, fmt.Errorf("cannot join network of container %s: it is not running", target.ID)
+		}
+		if len(ports) > 0 {
+			return 0, fmt.Errorf("conflicting options: port publishing and the container network mode")
+		}
+		// Holding the namespace open keeps it alive until the child joins it
+		sharedNetns, err = os.Open(fmt.Sprintf("/proc/%d/ns/net", target.PID))
+		if err != nil {
+			return 0, fmt.Errorf("failed to open network namespace of container %s: %v", target.ID, err)
+		}
+		defer sharedNetns.Close()
+		sharedIP = target.IP
+		mode = "container:" + target.ID
+	default:
+		var err error
+		if nw, err = network.Get(mode); err != nil {
+			return 0, err
+		}
+		mode = nw.Name
 	}
-	return images, nil
-}
+	if (mode == "host" || mode == "none") && len(ports) > 0 {
+		fmt.Fprintf(os.Stderr, "WARNING: Published ports are discarded when using %s network mode\n", mode)
+		ports = nil
+	}
+	// Published ports are served by this process when the daemon config
+	// enables the userland proxy; it lives as long as the container does
+	cfg, err := config.Load()
+	if err != nil {
+		return 0, err
+	}
+	userlandProxy := cfg.UserlandProxy
 
-func startContainer(id, image string, cmd []string, volumes []string, ports []PortMapping) (int, error) {
-	basePath := "/var/lib/mydocker"
-	imagePath := filepath.Join(basePath, "images", image)
-	containerPath := filepath.Join(basePath, "containers", id)
-	bundlePath := filepath.Join(containerPath, "bundle")
+	// Reserve the host ports up front so a conflict fails before anything
+	// is started
+	ports, err = network.AllocatePorts(id, ports)
+	if err != nil {
+		return 0, err
+	}
+
+	// info describes what has been set up so far. Until the container is
+	// recorded, a failure kills its process and tears all of it down here,
+	// as nothing on disk would tell removeContainer about it
+	info := ContainerInfo{
+		ID:          id,
+		Image:       spec.Image,
+		Cmd:         cmd,
+		Volumes:     volumes,
+		NetworkMode: mode,
+	}
+	var childCmd *exec.Cmd
+	recorded := false
+	defer func() {
+		if recorded {
+			return
+		}
+		if childCmd != nil && childCmd.Process != nil {
+			childCmd.Process.Kill()
+			childCmd.Wait()
+		}
+		if terr := teardownContainer(info); terr != nil {
+			err = fmt.Errorf("%v (cleaning up: %v)", err, terr)
+		}
+	}()
 
 	// Create bundle directory
 	if err := os.MkdirAll(bundlePath, 0755); err != nil {
@@ -197,16 +460,16 @@ func startContainer(id, image string, cmd []string, volumes []string, ports []Po
 	}
 
 	// Unpack OCI image into bundle
-	umociCmd := exec.Command("umoci", "unpack", "--image", imagePath, bundlePath)
+	umociCmd := exec.Command("umoci", "unpack", "--image", layout.Path+":"+img.Tag, bundlePath)
 	umociCmd.Stdout = os.Stdout
 	umociCmd.Stderr = os.Stderr
 	if err := umociCmd.Run(); err != nil {
 		return 0, fmt.Errorf("umoci unpack failed: %v", err)
 	}
 
-	// Set up cgroup for container (memory/CPU limits)
-	if err := cgroups.CreateCgroup(id, os.Getpid()); err != nil {
-		return 0, fmt.Errorf("failed to create cgroup: %v", err)
+	// Record the platform the image was built for
+	if info.Platform, err = imagePlatform(img, ""); err != nil {
+		return 0, err
 	}
 
 	// Prepare command to re-exec self as child process
@@ -218,28 +481,64 @@ func startContainer(id, image string, cmd []string, volumes []string, ports []Po
 		}
 	}
 
-	childCmd := exec.Command(exePath, append(append([]string{"child"}, id), cmd...)...)
+	childCmd = exec.Command(exePath, append(append([]string{"child"}, id), cmd...)...)
 	// Pass volume mounts via environment
 	volumesEnv := ""
 	if len(volumes) > 0 {
 		volumesEnv = strings.Join(volumes, ",")
 	}
-	childCmd.Env = append(os.Environ(), fmt.Sprintf("MYDOCKER_VOLUMES=%s", volumesEnv))
+	env := spec.Env
+	if env == nil {
+		env = os.Environ()
+	}
+	childCmd.Env = append(env,
+		fmt.Sprintf("MYDOCKER_VOLUMES=%s", volumesEnv),
+		fmt.Sprintf("MYDOCKER_WORKDIR=%s", spec.WorkingDir),
+		fmt.Sprintf("MYDOCKER_USER=%s", spec.User))
 	// Setup namespaces
 	childCmd.SysProcAttr = &syscall.SysProcAttr{
-		Cloneflags: syscall.CLONE_NEWUTS | syscall.CLONE_NEWPID | syscall.CLONE_NEWNS | syscall.CLONE_NEWNET,
+		Cloneflags: syscall.CLONE_NEWPID | syscall.CLONE_NEWNS,
+	}
+	if mode == "host" {
+		// The container goes by the host's name along with its network
+		childCmd.Env = append(childCmd.Env, "MYDOCKER_UTS=host")
+	} else {
+		childCmd.SysProcAttr.Cloneflags |= syscall.CLONE_NEWUTS
+	}
+	if mode != "host" && sharedNetns == nil {
+		childCmd.SysProcAttr.Cloneflags |= syscall.CLONE_NEWNET
 	}
 	childCmd.Stdin = os.Stdin
 	childCmd.Stdout = os.Stdout
 	childCmd.Stderr = os.Stderr
+	// The child waits on this pipe until its network is configured
+	syncR, syncW, err := os.Pipe()
+	if err != nil {
+		return 0, fmt.Errorf("failed to create sync pipe: %v", err)
+	}
+	defer syncW.Close()
+	childCmd.ExtraFiles = []*os.File{syncR}
+	if sharedNetns != nil {
+		// The child joins this namespace as fd 4
+		childCmd.ExtraFiles = append(childCmd.ExtraFiles, sharedNetns)
+		childCmd.Env = append(childCmd.Env, "MYDOCKER_NETNS_FD=4")
+	}
 
 	// Start container process
-	if err := childCmd.Start(); err != nil {
+	err = childCmd.Start()
+	syncR.Close()
+	if err != nil {
 		return 0, fmt.Errorf("failed to start container process: %v", err)
 	}
 	pid := childCmd.Process.Pid
+	info.PID = pid
 	fmt.Printf("spawned child with PID %d\n", pid)
 
+	// Set up cgroup for container (memory/CPU limits)
+	if err := cgroups.CreateCgroup(id, pid); err != nil {
+		return 0, fmt.Errorf("failed to create cgroup: %v", err)
+	}
+
 	// go func() {
 	// 	err := childCmd.Wait()
 	// 	if err != nil {
@@ -250,61 +549,71 @@ func startContainer(id, image string, cmd []string, volumes []string, ports []Po
 	// 	log.Printf("Container Checkpoint")
 	// }()
 
-	// Setup network: create bridge if not exists
-	exec.Command("ip", "link", "add", "mydocker0", "type", "bridge").Run()
-	exec.Command("ip", "link", "set", "mydocker0", "up").Run()
-
-	// Create veth pair for container networking
-	prefix := id
-	if len(id) > 5 {
-		prefix = id[:5]
-	}
-	vethHost := "veth" + prefix
-	vethCont := "eth0"
-	exec.Command("ip", "link", "add", vethHost, "type", "veth", "peer", "name", vethCont).Run()
-	// Attach container end of veth to container net namespace
-	exec.Command("ip", "link", "set", vethCont, "netns", strconv.Itoa(pid)).Run()
-	// Add host end of veth to bridge and bring up
-	exec.Command("ip", "link", "set", vethHost, "master", "mydocker0").Run()
-	exec.Command("ip", "link", "set", vethHost, "up").Run()
-	// Assign IP inside container
-	containerIP := "10.0.0.2"
-	exec.Command("ip", "netns", "exec", strconv.Itoa(pid), "ip", "addr", "add", containerIP+"/24", "dev", vethCont).Run()
-	exec.Command("ip", "netns", "exec", strconv.Itoa(pid), "ip", "link", "set", vethCont, "up").Run()
-
-	// Setup port mappings via iptables
-	for _, pm := range ports {
-		exec.Command("iptables", "-t", "nat", "-A", "PREROUTING", "-p", "tcp",
-			"--dport", strconv.Itoa(pm.HostPort),
-			"-j", "DNAT", "--to-destination", fmt.Sprintf("%s:%d", containerIP, pm.ContainerPort)).Run()
-		exec.Command("iptables", "-t", "nat", "-A", "POSTROUTING", "-j", "MASQUERADE").Run()
-	}
-
-	// Write container metadata to config.json
-	info := ContainerInfo{
-		ID:      id,
-		Image:   image,
-		Cmd:     cmd,
-		Volumes: volumes,
-		Ports:   ports,
-		IP:      containerIP,
-		PID:     pid,
+	// Connect the container to its network
+	var endpoint EndpointInfo
+	switch {
+	case nw != nil:
+		endpoint, err = connectContainer(id, pid, nw, 0)
+	case mode == "none":
+		err = network.SetupLoopback(pid)
 	}
-	configPath := filepath.Join(containerPath, "config.json")
-	f, err := os.Create(configPath)
 	if err != nil {
-		return 0, fmt.Errorf("failed to create config file: %v", err)
+		return 0, fmt.Errorf("failed to set up container network: %v", err)
+	}
+	containerIP := endpoint.IP
+	info.IP, info.MAC = containerIP, endpoint.MAC
+	if nw != nil {
+		info.Networks = map[string]EndpointInfo{nw.Name: endpoint}
+	}
+
+	// Publish ports, with DNAT rules or the userland proxy
+	if nw != nil {
+		if userlandProxy {
+			info.UserlandProxy = true
+			var proxies []*network.Proxy
+			if proxies, err = network.StartProxies(containerIP, ports); err == nil {
+				defer func() {
+					for _, p := range proxies {
+						p.Close()
+					}
+				}()
+			}
+		} else {
+			// Set first, so rules installed before a failure are removed
+			info.Ports = ports
+			err = network.PublishPorts(id, nw.Bridge, containerIP, ports)
+		}
+		if err != nil {
+			return 0, fmt.Errorf("failed to publish ports: %v", err)
+		}
+	}
+	info.Ports = ports
+
+	// Generate the container's hosts, hostname and resolv.conf
+	hostsIP := containerIP
+	if sharedNetns != nil {
+		hostsIP = sharedIP
+	}
+	if err := writeEtcFiles(spec, hostsIP, mode); err != nil {
+		return 0, err
+	}
+
+	// Let the container process run now that its network is ready
+	if _, err := syncW.Write([]byte{0}); err != nil {
+		return 0, fmt.Errorf("failed to signal container process: %v", err)
 	}
-	defer f.Close()
-	enc := json.NewEncoder(f)
-	enc.SetIndent("", "    ")
-	if err := enc.Encode(info); err != nil {
-		return 0, fmt.Errorf("failed to write config: %v", err)
+	syncW.Close()
+
+	// Write container metadata to config.json. The child is not reaped
+	// before Wait, so its start time can be read
+	info.StartTime, _ = processStartTime(pid)
+	if err := writeContainer(info); err != nil {
+		return 0, err
 	}
+	recorded = true
 
 	if err := childCmd.Wait(); err != nil {
-		fmt.Printf("Error Waiting for command: %v\n", err)
-		os.Exit(1)
+		return pid, fmt.Errorf("container process failed: %w", err)
 	}
 
 	return pid, nil
@@ -324,8 +633,50 @@ func child(containerID string) error {
 	// Optionally load entrypoint from env or predefined args
 	// cmdArgs := []string{cmdPath}
 
-	// Mount volume if any
+	// Settings passed by startContainer are not part of the container's
+	// environment.
 	volEnv := os.Getenv("MYDOCKER_VOLUMES")
+	workDir := os.Getenv("MYDOCKER_WORKDIR")
+	user := os.Getenv("MYDOCKER_USER")
+	netnsFD := os.Getenv("MYDOCKER_NETNS_FD")
+	uts := os.Getenv("MYDOCKER_UTS")
+	for _, key := range []string{"MYDOCKER_VOLUMES", "MYDOCKER_WORKDIR", "MYDOCKER_USER", "MYDOCKER_NETNS_FD", "MYDOCKER_UTS"} {
+		os.Unsetenv(key)
+	}
+
+	// Join the network namespace of another container. setns only moves
+	// the calling thread, so stay on it: the command is forked from here.
+	if netnsFD != "" {
+		fd, err := strconv.Atoi(netnsFD)
+		if err != nil {
+			return fmt.Errorf("invalid network namespace fd %q", netnsFD)
+		}
+		runtime.LockOSThread()
+		if err := netns.Set(netns.NsHandle(fd)); err != nil {
+			return fmt.Errorf("failed to join network namespace: %v", err)
+		}
+		syscall.Close(fd)
+	}
+
+	// Wait until startContainer has set up the network and /etc files
+	syncPipe := os.NewFile(3, "sync")
+	n, _ := syncPipe.Read(make([]byte, 1))
+	syncPipe.Close()
+	if n != 1 {
+		return fmt.Errorf("container setup was aborted")
+	}
+
+	// Keep the mounts below out of the host's mount namespace
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("failed to make mounts private: %v", err)
+	}
+
+	// Mount the generated /etc files; volumes may still override them
+	if err := mountEtcFiles(containerPath, filepath.Join(bundlePath, "rootfs")); err != nil {
+		return err
+	}
+
+	// Mount volume if any
 	if volEnv != "" {
 		volumes := strings.Split(volEnv, ",")
 		for _, vol := range volumes {
@@ -336,8 +687,8 @@ func child(containerID string) error {
 			}
 			src := parts[0]
 			dst := filepath.Join(bundlePath, "rootfs", parts[1])
-			if err := os.MkdirAll(dst, 0755); err != nil {
-				log.Printf("failed to create mount point %s: %v", dst, err)
+			if err := makeMountPoint(containerPath, filepath.Join(bundlePath, "rootfs"), parts[1], true); err != nil {
+				log.Print(err)
 				continue
 			}
 			if err := syscall.Mount(src, dst, "", syscall.MS_BIND, ""); err != nil {
@@ -346,9 +697,16 @@ func child(containerID string) error {
 		}
 	}
 
-	// Set hostname
-	if err := syscall.Sethostname([]byte(containerID[:5])); err != nil {
-		return fmt.Errorf("failed to set hostname: %v", err)
+	// Set the hostname generated for the container, unless it shares the
+	// host's UTS namespace
+	if uts != "host" {
+		hostname, err := os.ReadFile(filepath.Join(containerPath, "hostname"))
+		if err != nil {
+			return fmt.Errorf("failed to read hostname: %v", err)
+		}
+		if err := syscall.Sethostname([]byte(strings.TrimSpace(string(hostname)))); err != nil {
+			return fmt.Errorf("failed to set hostname: %v", err)
+		}
 	}
 	// Change root
 	if err := syscall.Chroot(filepath.Join(bundlePath, "rootfs")); err != nil {
@@ -368,8 +726,24 @@ func child(containerID string) error {
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
+	if workDir != "" {
+		if err := os.MkdirAll(workDir, 0755); err != nil {
+			return fmt.Errorf("failed to create working directory: %v", err)
+		}
+		cmd.Dir = workDir
+	}
+	if user != "" {
+		cred, err := lookupUser(user)
+		if err != nil {
+			return err
+		}
+		cmd.SysProcAttr = &syscall.SysProcAttr{Credential: cred}
+	}
 
 	if err := cmd.Run(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			os.Exit(exitErr.ExitCode())
+		}
 		fmt.Printf("Error: %v\n", err)
 		os.Exit(1)
 	}
@@ -483,81 +857,76 @@ func stopContainer(id string) error {
 		return fmt.Errorf("failed to parse config for container %s: %v", id, err)
 	}
 
-	// Kill the process
-	if info.PID > 0 {
-		if err := syscall.Kill(info.PID, syscall.SIGKILL); err != nil {
+	// Kill the process; it may already have exited on its own, and its PID
+	// then belongs to someone else
+	if containerRunning(info) {
+		if err := syscall.Kill(info.PID, syscall.SIGKILL); err != nil && err != syscall.ESRCH {
 			return fmt.Errorf("failed to kill process %d: %v", info.PID, err)
 		}
 	}
 
-	// Remove cgroup
-	cgroups.RemoveCgroup(id)
-
-	// Remove network setup
-	vethHost := "veth" + id[:5]
-	vethContainer := "eth0"
-	if err := network.Cleanup(vethHost, vethContainer); err != nil {
-		return fmt.Errorf("failed to clean up network: %v", err)
-	}
-
-	// Remove container directory
-	if err := os.RemoveAll(containerPath); err != nil {
-		return fmt.Errorf("failed to remove container directory %s: %v", containerPath, err)
+	if err := removeContainer(id); err != nil {
+		return err
 	}
 
 	fmt.Printf("Container %s stopped and cleaned up\n", id)
 	return nil
 }
 
-/* ───────────────────────────  PULL Image  ────────────────────────── */
-
-func pullImage(image string) error {
-	// Base directory for images (adjust as needed)
-	baseDir := "/var/lib/mydocker/images"
-
-	// Parse image reference into repository and tag
-	ref := image
-	tag := "latest"
-	if parts := strings.SplitN(ref, "@", 2); len(parts) > 1 {
-		// Remove any digest suffix
-		ref = parts[0]
-	}
-	// If the last colon is after the last slash, split tag
-	if i := strings.LastIndex(ref, ":"); i != -1 && i > strings.LastIndex(ref, "/") {
-		tag = ref[i+1:]
-		ref = ref[:i]
+// removeContainer tears down what startContainer set up for a container
+// whose process has exited and deletes its directory.
+func removeContainer(id string) error {
+	info, err := findContainer(id)
+	if err != nil {
+		// Without metadata only what is named after the ID can be found
+		info = ContainerInfo{ID: id}
 	}
+	return teardownContainer(info)
+}
 
-	// Build the directory path (preserving any registry in ref as part of path)
-	dir := filepath.Join(baseDir, filepath.FromSlash(ref))
+// teardownContainer removes the cgroup, published ports, interfaces,
+// addresses, port reservations and directory of the container info
+// describes.
+func teardownContainer(info ContainerInfo) error {
+	id := info.ID
+	containerPath := filepath.Join("/var/lib/mydocker/containers", id)
 
-	// Create the directory (and any needed parents)
-	if err := os.MkdirAll(dir, 0755); err != nil {
-		return fmt.Errorf("failed to create directory %q: %w", dir, err)
-	}
+	// Remove cgroup
+	cgroups.RemoveCgroup(id)
 
-	// Use skopeo to copy the image into OCI layout format
-	src := "docker://" + ref + ":" + tag
-	dest := fmt.Sprintf("oci:%s:%s", dir, tag)
-	cmd := exec.Command("skopeo", "copy", src, dest)
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("skopeo copy failed: %s", string(output))
+	// Remove published ports and network setup. Ports served by the
+	// userland proxy went with the process that ran it
+	if len(info.Ports) > 0 && !info.UserlandProxy {
+		if n, err := network.Get(info.NetworkMode); err == nil {
+			if err := network.UnpublishPorts(id, n.Bridge, info.IP, info.Ports); err != nil {
+				return fmt.Errorf("failed to remove published ports: %v", err)
+			}
+		}
 	}
-
-	// Verify the layout: index.json and oci-layout must exist
-	if _, err := os.Stat(filepath.Join(dir, "index.json")); os.IsNotExist(err) {
-		return fmt.Errorf("invalid OCI layout: index.json not found in %s", dir)
+	hostIfaces := []string{"veth" + id[:5]}
+	if info.NetworkMode != "" || len(info.Networks) > 0 {
+		// Containers in the none, host and container modes have no veth
+		hostIfaces = hostIfaces[:0]
+		for _, ep := range info.Networks {
+			hostIfaces = append(hostIfaces, ep.HostIface)
+		}
 	}
-	if _, err := os.Stat(filepath.Join(dir, "oci-layout")); os.IsNotExist(err) {
-		return fmt.Errorf("invalid OCI layout: oci-layout not found in %s", dir)
+	for _, iface := range hostIfaces {
+		if err := network.Cleanup(iface); err != nil {
+			return fmt.Errorf("failed to clean up network: %v", err)
+		}
+	}
+	if err := network.ReleaseAll(id); err != nil {
+		return fmt.Errorf("failed to release IP addresses: %v", err)
 	}
-	// Check that blobs/sha256 exists
-	if stat, err := os.Stat(filepath.Join(dir, "blobs", "sha256")); err != nil || !stat.IsDir() {
-		return fmt.Errorf("invalid OCI layout: blobs/sha256 not found or not a directory in %s", dir)
+	if err := network.ReleasePorts(id); err != nil {
+		return fmt.Errorf("failed to release host ports: %v", err)
 	}
 
-	// Successfully pulled and validated
+	// Remove container directory
+	if err := os.RemoveAll(containerPath); err != nil {
+		return fmt.Errorf("failed to remove container directory %s: %v", containerPath, err)
+	}
 	return nil
 }
 
@@ -609,3 +978,79 @@ func listContainers() ([]ContainerInfo, error) {
 	}
 	return containers, nil
 }
+
+// readContainers loads the metadata of every container without printing it.
+func readContainers() ([]ContainerInfo, error) {
+	containersDir := "/var/lib/mydocker/containers"
+	files, err := os.ReadDir(containersDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read containers directory: %v", err)
+	}
+
+	var containers []ContainerInfo
+	for _, file := range files {
+		if !file.IsDir() {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(containersDir, file.Name(), "config.json"))
+		if err != nil {
+			continue
+		}
+		var info ContainerInfo
+		if err := json.Unmarshal(data, &info); err != nil {
+			continue
+		}
+		containers = append(containers, info)
+	}
+	return containers, nil
+}
+
+// findContainer returns the container whose ID is id or starts with it.
+func findContainer(id string) (ContainerInfo, error) {
+	containers, err := readContainers()
+	if err != nil {
+		return ContainerInfo{}, err
+	}
+	var matches []ContainerInfo
+	for _, c := range containers {
+		if c.ID == id {
+			return c, nil
+		}
+		if id != "" && strings.HasPrefix(c.ID, id) {
+			matches = append(matches, c)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return ContainerInfo{}, fmt.Errorf("no such container: %s", id)
+	case 1:
+		return matches[0], nil
+	default:
+		return ContainerInfo{}, fmt.Errorf("container ID %s is ambiguous", id)
+	}
+}
+
+// writeContainer saves the metadata of a container to its config.json.
+func writeContainer(info ContainerInfo) error {
+	configPath := filepath.Join("/var/lib/mydocker/containers", info.ID, "config.json")
+	data, err := json.MarshalIndent(info, "", "    ")
+	if err != nil {
+		return fmt.Errorf("failed to encode config: %v", err)
+	}
+	tmp := configPath + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write config: %v", err)
+	}
+	if err := os.Rename(tmp, configPath); err != nil {
+		return fmt.Errorf("failed to write config: %v", err)
+	}
+	return nil
+}
+
+// containerRootfs returns the root file system directory of container id.
+func containerRootfs(id string) string {
+	return filepath.Join("/var/lib/mydocker/containers", id, "bundle/rootfs")
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"mydocker/network"
+)
+
+// EndpointInfo is a container's attachment to one network.
+type EndpointInfo struct {
+	NetworkID string `json:"networkId"`
+	IP        string `json:"ip"`
+	MAC       string `json:"mac"`
+	// Iface is the interface inside the container, HostIface the host end
+	// of its veth pair.
+	Iface     string `json:"iface"`
+	HostIface string `json:"hostIface"`
+}
+
+/* ───────────────────────────────  NETWORK  ──────────────────────────── */
+
+// runNetwork dispatches `mydocker network <command>`.
+func runNetwork(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: mydocker network <create|ls|inspect|rm|connect|disconnect> [options]")
+	}
+	switch args[0] {
+	case "create":
+		return runNetworkCreate(args[1:])
+	case "ls":
+		return runNetworkLs(args[1:])
+	case "inspect":
+		return runNetworkInspect(args[1:])
+	case "rm":
+		return runNetworkRm(args[1:])
+	case "connect":
+		return runNetworkConnect(args[1:])
+	case "disconnect":
+		return runNetworkDisconnect(args[1:])
+	default:
+		return fmt.Errorf("unknown network command %q", args[0])
+	}
+}
+
+// runNetworkCreate implements
+// `mydocker network create [-d bridge] [--subnet CIDR] [--gateway IP] NAME`.
+func runNetworkCreate(args []string) error {
+	createCmd := flag.NewFlagSet("network create", flag.ExitOnError)
+	driver := createCmd.String("d", "bridge", "Driver managing the network")
+	subnet := createCmd.String("subnet", "", "Subnet in CIDR form (default: a free 172.x.0.0/16)")
+	gateway := createCmd.String("gateway", "", "Gateway address (default: the subnet's first address)")
+	createCmd.Parse(args)
+	if createCmd.NArg() != 1 {
+		return fmt.Errorf("usage: mydocker network create [--subnet CIDR] [--gateway IP] <name>")
+	}
+	if *driver != "bridge" {
+		return fmt.Errorf("unsupported network driver %q", *driver)
+	}
+	n, err := network.Create(createCmd.Arg(0), network.CreateOptions{Subnet: *subnet, Gateway: *gateway})
+	if err != nil {
+		return err
+	}
+	fmt.Println(n.ID)
+	return nil
+}
+
+// runNetworkLs implements `mydocker network ls [-q]`.
+func runNetworkLs(args []string) error {
+	lsCmd := flag.NewFlagSet("network ls", flag.ExitOnError)
+	quiet := lsCmd.Bool("q", false, "Only display network IDs")
+	lsCmd.Parse(args)
+
+	networks, err := network.List()
+	if err != nil {
+		return err
+	}
+	if *quiet {
+		for _, n := range networks {
+			fmt.Println(n.ID[:12])
+		}
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(w, "NETWORK ID\tNAME\tDRIVER\tSUBNET\tGATEWAY")
+	for _, n := range networks {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", n.ID[:12], n.Name, n.Driver, n.Subnet, n.Gateway)
+	}
+	return w.Flush()
+}
+
+// networkDetails is what `network inspect` prints for a network.
+type networkDetails struct {
+	*network.Network
+	// Containers maps the IDs of attached containers to their endpoints.
+	Containers map[string]EndpointInfo `json:"containers"`
+}
+
+// runNetworkInspect implements `mydocker network inspect NETWORK...`.
+func runNetworkInspect(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: mydocker network inspect <network> [<network>...]")
+	}
+	containers, err := readContainers()
+	if err != nil {
+		return err
+	}
+	var details []networkDetails
+	for _, name := range args {
+		n, err := network.Get(name)
+		if err != nil {
+			return err
+		}
+		d := networkDetails{Network: n, Containers: map[string]EndpointInfo{}}
+		for _, c := range containers {
+			if ep, ok := c.Networks[n.Name]; ok {
+				d.Containers[c.ID] = ep
+			}
+		}
+		details = append(details, d)
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "    ")
+	return enc.Encode(details)
+}
+
+// runNetworkRm implements `mydocker network rm NETWORK...`.
+func runNetworkRm(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: mydocker network rm <network> [<network>...]")
+	}
+	for _, name := range args {
+		if _, err := network.Remove(name); err != nil {
+			return err
+		}
+		fmt.Println(name)
+	}
+	return nil
+}
+
+// runNetworkConnect implements `mydocker network connect NETWORK CONTAINER`,
+// adding an interface on the network to a running container.
+func runNetworkConnect(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage: mydocker network connect <network> <container>")
+	}
+	n, err := network.Get(args[0])
+	if err != nil {
+		return err
+	}
+	c, err := findContainer(args[1])
+	if err != nil {
+		return err
+	}
+	if !containerRunning(c) {
+		return fmt.Errorf("container %s is not running", c.ID)
+	}
+	if c.NetworkMode == "host" || c.NetworkMode == "none" || strings.HasPrefix(c.NetworkMode, "container:") {
+		return fmt.Errorf("container %s uses network mode %s and cannot be connected to networks", c.ID, c.NetworkMode)
+	}
+	if _, ok := c.Networks[n.Name]; ok {
+		return fmt.Errorf("container %s is already connected to network %s", c.ID, n.Name)
+	}
+
+	// Use the first interface index no endpoint has taken
+	used := map[string]bool{}
+	for _, ep := range c.Networks {
+		used[ep.Iface] = true
+	}
+	index := 0
+	for used[fmt.Sprintf("eth%d", index)] {
+		index++
+	}
+	ep, err := connectContainer(c.ID, c.PID, n, index)
+	if err != nil {
+		return err
+	}
+	if c.Networks == nil {
+		c.Networks = map[string]EndpointInfo{}
+	}
+	c.Networks[n.Name] = ep
+	return writeContainer(c)
+}
+
+// runNetworkDisconnect implements
+// `mydocker network disconnect NETWORK CONTAINER`.
+func runNetworkDisconnect(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage: mydocker network disconnect <network> <container>")
+	}
+	n, err := network.Get(args[0])
+	if err != nil {
+		return err
+	}
+	c, err := findContainer(args[1])
+	if err != nil {
+		return err
+	}
+	ep, ok := c.Networks[n.Name]
+	if !ok {
+		return fmt.Errorf("container %s is not connected to network %s", c.ID, n.Name)
+	}
+	if n.Name == c.NetworkMode && len(c.Ports) > 0 {
+		// The published ports forward to this endpoint's address and are
+		// only taken down with the container
+		return fmt.Errorf("container %s publishes ports on network %s; stop it instead", c.ID, n.Name)
+	}
+	if err := network.Cleanup(ep.HostIface); err != nil {
+		return err
+	}
+	if err := network.Release(n.Name, c.ID); err != nil {
+		return err
+	}
+	delete(c.Networks, n.Name)
+	return writeContainer(c)
+}
+
+// connectContainer attaches the network namespace of pid to n as interface
+// eth<index>. Only the first interface gets a default route.
+func connectContainer(id string, pid int, n *network.Network, index int) (EndpointInfo, error) {
+	pool, err := n.Pool()
+	if err != nil {
+		return EndpointInfo{}, err
+	}
+	ip, err := pool.Allocate(id)
+	if err != nil {
+		return EndpointInfo{}, fmt.Errorf("failed to allocate IP address: %v", err)
+	}
+
+	prefix := id
+	if len(id) > 5 {
+		prefix = id[:5]
+	}
+	ep := network.Endpoint{
+		Bridge:    pool.Bridge,
+		HostIface: "veth" + prefix,
+		Iface:     fmt.Sprintf("eth%d", index),
+		Address:   &net.IPNet{IP: ip, Mask: pool.Subnet.Mask},
+		MAC:       network.MACAddress(ip),
+	}
+	if index > 0 {
+		ep.HostIface = fmt.Sprintf("veth%s%d", prefix, index)
+	} else {
+		ep.Gateway = pool.Gateway
+	}
+	err = network.SetupBridge(pool.Bridge, pool.GatewayAddr())
+	if err == nil {
+		err = network.TrySetupNAT(n)
+	}
+	if err == nil {
+		err = network.SetupNetwork(pid, ep)
+	}
+	if err != nil {
+		network.Release(pool.Network, id)
+		return EndpointInfo{}, err
+	}
+	return EndpointInfo{
+		NetworkID: n.ID,
+		IP:        ip.String(),
+		MAC:       ep.MAC.String(),
+		Iface:     ep.Iface,
+		HostIface: ep.HostIface,
+	}, nil
+}
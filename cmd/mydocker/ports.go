@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"mydocker/image"
+	"mydocker/network"
+)
+
+/* ───────────────────────────────  PORTS  ──────────────────────────── */
+
+// parsePortSpec parses a `-p` value,
+// [hostIP:][hostPort[-end]:]containerPort[-end][/tcp|udp]. A missing host
+// port is left 0 for the port allocator to pick, as is the choice within a
+// host range published for a single container port.
+func parsePortSpec(spec string) ([]network.PortMapping, error) {
+	rest, proto := spec, "tcp"
+	if i := strings.LastIndex(spec, "/"); i >= 0 {
+		rest, proto = spec[:i], strings.ToLower(spec[i+1:])
+	}
+	if proto != "tcp" && proto != "udp" {
+		return nil, fmt.Errorf("invalid port mapping %s: unsupported protocol %q", spec, proto)
+	}
+
+	var hostIP, hostPart, containerPart string
+	parts := strings.Split(rest, ":")
+	switch len(parts) {
+	case 1:
+		containerPart = parts[0]
+	case 2:
+		hostPart, containerPart = parts[0], parts[1]
+	case 3:
+		hostIP, hostPart, containerPart = parts[0], parts[1], parts[2]
+		if ip := net.ParseIP(hostIP); ip == nil || ip.To4() == nil {
+			return nil, fmt.Errorf("invalid port mapping %s: invalid host IP %q", spec, hostIP)
+		}
+	default:
+		return nil, fmt.Errorf("invalid port mapping %s, expected [hostIP:][hostPort:]containerPort[/protocol]", spec)
+	}
+
+	cStart, cEnd, err := parsePortRange(containerPart)
+	if err != nil {
+		return nil, fmt.Errorf("invalid container port in %s: %v", spec, err)
+	}
+	hStart, hEnd := 0, 0
+	if hostPart != "" {
+		if hStart, hEnd, err = parsePortRange(hostPart); err != nil {
+			return nil, fmt.Errorf("invalid host port in %s: %v", spec, err)
+		}
+		if cEnd == cStart && hEnd > hStart {
+			return []network.PortMapping{{HostIP: hostIP, HostPort: hStart, HostPortEnd: hEnd, ContainerPort: cStart, Protocol: proto}}, nil
+		}
+		if hEnd-hStart != cEnd-cStart {
+			return nil, fmt.Errorf("invalid port mapping %s: host and container port ranges differ in size", spec)
+		}
+	}
+
+	var mappings []network.PortMapping
+	for i := 0; i <= cEnd-cStart; i++ {
+		pm := network.PortMapping{HostIP: hostIP, ContainerPort: cStart + i, Protocol: proto}
+		if hStart != 0 {
+			pm.HostPort = hStart + i
+		}
+		mappings = append(mappings, pm)
+	}
+	return mappings, nil
+}
+
+// parsePortRange parses "port" or "start-end".
+func parsePortRange(s string) (int, int, error) {
+	startStr, endStr, isRange := strings.Cut(s, "-")
+	start, err := parsePort(startStr)
+	if err != nil {
+		return 0, 0, err
+	}
+	if !isRange {
+		return start, start, nil
+	}
+	end, err := parsePort(endStr)
+	if err != nil {
+		return 0, 0, err
+	}
+	if end < start {
+		return 0, 0, fmt.Errorf("invalid range %s", s)
+	}
+	return start, end, nil
+}
+
+func parsePort(s string) (int, error) {
+	port, err := strconv.Atoi(s)
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("invalid port %q", s)
+	}
+	return port, nil
+}
+
+// exposedPorts returns a mapping to a host port yet to be chosen for every
+// port img declares with EXPOSE, for `run -P`.
+func exposedPorts(img image.Summary) ([]network.PortMapping, error) {
+	cfg, err := img.Config()
+	if err != nil {
+		return nil, err
+	}
+	var mappings []network.PortMapping
+	for exposed := range cfg.Config.ExposedPorts {
+		port, proto, _ := strings.Cut(exposed, "/")
+		if proto == "" {
+			proto = "tcp"
+		}
+		p, err := parsePort(port)
+		if err != nil || (proto != "tcp" && proto != "udp") {
+			return nil, fmt.Errorf("image %s exposes invalid port %q", summaryRef(img), exposed)
+		}
+		mappings = append(mappings, network.PortMapping{ContainerPort: p, Protocol: proto})
+	}
+	sort.Slice(mappings, func(i, j int) bool {
+		if mappings[i].ContainerPort != mappings[j].ContainerPort {
+			return mappings[i].ContainerPort < mappings[j].ContainerPort
+		}
+		return mappings[i].Proto() < mappings[j].Proto()
+	})
+	return mappings, nil
+}
+
+// runPort implements `mydocker port CONTAINER [PRIVATE_PORT[/PROTO]]`.
+func runPort(args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return fmt.Errorf("usage: mydocker port <container> [<private_port>[/<proto>]]")
+	}
+	c, err := findContainer(args[0])
+	if err != nil {
+		return err
+	}
+	var filter *network.PortMapping
+	if len(args) == 2 {
+		port, proto, _ := strings.Cut(args[1], "/")
+		p, err := parsePort(port)
+		if err != nil {
+			return err
+		}
+		filter = &network.PortMapping{ContainerPort: p, Protocol: proto}
+	}
+	found := false
+	for _, pm := range c.Ports {
+		if filter != nil && (pm.ContainerPort != filter.ContainerPort || pm.Proto() != filter.Proto()) {
+			continue
+		}
+		found = true
+		if filter != nil {
+			fmt.Println(pm.HostAddr())
+		} else {
+			fmt.Println(pm)
+		}
+	}
+	if filter != nil && !found {
+		return fmt.Errorf("no public port '%s' published for %s", args[1], c.ID)
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"mydocker/network"
+)
+
+func TestParsePortSpec(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    []network.PortMapping
+		wantErr bool
+	}{
+		{in: "80", want: []network.PortMapping{{ContainerPort: 80, Protocol: "tcp"}}},
+		{in: "8080:80", want: []network.PortMapping{{HostPort: 8080, ContainerPort: 80, Protocol: "tcp"}}},
+		{in: "8080:80/udp", want: []network.PortMapping{{HostPort: 8080, ContainerPort: 80, Protocol: "udp"}}},
+		{in: "8080:80/TCP", want: []network.PortMapping{{HostPort: 8080, ContainerPort: 80, Protocol: "tcp"}}},
+		{in: "127.0.0.1:8080:80", want: []network.PortMapping{{HostIP: "127.0.0.1", HostPort: 8080, ContainerPort: 80, Protocol: "tcp"}}},
+		{in: "127.0.0.1::80", want: []network.PortMapping{{HostIP: "127.0.0.1", ContainerPort: 80, Protocol: "tcp"}}},
+		{in: "53/udp", want: []network.PortMapping{{ContainerPort: 53, Protocol: "udp"}}},
+		{in: "8000-8001:80-81", want: []network.PortMapping{
+			{HostPort: 8000, ContainerPort: 80, Protocol: "tcp"},
+			{HostPort: 8001, ContainerPort: 81, Protocol: "tcp"},
+		}},
+		{in: "80-81", want: []network.PortMapping{
+			{ContainerPort: 80, Protocol: "tcp"},
+			{ContainerPort: 81, Protocol: "tcp"},
+		}},
+		{in: "8000-8010:80", want: []network.PortMapping{{HostPort: 8000, HostPortEnd: 8010, ContainerPort: 80, Protocol: "tcp"}}},
+		{in: "8000-8002:80-81", wantErr: true},
+		{in: "8080:80/sctp", wantErr: true},
+		{in: "::1:8080:80", wantErr: true},
+		{in: "localhost:8080:80", wantErr: true},
+		{in: "0:80", wantErr: true},
+		{in: "8080:65536", wantErr: true},
+		{in: "8080:", wantErr: true},
+		{in: "x:80", wantErr: true},
+		{in: "81-80", wantErr: true},
+		{in: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parsePortSpec(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parsePortSpec(%q) = %+v, want an error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parsePortSpec(%q) failed: %v", tt.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parsePortSpec(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParsePortRange(t *testing.T) {
+	tests := []struct {
+		in         string
+		start, end int
+		wantErr    bool
+	}{
+		{in: "1", start: 1, end: 1},
+		{in: "65535", start: 65535, end: 65535},
+		{in: "80-80", start: 80, end: 80},
+		{in: "80-90", start: 80, end: 90},
+		{in: "90-80", wantErr: true},
+		{in: "80-", wantErr: true},
+		{in: "-80", wantErr: true},
+		{in: "0", wantErr: true},
+		{in: "65536", wantErr: true},
+		{in: "http", wantErr: true},
+	}
+	for _, tt := range tests {
+		start, end, err := parsePortRange(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parsePortRange(%q) = %d, %d, want an error", tt.in, start, end)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parsePortRange(%q) failed: %v", tt.in, err)
+			continue
+		}
+		if start != tt.start || end != tt.end {
+			t.Errorf("parsePortRange(%q) = %d, %d, want %d, %d", tt.in, start, end, tt.start, tt.end)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+/* ───────────────────────────  Transfer progress  ────────────────────────── */
+
+// progressPrinter shows one line per blob being transferred. On a terminal
+// the lines are redrawn in place as progress bars; otherwise a plain line is
+// printed when a blob starts and when it finishes.
+type progressPrinter struct {
+	mu       sync.Mutex
+	out      io.Writer
+	tty      bool
+	order    []string
+	lines    map[string]string
+	started  map[string]bool
+	drawn    int
+	lastDraw time.Time
+}
+
+func newProgressPrinter() *progressPrinter {
+	return &progressPrinter{
+		out:     os.Stdout,
+		tty:     isTerminal(os.Stdout),
+		lines:   map[string]string{},
+		started: map[string]bool{},
+	}
+}
+
+// Update implements registry.Progress.
+func (p *progressPrinter) Update(id, action string, current, total int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.tty {
+		if !p.started[id] {
+			p.started[id] = true
+			fmt.Fprintf(p.out, "%s: %s\n", id, action)
+		}
+		return
+	}
+	p.set(id, fmt.Sprintf("%s: %-12s %s", id, action, progressBar(current, total)))
+	if time.Since(p.lastDraw) > 100*time.Millisecond {
+		p.redraw()
+	}
+}
+
+// Done implements registry.Progress.
+func (p *progressPrinter) Done(id, message string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	line := fmt.Sprintf("%s: %s", id, message)
+	if !p.tty {
+		fmt.Fprintln(p.out, line)
+		return
+	}
+	p.set(id, line)
+	p.redraw()
+}
+
+// Message implements registry.Progress. On a terminal the line goes above
+// the progress lines, which are redrawn below it.
+func (p *progressPrinter) Message(line string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.tty || p.drawn == 0 {
+		fmt.Fprintln(p.out, line)
+		return
+	}
+	fmt.Fprintf(p.out, "\x1b[%dA\x1b[2K%s\n", p.drawn, line)
+	p.drawn = 0
+	p.redraw()
+}
+
+func (p *progressPrinter) set(id, line string) {
+	if _, ok := p.lines[id]; !ok {
+		p.order = append(p.order, id)
+	}
+	p.lines[id] = line
+}
+
+// redraw moves the cursor back over the lines drawn last time and rewrites
+// every line.
+func (p *progressPrinter) redraw() {
+	if p.drawn > 0 {
+		fmt.Fprintf(p.out, "\x1b[%dA", p.drawn)
+	}
+	for _, id := range p.order {
+		fmt.Fprintf(p.out, "\x1b[2K%s\n", p.lines[id])
+	}
+	p.drawn = len(p.order)
+	p.lastDraw = time.Now()
+}
+
+// progressBar renders e.g. "[=========>          ]  12.3MB/45.6MB".
+func progressBar(current, total int64) string {
+	if total <= 0 {
+		return humanSize(current)
+	}
+	const width = 40
+	filled := int(float64(width) * float64(current) / float64(total))
+	if filled > width {
+		filled = width
+	}
+	bar := strings.Repeat("=", filled)
+	if filled < width {
+		bar += ">" + strings.Repeat(" ", width-filled-1)
+	}
+	return fmt.Sprintf("[%s] %8s/%s", bar, humanSize(current), humanSize(total))
+}
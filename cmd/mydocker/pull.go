@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+
+	"mydocker/image"
+	"mydocker/registry"
+)
+
+/* ───────────────────────────  PULL Image  ────────────────────────── */
+
+// pullImage downloads an image from its registry into the local OCI layout
+// for its repository. platformName selects the entry of a multi-arch image
+// and defaults to the host platform; maxDownloads bounds parallel fetches.
+func pullImage(name, platformName string, maxDownloads int) error {
+	ref, err := image.ParseReference(name)
+	if err != nil {
+		return err
+	}
+	opts := registry.PullOptions{
+		Platform:               image.DefaultPlatform(),
+		MaxConcurrentDownloads: maxDownloads,
+	}
+	if platformName != "" {
+		if opts.Platform, err = image.ParsePlatform(platformName); err != nil {
+			return err
+		}
+		opts.StrictPlatform = true
+	}
+
+	fmt.Printf("Pulling from %s\n", ref)
+	desc, err := registry.Pull(ref, opts, newProgressPrinter())
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Digest: %s\n", desc.Digest)
+	return nil
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"fmt"
+
+	"mydocker/image"
+	"mydocker/registry"
+)
+
+/* ───────────────────────────  PUSH Image  ────────────────────────── */
+
+// pushImage uploads a local image to the registry named by its reference.
+func pushImage(name string) error {
+	ref, err := image.ParseReference(name)
+	if err != nil {
+		return err
+	}
+	host, path := registry.SplitRepository(ref.Repository)
+	fmt.Printf("The push refers to repository [%s/%s]\n", host, path)
+	d, err := registry.Push(ref, newProgressPrinter())
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s: digest: %s\n", ref.Tag, d)
+	return nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// lookupUser resolves a Dockerfile USER value, "user[:group]" by name or
+// numeric id, against /etc/passwd and /etc/group of the current root. It
+// must run after the chroot into the container.
+func lookupUser(spec string) (*syscall.Credential, error) {
+	userPart, groupPart, hasGroup := strings.Cut(spec, ":")
+	cred := &syscall.Credential{}
+
+	passwd, err := readColonFile("/etc/passwd")
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if uid, err := strconv.ParseUint(userPart, 10, 32); err == nil {
+		cred.Uid = uint32(uid)
+		for _, fields := range passwd {
+			if len(fields) > 3 && fields[2] == userPart {
+				gid, _ := strconv.ParseUint(fields[3], 10, 32)
+				cred.Gid = uint32(gid)
+				break
+			}
+		}
+	} else {
+		found := false
+		for _, fields := range passwd {
+			if len(fields) > 3 && fields[0] == userPart {
+				uid, _ := strconv.ParseUint(fields[2], 10, 32)
+				gid, _ := strconv.ParseUint(fields[3], 10, 32)
+				cred.Uid, cred.Gid = uint32(uid), uint32(gid)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unable to find user %s: no matching entries in passwd file", userPart)
+		}
+	}
+
+	if !hasGroup {
+		return cred, nil
+	}
+	if gid, err := strconv.ParseUint(groupPart, 10, 32); err == nil {
+		cred.Gid = uint32(gid)
+		return cred, nil
+	}
+	groups, err := readColonFile("/etc/group")
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, fields := range groups {
+		if len(fields) > 2 && fields[0] == groupPart {
+			gid, _ := strconv.ParseUint(fields[2], 10, 32)
+			cred.Gid = uint32(gid)
+			return cred, nil
+		}
+	}
+	return nil, fmt.Errorf("unable to find group %s: no matching entries in group file", groupPart)
+}
+
+// readColonFile reads a passwd(5) style file into its fields.
+func readColonFile(path string) ([][]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var entries [][]string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entries = append(entries, strings.Split(line, ":"))
+	}
+	return entries, scanner.Err()
+}
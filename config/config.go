@@ -0,0 +1,70 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// DefaultPath is where the daemon configuration lives unless
+// MYDOCKER_DAEMON_CONFIG names another file.
+const DefaultPath = "/etc/mydocker/daemon.json"
+
+// Config is the daemon-wide configuration shared by every mydocker command.
+type Config struct {
+	// RegistryMirrors are pull-through caches for Docker Hub, tried in order
+	// before docker.io itself (same meaning as in Docker's daemon.json).
+	RegistryMirrors []string `json:"registry-mirrors,omitempty"`
+	// InsecureRegistries may be reached over plain HTTP or with unverified
+	// TLS. Entries are host[:port] names or CIDR ranges.
+	InsecureRegistries []string `json:"insecure-registries,omitempty"`
+	// Registries holds per-registry settings keyed by host[:port].
+	Registries map[string]Registry `json:"registries,omitempty"`
+	// BridgeIP is the address and subnet of the default bridge network in
+	// CIDR form, e.g. "10.0.0.1/24". Containers get addresses from that
+	// subnet.
+	BridgeIP string `json:"bip,omitempty"`
+	// UserlandProxy serves published ports with a proxy in the mydocker
+	// process supervising the container instead of DNAT rules.
+	UserlandProxy bool `json:"userland-proxy,omitempty"`
+	// FirewallBackend selects how NAT and published ports are set up:
+	// "iptables" or "nftables". Empty picks iptables when it works on the
+	// host and nftables otherwise.
+	FirewallBackend string `json:"firewall-backend,omitempty"`
+}
+
+// Registry is the configuration for one registry host.
+type Registry struct {
+	// Mirrors are tried in order before the registry itself when pulling.
+	// Each is a URL such as "https://mirror.internal:5000".
+	Mirrors []string `json:"mirrors,omitempty"`
+	// Insecure allows plain HTTP and unverified TLS for this registry.
+	Insecure bool `json:"insecure,omitempty"`
+	// CA is the path of a PEM bundle trusted in addition to the system
+	// roots.
+	CA string `json:"ca,omitempty"`
+}
+
+// Path returns the configuration file in use.
+func Path() string {
+	if p := os.Getenv("MYDOCKER_DAEMON_CONFIG"); p != "" {
+		return p
+	}
+	return DefaultPath
+}
+
+// Load reads the daemon configuration. A missing file yields the defaults.
+func Load() (*Config, error) {
+	cfg := &Config{}
+	data, err := os.ReadFile(Path())
+	if os.IsNotExist(err) {
+		return cfg, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read daemon config %s: %v", Path(), err)
+	}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse daemon config %s: %v", Path(), err)
+	}
+	return cfg, nil
+}
@@ -0,0 +1,490 @@
+package image
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Archive formats understood by Save and Load.
+const (
+	FormatDockerArchive = "docker-archive"
+	FormatOCIArchive    = "oci-archive"
+)
+
+// TempDir is scratch space for unpacking archives and building layers.
+const TempDir = "/var/lib/mydocker/tmp"
+
+// imageNameAnnotation carries the full image name in OCI archives, as
+// containerd and `docker save` do; ref.name only holds the tag.
+const imageNameAnnotation = "io.containerd.image.name"
+
+// dockerManifestEntry is one element of a docker-archive manifest.json.
+type dockerManifestEntry struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+// savedImage is an image selected for Save, resolved to a single manifest.
+type savedImage struct {
+	ref      Reference
+	layout   *Layout
+	desc     ocispec.Descriptor
+	manifest *ocispec.Manifest
+}
+
+// Save writes the named images to w as a docker-archive or oci-archive tar.
+func Save(w io.Writer, format string, names []string) error {
+	if format != FormatDockerArchive && format != FormatOCIArchive {
+		return fmt.Errorf("unsupported archive format %q", format)
+	}
+	var images []savedImage
+	for _, name := range names {
+		matches, err := Lookup(name)
+		if err != nil {
+			return err
+		}
+		for _, s := range matches {
+			l, err := OpenLayout(s.Repository)
+			if err != nil {
+				return err
+			}
+			desc, m, err := l.Manifest(s.desc)
+			if err != nil {
+				return err
+			}
+			ref := Reference{Repository: s.Repository, Tag: s.Tag}
+			images = append(images, savedImage{ref: ref, layout: l, desc: desc, manifest: m})
+		}
+	}
+
+	aw := &archiveWriter{tw: tar.NewWriter(w), written: map[string]bool{}}
+	var err error
+	if format == FormatDockerArchive {
+		err = aw.writeDockerArchive(images)
+	} else {
+		err = aw.writeOCIArchive(images)
+	}
+	if err != nil {
+		return err
+	}
+	return aw.tw.Close()
+}
+
+type archiveWriter struct {
+	tw      *tar.Writer
+	written map[string]bool
+}
+
+// blobName is the archive path of a blob; both formats use the OCI layout.
+func blobName(d digest.Digest) string {
+	return path.Join("blobs", d.Algorithm().String(), d.Encoded())
+}
+
+func (aw *archiveWriter) writeFile(name string, data []byte) error {
+	hdr := &tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), Typeflag: tar.TypeReg}
+	if err := aw.tw.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("failed to write %s: %v", name, err)
+	}
+	if _, err := aw.tw.Write(data); err != nil {
+		return fmt.Errorf("failed to write %s: %v", name, err)
+	}
+	return nil
+}
+
+// writeBlob copies a blob from l into the archive once.
+func (aw *archiveWriter) writeBlob(l *Layout, d digest.Digest) error {
+	name := blobName(d)
+	if aw.written[name] {
+		return nil
+	}
+	aw.written[name] = true
+	f, err := os.Open(l.BlobPath(d))
+	if err != nil {
+		return fmt.Errorf("failed to open blob %s: %v", d, err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	hdr := &tar.Header{Name: name, Mode: 0644, Size: info.Size(), Typeflag: tar.TypeReg}
+	if err := aw.tw.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("failed to write %s: %v", name, err)
+	}
+	if _, err := io.Copy(aw.tw, f); err != nil {
+		return fmt.Errorf("failed to write %s: %v", name, err)
+	}
+	return nil
+}
+
+// writeImageBlobs writes the config and layers of an image.
+func (aw *archiveWriter) writeImageBlobs(img savedImage) error {
+	if err := aw.writeBlob(img.layout, img.manifest.Config.Digest); err != nil {
+		return err
+	}
+	for _, layer := range img.manifest.Layers {
+		if err := aw.writeBlob(img.layout, layer.Digest); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeDockerArchive writes manifest.json and repositories in the format
+// `docker load` expects, with one entry per image ID listing all its tags.
+func (aw *archiveWriter) writeDockerArchive(images []savedImage) error {
+	var entries []*dockerManifestEntry
+	byConfig := map[digest.Digest]*dockerManifestEntry{}
+	repositories := map[string]map[string]string{}
+	for _, img := range images {
+		if err := aw.writeImageBlobs(img); err != nil {
+			return err
+		}
+		entry, ok := byConfig[img.manifest.Config.Digest]
+		if !ok {
+			entry = &dockerManifestEntry{Config: blobName(img.manifest.Config.Digest), RepoTags: []string{}}
+			for _, layer := range img.manifest.Layers {
+				entry.Layers = append(entry.Layers, blobName(layer.Digest))
+			}
+			byConfig[img.manifest.Config.Digest] = entry
+			entries = append(entries, entry)
+		}
+		if img.ref.Tag == "" {
+			continue
+		}
+		entry.RepoTags = append(entry.RepoTags, img.ref.String())
+		if len(img.manifest.Layers) > 0 {
+			if repositories[img.ref.Repository] == nil {
+				repositories[img.ref.Repository] = map[string]string{}
+			}
+			top := img.manifest.Layers[len(img.manifest.Layers)-1].Digest
+			repositories[img.ref.Repository][img.ref.Tag] = top.Encoded()
+		}
+	}
+
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	if err := aw.writeFile("manifest.json", data); err != nil {
+		return err
+	}
+	if data, err = json.Marshal(repositories); err != nil {
+		return err
+	}
+	return aw.writeFile("repositories", data)
+}
+
+// writeOCIArchive writes an OCI image layout with one index entry per image.
+func (aw *archiveWriter) writeOCIArchive(images []savedImage) error {
+	idx := ocispec.Index{Versioned: specs.Versioned{SchemaVersion: 2}, MediaType: ocispec.MediaTypeImageIndex}
+	for _, img := range images {
+		if err := aw.writeImageBlobs(img); err != nil {
+			return err
+		}
+		if err := aw.writeBlob(img.layout, img.desc.Digest); err != nil {
+			return err
+		}
+		desc := img.desc
+		desc.Annotations = nil
+		if img.ref.Tag != "" {
+			desc.Annotations = map[string]string{
+				ocispec.AnnotationRefName: img.ref.Tag,
+				imageNameAnnotation:       img.ref.String(),
+			}
+		}
+		idx.Manifests = append(idx.Manifests, desc)
+	}
+	layoutFile := fmt.Sprintf(`{"imageLayoutVersion":"%s"}`, ocispec.ImageLayoutVersion)
+	if err := aw.writeFile(ocispec.ImageLayoutFile, []byte(layoutFile)); err != nil {
+		return err
+	}
+	data, err := json.Marshal(idx)
+	if err != nil {
+		return err
+	}
+	return aw.writeFile("index.json", data)
+}
+
+/* ───────────────────────────  Load  ────────────────────────── */
+
+// Load imports a docker-archive or oci-archive tar (optionally gzip
+// compressed) into the local store and returns the references it tagged.
+func Load(r io.Reader) ([]string, error) {
+	if err := os.MkdirAll(TempDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create temp directory: %v", err)
+	}
+	dir, err := os.MkdirTemp(TempDir, "load-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	stream, err := decompress(r)
+	if err != nil {
+		return nil, err
+	}
+	if err := extractArchive(tar.NewReader(stream), dir); err != nil {
+		return nil, err
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "manifest.json")); err == nil {
+		return loadDockerArchive(dir)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "index.json")); err == nil {
+		return loadOCIArchive(dir)
+	}
+	return nil, fmt.Errorf("archive has neither manifest.json nor index.json")
+}
+
+// decompress transparently gunzips r when it starts with the gzip magic.
+func decompress(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(2)
+	if err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read gzip stream: %v", err)
+		}
+		return gz, nil
+	}
+	return br, nil
+}
+
+// safeJoin joins an archive path to root so the result cannot escape it.
+func safeJoin(root, name string) string {
+	return filepath.Join(root, filepath.Clean("/"+name))
+}
+
+// extractArchive unpacks regular files and directories into dir. Links,
+// which legacy docker archives use to share layer.tar files, are replaced by
+// hard links to their targets inside dir.
+func extractArchive(tr *tar.Reader, dir string) error {
+	type link struct{ name, target string }
+	var links []link
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read archive: %v", err)
+		}
+		dst := safeJoin(dir, hdr.Name)
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(dst, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, tr)
+			f.Close()
+			if err != nil {
+				return fmt.Errorf("failed to extract %s: %v", hdr.Name, err)
+			}
+		case tar.TypeSymlink:
+			links = append(links, link{hdr.Name, path.Join(path.Dir(hdr.Name), hdr.Linkname)})
+		case tar.TypeLink:
+			links = append(links, link{hdr.Name, hdr.Linkname})
+		}
+	}
+	for _, l := range links {
+		dst := safeJoin(dir, l.name)
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return err
+		}
+		if err := os.Link(safeJoin(dir, l.target), dst); err != nil {
+			return fmt.Errorf("failed to resolve link %s -> %s: %v", l.name, l.target, err)
+		}
+	}
+	return nil
+}
+
+// loadDockerArchive imports every entry of a docker-archive manifest.json.
+func loadDockerArchive(dir string) ([]string, error) {
+	data, err := os.ReadFile(filepath.Join(dir, "manifest.json"))
+	if err != nil {
+		return nil, err
+	}
+	var entries []dockerManifestEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest.json: %v", err)
+	}
+
+	var loaded []string
+	for _, entry := range entries {
+		if len(entry.RepoTags) == 0 {
+			return loaded, fmt.Errorf("image %s in archive has no tag to load it under", entry.Config)
+		}
+		var refs []Reference
+		for _, tag := range entry.RepoTags {
+			ref, err := ParseReference(tag)
+			if err != nil {
+				return loaded, err
+			}
+			refs = append(refs, ref)
+		}
+
+		l, err := CreateLayout(refs[0].Repository)
+		if err != nil {
+			return loaded, err
+		}
+		m := ocispec.Manifest{Versioned: specs.Versioned{SchemaVersion: 2}, MediaType: ocispec.MediaTypeImageManifest}
+		if m.Config, err = ingestFile(l, dir, entry.Config, ocispec.MediaTypeImageConfig); err != nil {
+			return loaded, err
+		}
+		for _, layer := range entry.Layers {
+			desc, err := ingestFile(l, dir, layer, "")
+			if err != nil {
+				return loaded, err
+			}
+			m.Layers = append(m.Layers, desc)
+		}
+		desc, err := l.writeManifest(&m)
+		if err != nil {
+			return loaded, err
+		}
+		for _, ref := range refs {
+			if err := tagInto(l, desc, ref); err != nil {
+				return loaded, err
+			}
+			loaded = append(loaded, ref.String())
+		}
+	}
+	return loaded, nil
+}
+
+// ingestFile copies an extracted archive file into l. An empty mediaType
+// means the file is a layer whose compression is detected from its header.
+func ingestFile(l *Layout, dir, name, mediaType string) (ocispec.Descriptor, error) {
+	f, err := os.Open(safeJoin(dir, name))
+	if err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("archive is missing %s: %v", name, err)
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	if mediaType == "" {
+		mediaType = layerMediaType(br)
+	}
+	d, size, err := l.IngestBlob(br)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	return ocispec.Descriptor{MediaType: mediaType, Digest: d, Size: size}, nil
+}
+
+// layerMediaType sniffs the compression of a layer tarball.
+func layerMediaType(br *bufio.Reader) string {
+	magic, _ := br.Peek(4)
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		return ocispec.MediaTypeImageLayerGzip
+	case bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return ocispec.MediaTypeImageLayerZstd
+	}
+	return ocispec.MediaTypeImageLayer
+}
+
+// writeManifest stores m and returns its descriptor, with the platform taken
+// from the image config.
+func (l *Layout) writeManifest(m *ocispec.Manifest) (ocispec.Descriptor, error) {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("failed to encode manifest: %v", err)
+	}
+	d, err := l.WriteBlob(data)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	desc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: d, Size: int64(len(data))}
+	if cfg, err := l.Config(m); err == nil {
+		platform := PlatformOf(cfg)
+		desc.Platform = &platform
+	}
+	return desc, nil
+}
+
+// tagInto tags desc, whose blobs live in from, as ref, linking the blobs
+// into ref's layout when it is a different one.
+func tagInto(from *Layout, desc ocispec.Descriptor, ref Reference) error {
+	to, err := CreateLayout(ref.Repository)
+	if err != nil {
+		return err
+	}
+	if to.Path != from.Path {
+		blobs, err := from.Blobs(desc)
+		if err != nil {
+			return err
+		}
+		for _, d := range blobs {
+			if err := to.LinkBlob(from, d); err != nil {
+				return err
+			}
+		}
+	}
+	return to.SetTag(ref.Tag, desc)
+}
+
+// loadOCIArchive imports every named entry of an OCI layout archive.
+func loadOCIArchive(dir string) ([]string, error) {
+	src := &Layout{Path: dir}
+	idx, err := src.Index()
+	if err != nil {
+		return nil, err
+	}
+	var loaded []string
+	for _, desc := range idx.Manifests {
+		ref, err := archiveRef(desc)
+		if err != nil {
+			return loaded, err
+		}
+		desc.Annotations = nil
+		if desc.Platform == nil && desc.MediaType == ocispec.MediaTypeImageManifest {
+			if _, m, err := src.Manifest(desc); err == nil {
+				if cfg, err := src.Config(m); err == nil {
+					platform := PlatformOf(cfg)
+					desc.Platform = &platform
+				}
+			}
+		}
+		if err := tagInto(src, desc, ref); err != nil {
+			return loaded, err
+		}
+		loaded = append(loaded, ref.String())
+	}
+	return loaded, nil
+}
+
+// archiveRef works out the image name of an OCI archive index entry from
+// the containerd name annotation, or a ref.name holding a full reference.
+func archiveRef(desc ocispec.Descriptor) (Reference, error) {
+	if name := desc.Annotations[imageNameAnnotation]; name != "" {
+		return ParseReference(name)
+	}
+	name := desc.Annotations[ocispec.AnnotationRefName]
+	if strings.ContainsAny(name, "/:") {
+		return ParseReference(name)
+	}
+	return Reference{}, fmt.Errorf("archive entry %s has no image name (ref.name %q is only a tag)", desc.Digest, name)
+}
@@ -0,0 +1,144 @@
+package image
+
+import (
+	"errors"
+	"fmt"
+
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// buildCacheAnnotation marks index entries that only exist as build cache:
+// the image after a build step, keyed by what the step depended on. They
+// keep their blobs alive but are hidden from listings and lookups, and are
+// removed by PruneBuildCache.
+const buildCacheAnnotation = "io.mydocker.build.cache-key"
+
+func isCacheEntry(desc ocispec.Descriptor) bool {
+	_, ok := desc.Annotations[buildCacheAnnotation]
+	return ok
+}
+
+// Cache records the draft, as last written, as the result of the build step
+// identified by key, replacing an earlier result for the same key.
+func (d *Draft) Cache(key string) error {
+	if d.desc.Digest == "" {
+		return fmt.Errorf("draft has not been written")
+	}
+	entry := d.desc
+	entry.Annotations = map[string]string{buildCacheAnnotation: key}
+	return d.layout.UpdateIndex(func(idx *ocispec.Index) error {
+		var manifests []ocispec.Descriptor
+		for _, desc := range idx.Manifests {
+			if desc.Annotations[buildCacheAnnotation] != key {
+				manifests = append(manifests, desc)
+			}
+		}
+		idx.Manifests = append(manifests, entry)
+		return nil
+	})
+}
+
+// CachedDraft returns a draft in repository's layout of the build step result
+// recorded under key, looking in that layout first and then in every other
+// one. It returns nil when there is no such result.
+func CachedDraft(repository, key string) (*Draft, error) {
+	layouts, err := Layouts()
+	if err != nil {
+		return nil, err
+	}
+	for i, l := range layouts {
+		if l.Repository == repository {
+			layouts[0], layouts[i] = layouts[i], layouts[0]
+			break
+		}
+	}
+	for _, l := range layouts {
+		idx, err := l.Index()
+		if err != nil {
+			continue
+		}
+		for _, desc := range idx.Manifests {
+			if desc.Annotations[buildCacheAnnotation] != key {
+				continue
+			}
+			to, err := CreateLayout(repository)
+			if err != nil {
+				return nil, err
+			}
+			d, err := draftFrom(to, l, desc)
+			if err != nil {
+				// A damaged entry is a cache miss, not a failed build.
+				continue
+			}
+			return d, nil
+		}
+	}
+	return nil, nil
+}
+
+// PruneBuildCache removes every build cache entry and the blobs only they
+// kept alive. It returns how many entries were removed and the space freed.
+// When another process holds the store the entries are still removed, but
+// the error is ErrStoreBusy and their blobs are left to a later prune.
+func PruneBuildCache() (int, int64, error) {
+	layouts, err := Layouts()
+	if err != nil {
+		return 0, 0, err
+	}
+	removed := 0
+	var reclaimed int64
+	var busy error
+	for _, l := range layouts {
+		err := l.UpdateIndex(func(idx *ocispec.Index) error {
+			var manifests []ocispec.Descriptor
+			for _, desc := range idx.Manifests {
+				if isCacheEntry(desc) {
+					removed++
+				} else {
+					manifests = append(manifests, desc)
+				}
+			}
+			idx.Manifests = manifests
+			return nil
+		})
+		if err != nil {
+			return removed, reclaimed, err
+		}
+		n, err := l.GC()
+		reclaimed += n
+		if errors.Is(err, ErrStoreBusy) {
+			busy = err
+			continue
+		}
+		if err != nil {
+			return removed, reclaimed, err
+		}
+	}
+	return removed, reclaimed, busy
+}
+
+// draftFrom starts a draft in to from the image desc stored in from.
+func draftFrom(to, from *Layout, desc ocispec.Descriptor) (*Draft, error) {
+	desc, m, err := from.Manifest(desc)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := from.Config(m)
+	if err != nil {
+		return nil, err
+	}
+	d := &Draft{layout: to, id: m.Config.Digest, desc: desc}
+	if to.Path != from.Path {
+		for _, layer := range m.Layers {
+			if err := to.LinkBlob(from, layer.Digest); err != nil {
+				return nil, err
+			}
+		}
+	}
+	d.Image = *cfg
+	d.Image.RootFS.DiffIDs = append([]digest.Digest(nil), cfg.RootFS.DiffIDs...)
+	d.Image.History = append([]ocispec.History(nil), cfg.History...)
+	d.Layers = append([]ocispec.Descriptor(nil), m.Layers...)
+	return d, nil
+}
@@ -0,0 +1,198 @@
+package image
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strings"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ApplyChange applies one Dockerfile-style instruction, such as
+// `CMD ["/bin/sh"]` or `ENV PATH=/usr/bin`, to cfg. Only instructions that
+// change image metadata are accepted.
+func ApplyChange(cfg *ocispec.ImageConfig, line string) error {
+	line = strings.TrimSpace(line)
+	keyword, args, _ := strings.Cut(line, " ")
+	args = strings.TrimSpace(args)
+	switch strings.ToUpper(keyword) {
+	case "CMD":
+		cfg.Cmd = parseCommand(args)
+	case "ENTRYPOINT":
+		cfg.Entrypoint = parseCommand(args)
+	case "ENV":
+		pairs, err := parsePairs(args)
+		if err != nil {
+			return fmt.Errorf("ENV: %v", err)
+		}
+		for _, kv := range pairs {
+			cfg.Env = setEnv(cfg.Env, kv[0], kv[1])
+		}
+	case "LABEL":
+		pairs, err := parsePairs(args)
+		if err != nil {
+			return fmt.Errorf("LABEL: %v", err)
+		}
+		if cfg.Labels == nil {
+			cfg.Labels = map[string]string{}
+		}
+		for _, kv := range pairs {
+			cfg.Labels[kv[0]] = kv[1]
+		}
+	case "WORKDIR":
+		if args == "" {
+			return fmt.Errorf("WORKDIR requires a path")
+		}
+		if !path.IsAbs(args) {
+			args = path.Join("/", cfg.WorkingDir, args)
+		}
+		cfg.WorkingDir = path.Clean(args)
+	case "USER":
+		if args == "" {
+			return fmt.Errorf("USER requires a user")
+		}
+		cfg.User = args
+	case "EXPOSE":
+		if cfg.ExposedPorts == nil {
+			cfg.ExposedPorts = map[string]struct{}{}
+		}
+		for _, port := range strings.Fields(args) {
+			if !strings.Contains(port, "/") {
+				port += "/tcp"
+			}
+			cfg.ExposedPorts[port] = struct{}{}
+		}
+	case "VOLUME":
+		if cfg.Volumes == nil {
+			cfg.Volumes = map[string]struct{}{}
+		}
+		for _, v := range parseList(args) {
+			cfg.Volumes[v] = struct{}{}
+		}
+	case "STOPSIGNAL":
+		if args == "" {
+			return fmt.Errorf("STOPSIGNAL requires a signal")
+		}
+		cfg.StopSignal = args
+	default:
+		return fmt.Errorf("unsupported change instruction %q", keyword)
+	}
+	return nil
+}
+
+// parseCommand accepts the exec form (a JSON array) or the shell form, which
+// runs the text through /bin/sh -c.
+func parseCommand(args string) []string {
+	if cmd, ok := parseJSONArray(args); ok {
+		return cmd
+	}
+	if args == "" {
+		return nil
+	}
+	return []string{"/bin/sh", "-c", args}
+}
+
+// parseList accepts a JSON array or whitespace separated words.
+func parseList(args string) []string {
+	if list, ok := parseJSONArray(args); ok {
+		return list
+	}
+	return strings.Fields(args)
+}
+
+func parseJSONArray(args string) ([]string, bool) {
+	if !strings.HasPrefix(args, "[") {
+		return nil, false
+	}
+	var list []string
+	if err := json.Unmarshal([]byte(args), &list); err != nil {
+		return nil, false
+	}
+	return list, true
+}
+
+// parsePairs parses `key=value ...` with shell-like quoting, or the legacy
+// `key value` form where everything after the first word is the value.
+func parsePairs(args string) ([][2]string, error) {
+	words, err := SplitWords(args)
+	if err != nil {
+		return nil, err
+	}
+	if len(words) == 0 {
+		return nil, fmt.Errorf("requires at least one argument")
+	}
+	if !strings.Contains(words[0], "=") {
+		key, value, _ := strings.Cut(args, " ")
+		words, err := SplitWords(strings.TrimSpace(value))
+		if err != nil {
+			return nil, err
+		}
+		return [][2]string{{key, strings.Join(words, " ")}}, nil
+	}
+	var pairs [][2]string
+	for _, w := range words {
+		key, value, ok := strings.Cut(w, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("expected key=value, got %q", w)
+		}
+		pairs = append(pairs, [2]string{key, value})
+	}
+	return pairs, nil
+}
+
+// SplitWords splits s on unquoted whitespace. Single and double quotes group
+// words and a backslash escapes the next character outside single quotes.
+func SplitWords(s string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	var quote rune
+	escaped := false
+	for _, r := range s {
+		switch {
+		case escaped:
+			word.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped = true
+			inWord = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '"' || r == '\'':
+			quote = r
+			inWord = true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quote in %q", s)
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+// setEnv sets key to value in env, replacing an existing entry.
+func setEnv(env []string, key, value string) []string {
+	for i, kv := range env {
+		if k, _, _ := strings.Cut(kv, "="); k == key {
+			env[i] = key + "=" + value
+			return env
+		}
+	}
+	return append(env, key+"="+value)
+}
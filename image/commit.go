@@ -0,0 +1,88 @@
+package image
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"mydocker/archive"
+
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// FileTree returns the metadata of the file system image name unpacks to,
+// built by applying its layers in order.
+func FileTree(name string) (archive.Tree, error) {
+	matches, err := Lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	l, _, m, _, err := matches[0].load()
+	if err != nil {
+		return nil, err
+	}
+	tree := archive.Tree{}
+	for _, layer := range m.Layers {
+		if err := l.applyLayer(tree, layer.Digest); err != nil {
+			return nil, err
+		}
+	}
+	return tree, nil
+}
+
+// applyLayer applies the layer blob d to tree.
+func (l *Layout) applyLayer(tree archive.Tree, d digest.Digest) error {
+	f, err := os.Open(l.BlobPath(d))
+	if err != nil {
+		return fmt.Errorf("failed to open layer %s: %v", d, err)
+	}
+	defer f.Close()
+	stream, err := decompress(f)
+	if err != nil {
+		return err
+	}
+	if err := tree.ApplyLayer(stream); err != nil {
+		return fmt.Errorf("layer %s: %v", d, err)
+	}
+	return nil
+}
+
+// CommitOptions describes the image Commit creates.
+type CommitOptions struct {
+	// Changes are Dockerfile-style instructions applied to the config.
+	Changes []string
+	// Message is recorded as the comment of the new history entry.
+	Message string
+	// Author is recorded in the config and the history entry.
+	Author string
+	// CreatedBy is the command recorded in the new history entry.
+	CreatedBy string
+	// Cmd, when set, replaces the command inherited from the base image.
+	Cmd []string
+}
+
+// Commit creates an image from the image base with the layer tar r on top
+// and tags it as ref.
+func Commit(base string, r io.Reader, ref Reference, opts CommitOptions) (Summary, error) {
+	d, err := NewDraft(ref.Repository, base)
+	if err != nil {
+		return Summary{}, err
+	}
+	if opts.Cmd != nil {
+		d.Image.Config.Cmd = opts.Cmd
+	}
+	for _, change := range opts.Changes {
+		if err := ApplyChange(&d.Image.Config, change); err != nil {
+			return Summary{}, err
+		}
+	}
+	if opts.Author != "" {
+		d.Image.Author = opts.Author
+	}
+	h := ocispec.History{CreatedBy: opts.CreatedBy, Author: opts.Author, Comment: opts.Message}
+	if err := d.AddLayer(r, h); err != nil {
+		return Summary{}, fmt.Errorf("failed to write layer: %v", err)
+	}
+	return d.Tag(ref.Tag)
+}
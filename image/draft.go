@@ -0,0 +1,137 @@
+package image
+
+import (
+	"io"
+	"time"
+
+	"mydocker/archive"
+
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Draft is an image being assembled in a layout one layer at a time, as
+// commit, import and build do. Nothing is visible in the store until the
+// draft is written and tagged. The blobs of a draft that is never tagged
+// stay until GC, which, unlike deleting them here, cannot remove a blob
+// another process is storing at the same time.
+type Draft struct {
+	// Image is the config being built; callers edit Image.Config directly.
+	Image  ocispec.Image
+	Layers []ocispec.Descriptor
+
+	layout *Layout
+	id     digest.Digest
+	desc   ocispec.Descriptor
+}
+
+// NewDraft starts an image in repository's layout on top of the image base,
+// or from scratch for the host platform when base is empty.
+func NewDraft(repository, base string) (*Draft, error) {
+	if base == "" {
+		to, err := CreateLayout(repository)
+		if err != nil {
+			return nil, err
+		}
+		d := &Draft{layout: to}
+		d.Image = ocispec.Image{
+			Platform: DefaultPlatform(),
+			RootFS:   ocispec.RootFS{Type: "layers"},
+		}
+		return d, nil
+	}
+
+	matches, err := Lookup(base)
+	if err != nil {
+		return nil, err
+	}
+	from, err := OpenLayout(matches[0].Repository)
+	if err != nil {
+		return nil, err
+	}
+	to, err := CreateLayout(repository)
+	if err != nil {
+		return nil, err
+	}
+	d, err := draftFrom(to, from, matches[0].desc)
+	if err != nil {
+		return nil, err
+	}
+	// The base is only a starting point; it is not what the draft holds.
+	d.desc = ocispec.Descriptor{}
+	return d, nil
+}
+
+// AddLayer stores the layer tar r and appends it, with h as its history.
+func (d *Draft) AddLayer(r io.Reader, h ocispec.History) error {
+	layer, diffID, err := d.layout.WriteLayer(r)
+	if err != nil {
+		return err
+	}
+	d.Layers = append(d.Layers, layer)
+	d.Image.RootFS.DiffIDs = append(d.Image.RootFS.DiffIDs, diffID)
+	d.addHistory(h)
+	return nil
+}
+
+// AddHistory records a step that only changed the config.
+func (d *Draft) AddHistory(h ocispec.History) {
+	h.EmptyLayer = true
+	d.addHistory(h)
+}
+
+func (d *Draft) addHistory(h ocispec.History) {
+	if h.Created == nil {
+		now := time.Now().UTC()
+		h.Created = &now
+	}
+	d.Image.History = append(d.Image.History, h)
+}
+
+// Tree returns the metadata of the draft's file system so far.
+func (d *Draft) Tree() (archive.Tree, error) {
+	tree := archive.Tree{}
+	for _, layer := range d.Layers {
+		if err := d.layout.applyLayer(tree, layer.Digest); err != nil {
+			return nil, err
+		}
+	}
+	return tree, nil
+}
+
+// Write stores the draft's config and manifest and returns the manifest
+// descriptor. The manifest is not referenced by the index until it is
+// tagged with Tag. The image is dated by its last history entry, so writing
+// an unchanged draft again yields the same image ID.
+func (d *Draft) Write() (ocispec.Descriptor, error) {
+	if n := len(d.Image.History); n > 0 && d.Image.History[n-1].Created != nil {
+		d.Image.Created = d.Image.History[n-1].Created
+	} else {
+		now := time.Now().UTC()
+		d.Image.Created = &now
+	}
+	desc, id, err := d.layout.writeImage(&d.Image, d.Layers)
+	if err != nil {
+		return desc, err
+	}
+	d.id, d.desc = id, desc
+	return desc, nil
+}
+
+// ID returns the image ID the draft had when it was last written.
+func (d *Draft) ID() digest.Digest {
+	return d.id
+}
+
+// Tag writes the draft and tags it in its layout, returning its summary.
+func (d *Draft) Tag(tag string) (Summary, error) {
+	desc, err := d.Write()
+	if err != nil {
+		return Summary{}, err
+	}
+	if err := d.layout.SetTag(tag, desc); err != nil {
+		return Summary{}, err
+	}
+	desc.Annotations = map[string]string{ocispec.AnnotationRefName: tag}
+	return d.layout.summarize(desc)
+}
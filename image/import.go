@@ -0,0 +1,71 @@
+package image
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ImportOptions describes the image Import creates around a tarball.
+type ImportOptions struct {
+	// Changes are Dockerfile-style instructions applied to the config.
+	Changes []string
+	// Message is recorded as the comment of the image's history entry.
+	Message string
+	// Source names where the tarball came from, for the history entry.
+	Source string
+	// Platform is recorded in the config; the host platform when empty.
+	Platform *ocispec.Platform
+}
+
+// Import creates a single-layer image from the flat file system tarball r
+// and tags it as ref.
+func Import(r io.Reader, ref Reference, opts ImportOptions) (Summary, error) {
+	d, err := NewDraft(ref.Repository, "")
+	if err != nil {
+		return Summary{}, err
+	}
+	for _, change := range opts.Changes {
+		if err := ApplyChange(&d.Image.Config, change); err != nil {
+			return Summary{}, err
+		}
+	}
+	if opts.Platform != nil {
+		d.Image.Platform = *opts.Platform
+	}
+
+	createdBy := "imported"
+	if opts.Source != "" {
+		createdBy = "imported from " + opts.Source
+	}
+	if err := d.AddLayer(r, ocispec.History{CreatedBy: createdBy, Comment: opts.Message}); err != nil {
+		return Summary{}, fmt.Errorf("failed to import layer: %v", err)
+	}
+	return d.Tag(ref.Tag)
+}
+
+// writeImage stores img as a config blob and writes a manifest referencing
+// it and layers, whose blobs must already be in l. It returns the manifest
+// descriptor and the image ID, the digest of the config.
+func (l *Layout) writeImage(img *ocispec.Image, layers []ocispec.Descriptor) (ocispec.Descriptor, digest.Digest, error) {
+	data, err := json.Marshal(img)
+	if err != nil {
+		return ocispec.Descriptor{}, "", fmt.Errorf("failed to encode image config: %v", err)
+	}
+	d, err := l.WriteBlob(data)
+	if err != nil {
+		return ocispec.Descriptor{}, "", err
+	}
+	m := ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    ocispec.Descriptor{MediaType: ocispec.MediaTypeImageConfig, Digest: d, Size: int64(len(data))},
+		Layers:    layers,
+	}
+	desc, err := l.writeManifest(&m)
+	return desc, d, err
+}
@@ -0,0 +1,150 @@
+package image
+
+import (
+	"fmt"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Details is the inspect view of an image: its configuration together with
+// every reference naming it in the local store.
+type Details struct {
+	ID           digest.Digest        `json:"Id"`
+	RepoTags     []string             `json:"RepoTags"`
+	RepoDigests  []string             `json:"RepoDigests"`
+	Created      *time.Time           `json:"Created,omitempty"`
+	Author       string               `json:"Author,omitempty"`
+	Architecture string               `json:"Architecture"`
+	Os           string               `json:"Os"`
+	Variant      string               `json:"Variant,omitempty"`
+	Config       ocispec.ImageConfig  `json:"Config"`
+	RootFS       ocispec.RootFS       `json:"RootFS"`
+	Size         int64                `json:"Size"`
+	Manifest     ocispec.Descriptor   `json:"Manifest"`
+	Layers       []ocispec.Descriptor `json:"Layers"`
+}
+
+// HistoryEntry is one step of an image's history. Steps that produced a layer
+// carry its digest and size; metadata-only steps have EmptyLayer set.
+type HistoryEntry struct {
+	Layer      digest.Digest `json:"Layer,omitempty"`
+	Created    *time.Time    `json:"Created,omitempty"`
+	CreatedBy  string        `json:"CreatedBy"`
+	Size       int64         `json:"Size"`
+	Comment    string        `json:"Comment,omitempty"`
+	EmptyLayer bool          `json:"EmptyLayer,omitempty"`
+}
+
+// load reads the manifest and config of a listed image.
+func (s Summary) load() (*Layout, ocispec.Descriptor, *ocispec.Manifest, *ocispec.Image, error) {
+	l, err := OpenLayout(s.Repository)
+	if err != nil {
+		return nil, ocispec.Descriptor{}, nil, nil, err
+	}
+	desc, m, err := l.Manifest(s.desc)
+	if err != nil {
+		return nil, desc, nil, nil, err
+	}
+	cfg, err := l.Config(m)
+	if err != nil {
+		return nil, desc, nil, nil, err
+	}
+	return l, desc, m, cfg, nil
+}
+
+// Config reads the configuration of a listed image.
+func (s Summary) Config() (*ocispec.Image, error) {
+	_, _, _, cfg, err := s.load()
+	return cfg, err
+}
+
+// Inspect returns the details of the image name refers to.
+func Inspect(name string) (*Details, error) {
+	matches, err := Lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	_, desc, m, cfg, err := matches[0].load()
+	if err != nil {
+		return nil, err
+	}
+	d := &Details{
+		ID:           m.Config.Digest,
+		RepoTags:     []string{},
+		RepoDigests:  []string{},
+		Created:      cfg.Created,
+		Author:       cfg.Author,
+		Architecture: cfg.Architecture,
+		Os:           cfg.OS,
+		Variant:      cfg.Variant,
+		Config:       cfg.Config,
+		RootFS:       cfg.RootFS,
+		Manifest:     desc,
+		Layers:       m.Layers,
+		Size:         matches[0].Size,
+	}
+
+	// Collect every reference to the same image ID.
+	images, err := List()
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	for _, img := range images {
+		if img.ID != d.ID {
+			continue
+		}
+		if img.Tag != "" {
+			d.RepoTags = append(d.RepoTags, img.Repository+":"+img.Tag)
+		}
+		if rd := img.Repository + "@" + img.Digest.String(); !seen[rd] {
+			seen[rd] = true
+			d.RepoDigests = append(d.RepoDigests, rd)
+		}
+	}
+	return d, nil
+}
+
+// History returns the image's history, newest step first, matching each
+// non-empty step with the layer it produced.
+func History(name string) ([]HistoryEntry, error) {
+	matches, err := Lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	_, _, m, cfg, err := matches[0].load()
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []HistoryEntry
+	layer := 0
+	for _, h := range cfg.History {
+		e := HistoryEntry{
+			Created:    h.Created,
+			CreatedBy:  h.CreatedBy,
+			Comment:    h.Comment,
+			EmptyLayer: h.EmptyLayer,
+		}
+		if !h.EmptyLayer {
+			if layer >= len(m.Layers) {
+				return nil, fmt.Errorf("image history has more layers than the manifest")
+			}
+			e.Layer = m.Layers[layer].Digest
+			e.Size = m.Layers[layer].Size
+			layer++
+		}
+		entries = append(entries, e)
+	}
+	// Images built without history still have layers worth listing.
+	for ; layer < len(m.Layers); layer++ {
+		entries = append(entries, HistoryEntry{Layer: m.Layers[layer].Digest, Size: m.Layers[layer].Size})
+	}
+
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	return entries, nil
+}
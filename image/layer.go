@@ -0,0 +1,77 @@
+package image
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// WriteLayer stores the tar stream r, which may already be gzip compressed,
+// as a gzip layer blob. It returns the layer descriptor together with the
+// digest of the uncompressed tar, which is what the image config records as
+// the layer's diff ID. r must be a well formed tar archive.
+func (l *Layout) WriteLayer(r io.Reader) (ocispec.Descriptor, digest.Digest, error) {
+	stream, err := decompress(r)
+	if err != nil {
+		return ocispec.Descriptor{}, "", err
+	}
+
+	diffID := digest.Canonical.Digester()
+	pr, pw := io.Pipe()
+	go func() {
+		gz := gzip.NewWriter(pw)
+		err := copyTar(io.MultiWriter(gz, diffID.Hash()), stream)
+		if cerr := gz.Close(); err == nil {
+			err = cerr
+		}
+		pw.CloseWithError(err)
+	}()
+
+	d, size, err := l.IngestBlob(pr)
+	pr.CloseWithError(err)
+	if err != nil {
+		return ocispec.Descriptor{}, "", err
+	}
+	desc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayerGzip, Digest: d, Size: size}
+	return desc, diffID.Digest(), nil
+}
+
+// copyTar copies the tar archive r to w unchanged, reading it entry by entry
+// on the way so that anything which is not a tar archive is rejected.
+func copyTar(w io.Writer, r io.Reader) error {
+	cw := &countingWriter{w: w}
+	tr := tar.NewReader(io.TeeReader(r, cw))
+	for {
+		_, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("invalid tar archive: %v", err)
+		}
+	}
+	// Keep the end-of-archive padding so the diff ID matches the input.
+	if _, err := io.Copy(cw, r); err != nil {
+		return err
+	}
+	if cw.n == 0 {
+		return fmt.Errorf("invalid tar archive: empty input")
+	}
+	return nil
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,175 @@
+package image
+
+import (
+	_ "crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Root is the directory holding one OCI image layout per repository.
+const Root = "/var/lib/mydocker/images"
+
+// Layout is an OCI image layout on disk, as written by `skopeo copy oci:...`.
+type Layout struct {
+	// Repository is the image name the layout was stored under, e.g.
+	// "ubuntu" or "quay.io/org/app".
+	Repository string
+	// Path is the directory containing index.json, oci-layout and blobs/.
+	Path string
+}
+
+// OpenLayout returns the layout stored for the given repository.
+func OpenLayout(repository string) (*Layout, error) {
+	dir := filepath.Join(Root, filepath.FromSlash(repository))
+	if _, err := os.Stat(filepath.Join(dir, "index.json")); err != nil {
+		return nil, fmt.Errorf("no image layout for repository %s: %v", repository, err)
+	}
+	return &Layout{Repository: repository, Path: dir}, nil
+}
+
+// Layouts walks Root and returns every OCI layout beneath it, including the
+// nested ones created for registry-prefixed names such as quay.io/org/app.
+func Layouts() ([]*Layout, error) {
+	var layouts []*Layout
+	err := filepath.WalkDir(Root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == Root && os.IsNotExist(err) {
+				return fs.SkipAll
+			}
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if d.Name() == "blobs" {
+			return fs.SkipDir
+		}
+		if _, err := os.Stat(filepath.Join(path, "index.json")); err != nil {
+			return nil
+		}
+		rel, err := filepath.Rel(Root, path)
+		if err != nil {
+			return err
+		}
+		layouts = append(layouts, &Layout{Repository: filepath.ToSlash(rel), Path: path})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to walk images directory: %v", err)
+	}
+	sort.Slice(layouts, func(i, j int) bool { return layouts[i].Repository < layouts[j].Repository })
+	return layouts, nil
+}
+
+// Index reads the layout's index.json.
+func (l *Layout) Index() (*ocispec.Index, error) {
+	data, err := os.ReadFile(filepath.Join(l.Path, "index.json"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read index.json: %v", err)
+	}
+	var idx ocispec.Index
+	if err := json.Unmarshal(data, &idx); err != nil {
+		return nil, fmt.Errorf("failed to parse index.json in %s: %v", l.Path, err)
+	}
+	return &idx, nil
+}
+
+// BlobPath returns the path of a blob inside the layout.
+func (l *Layout) BlobPath(d digest.Digest) string {
+	return filepath.Join(l.Path, "blobs", d.Algorithm().String(), d.Encoded())
+}
+
+// ReadBlob returns the contents of a blob after validating its digest.
+func (l *Layout) ReadBlob(d digest.Digest) ([]byte, error) {
+	if err := d.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid digest %q: %v", d, err)
+	}
+	data, err := os.ReadFile(l.BlobPath(d))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read blob %s: %v", d, err)
+	}
+	return data, nil
+}
+
+// ReadJSON decodes a JSON blob such as a manifest or config into v.
+func (l *Layout) ReadJSON(d digest.Digest, v interface{}) error {
+	data, err := l.ReadBlob(d)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("failed to parse blob %s: %v", d, err)
+	}
+	return nil
+}
+
+// Manifest resolves desc to an image manifest. When desc points at an image
+// index the entry for the host platform is used; an index without one is an
+// error.
+func (l *Layout) Manifest(desc ocispec.Descriptor) (ocispec.Descriptor, *ocispec.Manifest, error) {
+	switch desc.MediaType {
+	case ocispec.MediaTypeImageIndex, mediaTypeDockerManifestList:
+		var idx ocispec.Index
+		if err := l.ReadJSON(desc.Digest, &idx); err != nil {
+			return desc, nil, err
+		}
+		if len(idx.Manifests) == 0 {
+			return desc, nil, fmt.Errorf("image index %s has no manifests", desc.Digest)
+		}
+		match, err := SelectManifest(&idx, DefaultPlatform())
+		if err != nil {
+			return desc, nil, err
+		}
+		return l.Manifest(match)
+	}
+	var m ocispec.Manifest
+	if err := l.ReadJSON(desc.Digest, &m); err != nil {
+		return desc, nil, err
+	}
+	return desc, &m, nil
+}
+
+// Config reads the image configuration referenced by a manifest.
+func (l *Layout) Config(m *ocispec.Manifest) (*ocispec.Image, error) {
+	var cfg ocispec.Image
+	if err := l.ReadJSON(m.Config.Digest, &cfg); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// TagOf returns the tag recorded for an index entry, or "" for an untagged
+// (dangling) entry.
+func TagOf(desc ocispec.Descriptor) string {
+	return desc.Annotations[ocispec.AnnotationRefName]
+}
+
+// mediaTypeDockerManifestList is the Docker v2 equivalent of an OCI index.
+const mediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+
+// isTagChar reports whether r may appear in a tag.
+func isTagChar(r rune) bool {
+	return r == '_' || r == '.' || r == '-' ||
+		(r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9')
+}
+
+// validTag reports whether tag is a syntactically valid image tag.
+func validTag(tag string) bool {
+	if tag == "" || len(tag) > 128 || strings.HasPrefix(tag, ".") || strings.HasPrefix(tag, "-") {
+		return false
+	}
+	for _, r := range tag {
+		if !isTagChar(r) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,81 @@
+package image
+
+import (
+	"fmt"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Summary describes one tagged (or dangling) manifest in the local store.
+type Summary struct {
+	Repository string            `json:"repository"`
+	Tag        string            `json:"tag"`
+	Digest     digest.Digest     `json:"digest"`
+	ID         digest.Digest     `json:"id"`
+	Created    time.Time         `json:"created"`
+	Size       int64             `json:"size"`
+	Labels     map[string]string `json:"labels,omitempty"`
+	// Platform is the platform the image was built for.
+	Platform ocispec.Platform `json:"-"`
+
+	desc ocispec.Descriptor
+}
+
+// List returns a summary for every entry of every layout's index.json.
+// Entries without a ref name annotation are reported with an empty tag;
+// build cache entries are left out.
+func List() ([]Summary, error) {
+	layouts, err := Layouts()
+	if err != nil {
+		return nil, err
+	}
+	var images []Summary
+	for _, l := range layouts {
+		idx, err := l.Index()
+		if err != nil {
+			return nil, err
+		}
+		for _, desc := range idx.Manifests {
+			if isCacheEntry(desc) {
+				continue
+			}
+			s, err := l.summarize(desc)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", l.Repository, err)
+			}
+			images = append(images, s)
+		}
+	}
+	return images, nil
+}
+
+// summarize reads the manifest and config behind an index entry.
+func (l *Layout) summarize(desc ocispec.Descriptor) (Summary, error) {
+	s := Summary{
+		Repository: l.Repository,
+		Tag:        TagOf(desc),
+		Digest:     desc.Digest,
+		desc:       desc,
+	}
+	_, m, err := l.Manifest(desc)
+	if err != nil {
+		return s, err
+	}
+	cfg, err := l.Config(m)
+	if err != nil {
+		return s, err
+	}
+	s.ID = m.Config.Digest
+	if cfg.Created != nil {
+		s.Created = *cfg.Created
+	}
+	s.Size = m.Config.Size
+	for _, layer := range m.Layers {
+		s.Size += layer.Size
+	}
+	s.Labels = cfg.Config.Labels
+	s.Platform = PlatformOf(cfg)
+	return s, nil
+}
@@ -0,0 +1,119 @@
+package image
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// ParsePlatform parses an os/arch[/variant] string such as "linux/arm64" or
+// "linux/arm/v7". Common architecture aliases are normalised.
+func ParsePlatform(s string) (ocispec.Platform, error) {
+	parts := strings.Split(strings.ToLower(s), "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return ocispec.Platform{}, fmt.Errorf("invalid platform %q, expected os/arch[/variant]", s)
+	}
+	p := ocispec.Platform{OS: parts[0], Architecture: parts[1]}
+	if len(parts) == 3 {
+		p.Variant = parts[2]
+	}
+	return normalizePlatform(p), nil
+}
+
+// DefaultPlatform returns the platform of the host, including the ARM
+// variant where one applies.
+func DefaultPlatform() ocispec.Platform {
+	p := ocispec.Platform{OS: runtime.GOOS, Architecture: runtime.GOARCH}
+	if runtime.GOARCH == "arm" {
+		p.Variant = armVariant()
+	}
+	return normalizePlatform(p)
+}
+
+// FormatPlatform renders a platform as os/arch[/variant].
+func FormatPlatform(p ocispec.Platform) string {
+	s := p.OS + "/" + p.Architecture
+	if p.Variant != "" {
+		s += "/" + p.Variant
+	}
+	return s
+}
+
+// MatchPlatform reports whether an image built for have can run where want is
+// requested. An empty variant in want matches any variant.
+func MatchPlatform(want, have ocispec.Platform) bool {
+	want, have = normalizePlatform(want), normalizePlatform(have)
+	if want.OS != have.OS || want.Architecture != have.Architecture {
+		return false
+	}
+	return want.Variant == "" || want.Variant == have.Variant
+}
+
+// SelectManifest picks the entry of an image index matching platform.
+func SelectManifest(idx *ocispec.Index, platform ocispec.Platform) (ocispec.Descriptor, error) {
+	var available []string
+	for _, desc := range idx.Manifests {
+		if desc.Platform == nil {
+			continue
+		}
+		if MatchPlatform(platform, *desc.Platform) {
+			return desc, nil
+		}
+		available = append(available, FormatPlatform(*desc.Platform))
+	}
+	return ocispec.Descriptor{}, fmt.Errorf("no image found in manifest list for platform %s (available: %s)",
+		FormatPlatform(platform), strings.Join(available, ", "))
+}
+
+// PlatformOf returns the platform an image configuration was built for.
+func PlatformOf(cfg *ocispec.Image) ocispec.Platform {
+	return normalizePlatform(ocispec.Platform{OS: cfg.OS, Architecture: cfg.Architecture, Variant: cfg.Variant})
+}
+
+// normalizePlatform maps architecture aliases onto their Go names and fills
+// in the implied default variants.
+func normalizePlatform(p ocispec.Platform) ocispec.Platform {
+	switch p.Architecture {
+	case "x86_64", "x86-64":
+		p.Architecture = "amd64"
+	case "aarch64":
+		p.Architecture = "arm64"
+	case "armhf":
+		p.Architecture, p.Variant = "arm", "v7"
+	case "armel":
+		p.Architecture, p.Variant = "arm", "v6"
+	case "i386", "i686":
+		p.Architecture = "386"
+	}
+	switch {
+	case p.Architecture == "arm64" && p.Variant == "":
+		p.Variant = "v8"
+	case p.Architecture == "arm" && p.Variant == "":
+		p.Variant = "v7"
+	case p.Architecture == "amd64" && p.Variant == "v1":
+		p.Variant = ""
+	}
+	return p
+}
+
+// armVariant derives the ARM variant from /proc/cpuinfo, defaulting to v7.
+func armVariant() string {
+	data, err := os.ReadFile("/proc/cpuinfo")
+	if err != nil {
+		return "v7"
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		key, value, ok := strings.Cut(line, ":")
+		if !ok || strings.TrimSpace(key) != "CPU architecture" {
+			continue
+		}
+		switch strings.TrimSpace(value) {
+		case "5", "6", "7", "8":
+			return "v" + strings.TrimSpace(value)
+		}
+	}
+	return "v7"
+}
@@ -0,0 +1,70 @@
+package image
+
+import (
+	"fmt"
+	"strings"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+// DefaultTag is used when a reference names no tag or digest.
+const DefaultTag = "latest"
+
+// Reference is a parsed image reference of the form
+// [registry/]repository[:tag][@digest].
+type Reference struct {
+	Repository string
+	Tag        string
+	Digest     digest.Digest
+}
+
+// ParseReference splits an image reference into repository, tag and digest.
+// The tag defaults to "latest" when neither a tag nor a digest is given.
+func ParseReference(ref string) (Reference, error) {
+	var r Reference
+	if ref == "" {
+		return r, fmt.Errorf("empty image reference")
+	}
+	if i := strings.Index(ref, "@"); i != -1 {
+		d, err := digest.Parse(ref[i+1:])
+		if err != nil {
+			return r, fmt.Errorf("invalid digest in reference %q: %v", ref, err)
+		}
+		r.Digest = d
+		ref = ref[:i]
+	}
+	// A colon after the last slash separates the tag; one before it belongs
+	// to a registry host:port.
+	if i := strings.LastIndex(ref, ":"); i != -1 && i > strings.LastIndex(ref, "/") {
+		r.Tag = ref[i+1:]
+		ref = ref[:i]
+		if !validTag(r.Tag) {
+			return r, fmt.Errorf("invalid tag %q in reference", r.Tag)
+		}
+	}
+	if ref == "" || strings.HasPrefix(ref, "/") || strings.HasSuffix(ref, "/") || strings.Contains(ref, "//") {
+		return r, fmt.Errorf("invalid repository name %q", ref)
+	}
+	for _, part := range strings.Split(ref, "/") {
+		if part == "." || part == ".." {
+			return r, fmt.Errorf("invalid repository name %q", ref)
+		}
+	}
+	r.Repository = ref
+	if r.Tag == "" && r.Digest == "" {
+		r.Tag = DefaultTag
+	}
+	return r, nil
+}
+
+// String formats the reference back into repository:tag or repository@digest.
+func (r Reference) String() string {
+	s := r.Repository
+	if r.Tag != "" {
+		s += ":" + r.Tag
+	}
+	if r.Digest != "" {
+		s += "@" + r.Digest.String()
+	}
+	return s
+}
@@ -0,0 +1,560 @@
+package image
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Resolve finds the index entry a reference points at. A reference carrying a
+// digest matches by manifest digest, otherwise the tag must match.
+func Resolve(ref Reference) (*Layout, ocispec.Descriptor, error) {
+	l, err := OpenLayout(ref.Repository)
+	if err != nil {
+		return nil, ocispec.Descriptor{}, fmt.Errorf("no such image: %s", ref)
+	}
+	idx, err := l.Index()
+	if err != nil {
+		return nil, ocispec.Descriptor{}, err
+	}
+	for _, desc := range idx.Manifests {
+		if isCacheEntry(desc) {
+			continue
+		}
+		if ref.Digest != "" && desc.Digest == ref.Digest {
+			return l, desc, nil
+		}
+		if ref.Digest == "" && TagOf(desc) == ref.Tag {
+			return l, desc, nil
+		}
+	}
+	return nil, ocispec.Descriptor{}, fmt.Errorf("no such image: %s", ref)
+}
+
+// Lookup resolves a user-supplied image name, which may be a reference or a
+// (possibly abbreviated) image ID. An ID may match several tagged entries.
+func Lookup(name string) ([]Summary, error) {
+	if ref, err := ParseReference(name); err == nil {
+		if l, desc, err := Resolve(ref); err == nil {
+			s, err := l.summarize(desc)
+			if err != nil {
+				return nil, err
+			}
+			return []Summary{s}, nil
+		}
+	}
+	id := strings.TrimPrefix(name, "sha256:")
+	if len(id) < 4 || strings.Trim(id, "0123456789abcdef") != "" {
+		return nil, fmt.Errorf("no such image: %s", name)
+	}
+	images, err := List()
+	if err != nil {
+		return nil, err
+	}
+	var matches []Summary
+	for _, img := range images {
+		if strings.HasPrefix(img.ID.Encoded(), id) {
+			matches = append(matches, img)
+		}
+	}
+	if len(matches) == 0 {
+		return nil, fmt.Errorf("no such image: %s", name)
+	}
+	for _, m := range matches[1:] {
+		if m.ID != matches[0].ID {
+			return nil, fmt.Errorf("image ID %s is ambiguous", name)
+		}
+	}
+	return matches, nil
+}
+
+// WriteIndex atomically replaces the layout's index.json.
+func (l *Layout) WriteIndex(idx *ocispec.Index) error {
+	if idx.SchemaVersion == 0 {
+		idx.SchemaVersion = 2
+	}
+	if idx.Manifests == nil {
+		idx.Manifests = []ocispec.Descriptor{}
+	}
+	data, err := json.Marshal(idx)
+	if err != nil {
+		return fmt.Errorf("failed to encode index.json: %v", err)
+	}
+	return writeFileAtomic(filepath.Join(l.Path, "index.json"), data)
+}
+
+// CreateLayout returns the layout for repository, initialising an empty one
+// if it does not exist yet.
+func CreateLayout(repository string) (*Layout, error) {
+	if err := holdStore(); err != nil {
+		return nil, err
+	}
+	if l, err := OpenLayout(repository); err == nil {
+		return l, nil
+	}
+	dir := filepath.Join(Root, filepath.FromSlash(repository))
+	l := &Layout{Repository: repository, Path: dir}
+	// Under the index lock a concurrent creator cannot replace an index
+	// that has gained entries with an empty one
+	err := l.withIndexLock(func() error {
+		if _, err := os.Stat(filepath.Join(dir, "index.json")); err == nil {
+			return nil
+		}
+		if err := os.MkdirAll(filepath.Join(dir, "blobs", "sha256"), 0755); err != nil {
+			return fmt.Errorf("failed to create layout %s: %v", dir, err)
+		}
+		layoutFile := fmt.Sprintf(`{"imageLayoutVersion":"%s"}`, ocispec.ImageLayoutVersion)
+		if err := os.WriteFile(filepath.Join(dir, ocispec.ImageLayoutFile), []byte(layoutFile), 0644); err != nil {
+			return fmt.Errorf("failed to write oci-layout: %v", err)
+		}
+		return l.WriteIndex(&ocispec.Index{})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// indexLocks holds a lock file per repository, serializing changes to its
+// index.json. They live outside the layouts so that removing a layout never
+// unlinks a lock another process is waiting on.
+const indexLocks = Root + "/.locks"
+
+// UpdateIndex applies fn to the layout's index and writes the result back,
+// holding the repository's index lock throughout so that concurrent pulls,
+// tags and builds do not lose each other's entries.
+func (l *Layout) UpdateIndex(fn func(*ocispec.Index) error) error {
+	return l.withIndexLock(func() error {
+		idx, err := l.Index()
+		if err != nil {
+			return err
+		}
+		if err := fn(idx); err != nil {
+			return err
+		}
+		return l.WriteIndex(idx)
+	})
+}
+
+// withIndexLock runs fn holding the repository's index lock.
+func (l *Layout) withIndexLock(fn func() error) error {
+	if err := os.MkdirAll(indexLocks, 0755); err != nil {
+		return fmt.Errorf("failed to create index lock directory: %v", err)
+	}
+	path := filepath.Join(indexLocks, url.PathEscape(l.Repository)+".lock")
+	lock, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open index lock of %s: %v", l.Repository, err)
+	}
+	defer lock.Close()
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return fmt.Errorf("failed to lock index of %s: %v", l.Repository, err)
+	}
+	return fn()
+}
+
+// SetTag points tag at desc, replacing whatever the tag referenced before.
+func (l *Layout) SetTag(tag string, desc ocispec.Descriptor) error {
+	annotations := map[string]string{}
+	for k, v := range desc.Annotations {
+		annotations[k] = v
+	}
+	annotations[ocispec.AnnotationRefName] = tag
+	desc.Annotations = annotations
+	return l.UpdateIndex(func(idx *ocispec.Index) error {
+		var manifests []ocispec.Descriptor
+		for _, d := range idx.Manifests {
+			if TagOf(d) != tag {
+				manifests = append(manifests, d)
+			}
+		}
+		idx.Manifests = append(manifests, desc)
+		return nil
+	})
+}
+
+// Tag makes dst refer to the same manifest as src. When the two live in
+// different layouts the blobs are hard-linked rather than copied.
+func Tag(src, dst Reference) error {
+	if dst.Digest != "" {
+		return fmt.Errorf("cannot tag with a digest reference: %s", dst)
+	}
+	from, desc, err := Resolve(src)
+	if err != nil {
+		return err
+	}
+	to, err := CreateLayout(dst.Repository)
+	if err != nil {
+		return err
+	}
+	if to.Path != from.Path {
+		blobs, err := from.Blobs(desc)
+		if err != nil {
+			return err
+		}
+		for _, d := range blobs {
+			if err := to.LinkBlob(from, d); err != nil {
+				return err
+			}
+		}
+	}
+	return to.SetTag(dst.Tag, desc)
+}
+
+// AddManifest records an untagged index entry for desc unless one exists.
+func (l *Layout) AddManifest(desc ocispec.Descriptor) error {
+	return l.UpdateIndex(func(idx *ocispec.Index) error {
+		for _, d := range idx.Manifests {
+			if d.Digest == desc.Digest && TagOf(d) == "" && !isCacheEntry(d) {
+				return nil
+			}
+		}
+		idx.Manifests = append(idx.Manifests, desc)
+		return nil
+	})
+}
+
+// Untag removes the index entry ref resolves to and returns it.
+func Untag(ref Reference) (ocispec.Descriptor, error) {
+	l, desc, err := Resolve(ref)
+	if err != nil {
+		return desc, err
+	}
+	return desc, l.UpdateIndex(func(idx *ocispec.Index) error {
+		var manifests []ocispec.Descriptor
+		for _, d := range idx.Manifests {
+			if d.Digest == desc.Digest && TagOf(d) == TagOf(desc) && !isCacheEntry(d) {
+				continue
+			}
+			manifests = append(manifests, d)
+		}
+		idx.Manifests = manifests
+		return nil
+	})
+}
+
+// Blobs returns every blob reachable from desc: nested indexes, manifests,
+// configs and layers.
+func (l *Layout) Blobs(desc ocispec.Descriptor) ([]digest.Digest, error) {
+	blobs := []digest.Digest{desc.Digest}
+	switch desc.MediaType {
+	case ocispec.MediaTypeImageIndex, mediaTypeDockerManifestList:
+		var idx ocispec.Index
+		if err := l.ReadJSON(desc.Digest, &idx); err != nil {
+			return nil, err
+		}
+		for _, m := range idx.Manifests {
+			children, err := l.Blobs(m)
+			if err != nil {
+				return nil, err
+			}
+			blobs = append(blobs, children...)
+		}
+		return blobs, nil
+	}
+	var m ocispec.Manifest
+	if err := l.ReadJSON(desc.Digest, &m); err != nil {
+		return nil, err
+	}
+	blobs = append(blobs, m.Config.Digest)
+	for _, layer := range m.Layers {
+		blobs = append(blobs, layer.Digest)
+	}
+	return blobs, nil
+}
+
+// HasBlob reports whether blob d is present in the layout.
+func (l *Layout) HasBlob(d digest.Digest) bool {
+	_, err := os.Stat(l.BlobPath(d))
+	return err == nil
+}
+
+// WriteBlob stores data as a blob and returns its digest.
+func (l *Layout) WriteBlob(data []byte) (digest.Digest, error) {
+	if err := holdStore(); err != nil {
+		return "", err
+	}
+	d := digest.FromBytes(data)
+	if l.HasBlob(d) {
+		return d, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(l.BlobPath(d)), 0755); err != nil {
+		return "", fmt.Errorf("failed to create blob directory: %v", err)
+	}
+	return d, writeFileAtomic(l.BlobPath(d), data)
+}
+
+// IngestBlob streams r into the layout as a blob, computing its digest on the
+// way, and returns the digest and size.
+func (l *Layout) IngestBlob(r io.Reader) (digest.Digest, int64, error) {
+	if err := holdStore(); err != nil {
+		return "", 0, err
+	}
+	dir := filepath.Join(l.Path, "blobs", string(digest.Canonical))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", 0, fmt.Errorf("failed to create blob directory: %v", err)
+	}
+	tmp, err := os.CreateTemp(dir, ".tmp-")
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to create blob: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	digester := digest.Canonical.Digester()
+	size, err := io.Copy(io.MultiWriter(tmp, digester.Hash()), r)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to write blob: %v", err)
+	}
+	d := digester.Digest()
+	if l.HasBlob(d) {
+		return d, size, nil
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return "", 0, fmt.Errorf("failed to write blob: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), l.BlobPath(d)); err != nil {
+		return "", 0, fmt.Errorf("failed to store blob %s: %v", d, err)
+	}
+	return d, size, nil
+}
+
+// FindBlob returns a layout other than l that already holds blob d, so the
+// local store can share content between repositories. It returns nil when
+// no layout has it. The blob is kept from GC for the caller to link.
+func (l *Layout) FindBlob(d digest.Digest) *Layout {
+	if holdStore() != nil {
+		return nil
+	}
+	layouts, err := Layouts()
+	if err != nil {
+		return nil
+	}
+	for _, other := range layouts {
+		if other.Path != l.Path && other.HasBlob(d) {
+			return other
+		}
+	}
+	return nil
+}
+
+// LinkBlob makes blob d from another layout available in l, hard-linking it
+// when possible and copying it otherwise.
+func (l *Layout) LinkBlob(from *Layout, d digest.Digest) error {
+	if err := holdStore(); err != nil {
+		return err
+	}
+	dst := l.BlobPath(d)
+	if _, err := os.Stat(dst); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return fmt.Errorf("failed to create blob directory: %v", err)
+	}
+	src := from.BlobPath(d)
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("failed to open blob %s: %v", d, err)
+	}
+	defer in.Close()
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".tmp-")
+	if err != nil {
+		return fmt.Errorf("failed to create blob %s: %v", d, err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, in); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to copy blob %s: %v", d, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to copy blob %s: %v", d, err)
+	}
+	return os.Rename(tmp.Name(), dst)
+}
+
+// storeLock is held shared by every process that writes to the store, from
+// its first write until it exits, and exclusively by GC. Blobs a pull, build
+// or commit has stored but not indexed yet are never collected under it.
+const storeLock = Root + "/.lock"
+
+var (
+	storeHold     *os.File
+	storeHoldErr  error
+	storeHoldOnce sync.Once
+)
+
+// holdStore takes the shared store lock for the rest of the process.
+func holdStore() error {
+	storeHoldOnce.Do(func() {
+		f, err := openStoreLock()
+		if err != nil {
+			storeHoldErr = err
+			return
+		}
+		if err := syscall.Flock(int(f.Fd()), syscall.LOCK_SH); err != nil {
+			f.Close()
+			storeHoldErr = fmt.Errorf("failed to lock image store: %v", err)
+			return
+		}
+		// Kept open, and so locked, until the process exits
+		storeHold = f
+	})
+	return storeHoldErr
+}
+
+func openStoreLock() (*os.File, error) {
+	if err := os.MkdirAll(Root, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create images directory: %v", err)
+	}
+	f, err := os.OpenFile(storeLock, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open image store lock: %v", err)
+	}
+	return f, nil
+}
+
+// ErrStoreBusy is returned by GC while another mydocker process is writing
+// to the image store. Nothing was collected; a later GC reclaims the space.
+var ErrStoreBusy = errors.New("the image store is in use by another mydocker process; unused blobs are kept until a later prune")
+
+// GC deletes every blob not reachable from index.json and returns the number
+// of bytes reclaimed. A layout whose index is empty is removed. While any
+// mydocker process is writing to the store nothing is collected and
+// ErrStoreBusy is returned.
+func (l *Layout) GC() (int64, error) {
+	lock, err := openStoreLock()
+	if err != nil {
+		return 0, err
+	}
+	defer lock.Close()
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		if err == syscall.EWOULDBLOCK {
+			return 0, ErrStoreBusy
+		}
+		return 0, fmt.Errorf("failed to lock image store: %v", err)
+	}
+
+	var reclaimed int64
+	err = l.withIndexLock(func() error {
+		var err error
+		reclaimed, err = l.gcLocked()
+		return err
+	})
+	return reclaimed, err
+}
+
+// gcLocked does the work of GC under the store and index locks.
+func (l *Layout) gcLocked() (int64, error) {
+	idx, err := l.Index()
+	if err != nil {
+		return 0, err
+	}
+	live, err := l.liveBlobs(idx)
+	if err != nil {
+		return 0, err
+	}
+
+	var reclaimed int64
+	blobsDir := filepath.Join(l.Path, "blobs")
+	algs, err := os.ReadDir(blobsDir)
+	if err != nil && !os.IsNotExist(err) {
+		return 0, fmt.Errorf("failed to read blobs directory: %v", err)
+	}
+	for _, alg := range algs {
+		entries, err := os.ReadDir(filepath.Join(blobsDir, alg.Name()))
+		if err != nil {
+			return reclaimed, fmt.Errorf("failed to read blobs directory: %v", err)
+		}
+		for _, e := range entries {
+			if strings.HasPrefix(e.Name(), ".tmp-") {
+				continue
+			}
+			if live[digest.NewDigestFromEncoded(digest.Algorithm(alg.Name()), e.Name())] {
+				continue
+			}
+			if info, err := e.Info(); err == nil {
+				reclaimed += info.Size()
+			}
+			if err := os.Remove(filepath.Join(blobsDir, alg.Name(), e.Name())); err != nil {
+				return reclaimed, fmt.Errorf("failed to remove blob %s: %v", e.Name(), err)
+			}
+		}
+	}
+
+	if len(idx.Manifests) == 0 {
+		if err := l.remove(); err != nil {
+			return reclaimed, err
+		}
+	}
+	return reclaimed, nil
+}
+
+// liveBlobs returns the blobs reachable from the entries of idx, the
+// layout's index.
+func (l *Layout) liveBlobs(idx *ocispec.Index) (map[digest.Digest]bool, error) {
+	live := map[digest.Digest]bool{}
+	for _, desc := range idx.Manifests {
+		blobs, err := l.Blobs(desc)
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range blobs {
+			live[d] = true
+		}
+	}
+	return live, nil
+}
+
+// remove deletes the layout's index.json, oci-layout and blobs, then its
+// directory and any parent directories below Root once they are empty.
+// Layouts nested in it, such as a/b inside a, are left alone.
+func (l *Layout) remove() error {
+	for _, name := range []string{"blobs", ocispec.ImageLayoutFile, "index.json"} {
+		if err := os.RemoveAll(filepath.Join(l.Path, name)); err != nil {
+			return fmt.Errorf("failed to remove layout %s: %v", l.Path, err)
+		}
+	}
+	for dir := l.Path; dir != Root && strings.HasPrefix(dir, Root); dir = filepath.Dir(dir) {
+		if err := os.Remove(dir); err != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// writeFileAtomic writes data to a temporary file and renames it over path.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-"+filepath.Base(path))
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package network
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// hostResolvConf is the host's resolver configuration. When it only points
+// at the systemd-resolved stub, upstreamResolvConf lists the servers the
+// stub forwards to.
+const (
+	hostResolvConf     = "/etc/resolv.conf"
+	upstreamResolvConf = "/run/systemd/resolve/resolv.conf"
+)
+
+// fallbackNameservers are used when the host has no nameserver a container
+// can reach.
+var fallbackNameservers = []string{"8.8.8.8", "8.8.4.4"}
+
+// HostEntry is a line of a container's /etc/hosts.
+type HostEntry struct {
+	IP    string
+	Names []string
+}
+
+func (e HostEntry) String() string {
+	return e.IP + "\t" + strings.Join(e.Names, " ")
+}
+
+// Hosts renders a container's /etc/hosts: the localhost entries followed by
+// entries.
+func Hosts(entries []HostEntry) []byte {
+	var b bytes.Buffer
+	b.WriteString("127.0.0.1\tlocalhost\n")
+	b.WriteString("::1\tlocalhost ip6-localhost ip6-loopback\n")
+	b.WriteString("fe00::0\tip6-localnet\n")
+	b.WriteString("ff00::0\tip6-mcastprefix\n")
+	b.WriteString("ff02::1\tip6-allnodes\n")
+	b.WriteString("ff02::2\tip6-allrouters\n")
+	for _, e := range entries {
+		b.WriteString(e.String() + "\n")
+	}
+	return b.Bytes()
+}
+
+// ResolvConf renders a container's /etc/resolv.conf from the host's.
+// Nameservers on the host's loopback cannot be reached from a network
+// namespace of its own, so unless keepLoopback is set they are dropped, and
+// public resolvers are used when none remain. Non-empty dns, search and
+// options replace the host's settings of that kind.
+func ResolvConf(dns, search, options []string, keepLoopback bool) ([]byte, error) {
+	hostDNS, hostSearch, hostOptions, err := readResolvConf(hostResolvConf)
+	if err != nil {
+		return nil, err
+	}
+	if !keepLoopback && len(hostDNS) == 1 && hostDNS[0] == "127.0.0.53" {
+		if upDNS, upSearch, upOptions, err := readResolvConf(upstreamResolvConf); err == nil {
+			hostDNS, hostSearch, hostOptions = upDNS, upSearch, upOptions
+		}
+	}
+
+	if len(dns) == 0 {
+		for _, ns := range hostDNS {
+			ip := net.ParseIP(ns)
+			if ip == nil || (ip.IsLoopback() && !keepLoopback) {
+				continue
+			}
+			dns = append(dns, ns)
+		}
+		if len(dns) == 0 {
+			dns = fallbackNameservers
+		}
+	}
+	if len(search) == 0 {
+		search = hostSearch
+	}
+	if len(options) == 0 {
+		options = hostOptions
+	}
+
+	var b bytes.Buffer
+	b.WriteString("# Generated by mydocker\n")
+	for _, ns := range dns {
+		fmt.Fprintf(&b, "nameserver %s\n", ns)
+	}
+	if len(search) > 0 {
+		fmt.Fprintf(&b, "search %s\n", strings.Join(search, " "))
+	}
+	if len(options) > 0 {
+		fmt.Fprintf(&b, "options %s\n", strings.Join(options, " "))
+	}
+	return b.Bytes(), nil
+}
+
+// readResolvConf returns the nameservers, search domains and options of a
+// resolv.conf. A missing file has none of them.
+func readResolvConf(path string) (dns, search, options []string, err error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to read %s: %v", path, err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") || strings.HasPrefix(fields[0], ";") {
+			continue
+		}
+		switch fields[0] {
+		case "nameserver":
+			dns = append(dns, fields[1])
+		case "search", "domain":
+			// The last of them wins, as with the resolver
+			search = fields[1:]
+		case "options":
+			options = append(options, fields[1:]...)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to read %s: %v", path, err)
+	}
+	return dns, search, options, nil
+}
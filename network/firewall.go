@@ -0,0 +1,108 @@
+package network
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"mydocker/config"
+)
+
+// Firewall installs the packet filter and NAT rules behind container
+// networking. Every rule it adds is tagged with the network or container it
+// belongs to so it can be found and removed again.
+type Firewall interface {
+	// SetupNetwork masquerades and forwards traffic leaving a network.
+	SetupNetwork(n *Network) error
+	// TeardownNetwork removes what SetupNetwork installed.
+	TeardownNetwork(n *Network) error
+	// PublishPorts forwards host ports to a container of bridge.
+	PublishPorts(owner, bridge, containerIP string, ports []PortMapping) error
+	// UnpublishPorts removes what PublishPorts installed, skipping rules
+	// that are already gone.
+	UnpublishPorts(owner, bridge, containerIP string, ports []PortMapping) error
+	// Flush removes everything the backend installed for any network or
+	// container.
+	Flush() error
+}
+
+// firewallState records which backend installed the rules on the host, so
+// a change of backend can remove what the previous one left behind.
+const firewallState = "/var/lib/mydocker/network/firewall-backend"
+
+// backends are the Firewall implementations by "firewall-backend" name.
+var backends = map[string]Firewall{
+	"iptables": iptablesFirewall{},
+	"nftables": nftablesFirewall{},
+}
+
+var (
+	firewallOnce    sync.Once
+	currentFirewall Firewall
+	firewallErr     error
+)
+
+// firewall returns the backend chosen by the daemon config's
+// "firewall-backend", detecting one when it is not set.
+func firewall() (Firewall, error) {
+	firewallOnce.Do(func() {
+		cfg, err := config.Load()
+		if err != nil {
+			firewallErr = err
+			return
+		}
+		name := cfg.FirewallBackend
+		if name == "" {
+			name = detectFirewall()
+		}
+		fw, ok := backends[name]
+		if !ok {
+			firewallErr = fmt.Errorf("unknown firewall-backend %q, expected iptables or nftables", name)
+			return
+		}
+		if firewallErr = switchFirewall(name); firewallErr == nil {
+			currentFirewall = fw
+		}
+	})
+	return currentFirewall, firewallErr
+}
+
+// switchFirewall records name as the backend in use. When another backend
+// installed the rules so far, they are flushed; the new backend sets up
+// networks again as containers attach to them, but the ports of running
+// containers stay unpublished until they are restarted.
+func switchFirewall(name string) error {
+	return withLock(firewallState+".lock", func() error {
+		data, err := os.ReadFile(firewallState)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to read firewall state: %v", err)
+		}
+		previous := strings.TrimSpace(string(data))
+		if previous == name {
+			return nil
+		}
+		if fw, ok := backends[previous]; ok {
+			if err := fw.Flush(); err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: failed to remove the rules of firewall backend %s: %v\n", previous, err)
+			} else {
+				fmt.Fprintf(os.Stderr, "Warning: firewall backend changed from %s to %s; restart running containers to publish their ports again\n", previous, name)
+			}
+		}
+		if err := os.WriteFile(firewallState, []byte(name+"\n"), 0644); err != nil {
+			return fmt.Errorf("failed to write firewall state: %v", err)
+		}
+		return nil
+	})
+}
+
+// detectFirewall prefers iptables when the command exists and can read the
+// nat table, which hosts with only nftables and no iptables-legacy
+// compatibility fail.
+func detectFirewall() string {
+	if _, err := exec.LookPath("iptables"); err == nil && iptables("-t", "nat", "-S", "POSTROUTING") == nil {
+		return "iptables"
+	}
+	return "nftables"
+}
@@ -0,0 +1,194 @@
+package network
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DefaultNetwork is the network containers join unless told otherwise.
+const DefaultNetwork = "bridge"
+
+// defaultBridgeIP is the gateway address and subnet of DefaultNetwork when
+// the daemon config sets no "bip".
+const defaultBridgeIP = "10.0.0.1/24"
+
+// ipamDir holds one allocation file per network.
+const ipamDir = "/var/lib/mydocker/network/ipam"
+
+// Pool hands out the addresses of one network's subnet.
+type Pool struct {
+	Network string
+	// Bridge is the network's bridge device.
+	Bridge string
+	Subnet *net.IPNet
+	// Gateway is the bridge's own address and never allocated.
+	Gateway net.IP
+}
+
+// allocations is the on-disk state of a Pool.
+type allocations struct {
+	Subnet string `json:"subnet"`
+	// IPs maps allocated addresses to the container holding them.
+	IPs map[string]string `json:"ips"`
+}
+
+// GatewayAddr returns the bridge address, the gateway in the pool's subnet.
+func (p Pool) GatewayAddr() *net.IPNet {
+	return &net.IPNet{IP: p.Gateway, Mask: p.Subnet.Mask}
+}
+
+// Allocate reserves a free address of the pool for owner, returning the one
+// owner already holds if any.
+func (p Pool) Allocate(owner string) (net.IP, error) {
+	var ip net.IP
+	err := updateAllocations(p.Network, func(a *allocations) error {
+		if p.Network != DefaultNetwork {
+			// The network may have been removed since p was looked up
+			if _, err := os.Stat(filepath.Join(networksDir, p.Network+".json")); os.IsNotExist(err) {
+				return fmt.Errorf("network %s not found", p.Network)
+			}
+		}
+		subnet := p.Subnet.String()
+		if a.Subnet != subnet {
+			if len(a.IPs) > 0 {
+				return fmt.Errorf("network %s still has addresses allocated from %s", p.Network, a.Subnet)
+			}
+			a.Subnet = subnet
+		}
+		for addr, holder := range a.IPs {
+			if holder == owner {
+				ip = net.ParseIP(addr).To4()
+				return nil
+			}
+		}
+
+		base := binary.BigEndian.Uint32(p.Subnet.IP.To4())
+		ones, bits := p.Subnet.Mask.Size()
+		size := uint32(1) << uint(bits-ones)
+		// Skip the network and broadcast addresses.
+		for i := uint32(1); i+1 < size; i++ {
+			candidate := make(net.IP, 4)
+			binary.BigEndian.PutUint32(candidate, base+i)
+			if candidate.Equal(p.Gateway) {
+				continue
+			}
+			if _, taken := a.IPs[candidate.String()]; !taken {
+				a.IPs[candidate.String()] = owner
+				ip = candidate
+				return nil
+			}
+		}
+		return fmt.Errorf("no free addresses left in %s for network %s", subnet, p.Network)
+	})
+	return ip, err
+}
+
+// Allocations returns the addresses allocated on network and who holds them.
+// It only reads the state, under the same lock as updates.
+func Allocations(network string) (map[string]string, error) {
+	var a allocations
+	err := withLock(filepath.Join(ipamDir, network+".lock"), func() error {
+		var err error
+		a, err = readAllocations(network)
+		return err
+	})
+	return a.IPs, err
+}
+
+// ReleaseAll frees the addresses owner holds on any network.
+func ReleaseAll(owner string) error {
+	files, err := os.ReadDir(ipamDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to read IPAM directory: %v", err)
+	}
+	for _, file := range files {
+		name, ok := strings.CutSuffix(file.Name(), ".json")
+		if !ok {
+			continue
+		}
+		if err := Release(name, owner); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Release frees the addresses owner holds on network.
+func Release(network, owner string) error {
+	return updateAllocations(network, func(a *allocations) error {
+		for addr, holder := range a.IPs {
+			if holder == owner {
+				delete(a.IPs, addr)
+			}
+		}
+		return nil
+	})
+}
+
+// readAllocations loads a network's allocations; the caller holds its lock.
+// A network without a state file has no allocations.
+func readAllocations(network string) (allocations, error) {
+	path := filepath.Join(ipamDir, network+".json")
+	a := allocations{}
+	data, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(data, &a); err != nil {
+			return a, fmt.Errorf("failed to parse IPAM state %s: %v", path, err)
+		}
+	case !os.IsNotExist(err):
+		return a, fmt.Errorf("failed to read IPAM state: %v", err)
+	}
+	if a.IPs == nil {
+		a.IPs = map[string]string{}
+	}
+	return a, nil
+}
+
+// MACAddress derives a locally administered MAC address from an IPv4
+// address, so that a container's MAC is unique as long as its IP is.
+func MACAddress(ip net.IP) net.HardwareAddr {
+	mac := net.HardwareAddr{0x02, 0x42, 0, 0, 0, 0}
+	copy(mac[2:], ip.To4())
+	return mac
+}
+
+// updateAllocations applies fn to a network's allocations while holding an
+// exclusive lock, so concurrent runs never hand out the same address.
+func updateAllocations(network string, fn func(*allocations) error) error {
+	return withLock(filepath.Join(ipamDir, network+".lock"), func() error {
+		return updateLocked(network, fn)
+	})
+}
+
+func updateLocked(network string, fn func(*allocations) error) error {
+	a, err := readAllocations(network)
+	if err != nil {
+		return err
+	}
+	if err := fn(&a); err != nil {
+		return err
+	}
+
+	path := filepath.Join(ipamDir, network+".json")
+	data, err := json.MarshalIndent(a, "", "    ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write IPAM state: %v", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to write IPAM state: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,211 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// Chains owned by mydocker. They are jumped to from the built-in chains so
+// that our rules can be found and flushed without touching anyone else's.
+const (
+	natChain     = "MYDOCKER-POSTROUTING"
+	forwardChain = "MYDOCKER-FORWARD"
+	inputChain   = "MYDOCKER-INPUT"
+	// dnatChain holds the DNAT rules of published ports. PREROUTING and
+	// OUTPUT jump to it for traffic addressed to the host itself.
+	dnatChain = "MYDOCKER"
+)
+
+// iptablesFirewall installs the rules with the iptables command, in
+// mydocker's own chains.
+type iptablesFirewall struct{}
+
+func (iptablesFirewall) SetupNetwork(n *Network) error {
+	if err := ensureChain("nat", natChain, "POSTROUTING"); err != nil {
+		return err
+	}
+	if err := ensureChain("filter", forwardChain, "FORWARD"); err != nil {
+		return err
+	}
+	if err := ensureChain("filter", inputChain, "INPUT"); err != nil {
+		return err
+	}
+	for _, rule := range natRules(n) {
+		if err := ensureRule(rule[0], rule[1:]...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (iptablesFirewall) TeardownNetwork(n *Network) error {
+	for _, rule := range natRules(n) {
+		if err := deleteRule(rule[0], rule[1:]...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f iptablesFirewall) PublishPorts(owner, bridge, containerIP string, ports []PortMapping) error {
+	local := []string{"-m", "addrtype", "--dst-type", "LOCAL"}
+	if err := ensureChain("nat", dnatChain, "PREROUTING", local...); err != nil {
+		return err
+	}
+	if err := ensureChain("nat", dnatChain, "OUTPUT", local...); err != nil {
+		return err
+	}
+	for i, pm := range ports {
+		for _, rule := range portRules(owner, bridge, containerIP, pm) {
+			if err := ensureRule(rule[0], rule[1:]...); err != nil {
+				f.UnpublishPorts(owner, bridge, containerIP, ports[:i+1])
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (iptablesFirewall) UnpublishPorts(owner, bridge, containerIP string, ports []PortMapping) error {
+	var firstErr error
+	for _, pm := range ports {
+		for _, rule := range portRules(owner, bridge, containerIP, pm) {
+			if err := deleteRule(rule[0], rule[1:]...); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+func (iptablesFirewall) Flush() error {
+	local := []string{"-m", "addrtype", "--dst-type", "LOCAL"}
+	jumps := []struct {
+		table, parent, chain string
+		match                []string
+	}{
+		{"nat", "POSTROUTING", natChain, nil},
+		{"filter", "FORWARD", forwardChain, nil},
+		{"filter", "INPUT", inputChain, nil},
+		{"nat", "PREROUTING", dnatChain, local},
+		{"nat", "OUTPUT", dnatChain, local},
+	}
+	for _, j := range jumps {
+		jump := append(append([]string{}, j.match...), "-j", j.chain)
+		for iptables(append([]string{"-t", j.table, "-C", j.parent}, jump...)...) == nil {
+			if err := iptables(append([]string{"-t", j.table, "-D", j.parent}, jump...)...); err != nil {
+				return err
+			}
+		}
+	}
+	for _, j := range jumps {
+		if iptables("-t", j.table, "-L", j.chain, "-n") != nil {
+			continue
+		}
+		if err := iptables("-t", j.table, "-F", j.chain); err != nil {
+			return err
+		}
+		if err := iptables("-t", j.table, "-X", j.chain); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// natRules lists a network's rules, each as table, chain and rule spec.
+func natRules(n *Network) [][]string {
+	comment := "mydocker:" + n.Name
+	return [][]string{
+		{"nat", natChain, "-s", n.Subnet, "!", "-o", n.Bridge,
+			"-m", "comment", "--comment", comment, "-j", "MASQUERADE"},
+		// Published ports reached through localhost need a source the
+		// container can answer.
+		{"nat", natChain, "-s", "127.0.0.0/8", "-o", n.Bridge,
+			"-m", "comment", "--comment", comment, "-j", "MASQUERADE"},
+		{"filter", forwardChain, "-i", n.Bridge,
+			"-m", "comment", "--comment", comment, "-j", "ACCEPT"},
+		{"filter", forwardChain, "-o", n.Bridge, "-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED",
+			"-m", "comment", "--comment", comment, "-j", "ACCEPT"},
+		// route_localnet would also let containers address the host's
+		// loopback services directly; only replies may reach 127.0.0.0/8
+		// from the bridge.
+		{"filter", inputChain, "-i", n.Bridge, "-d", "127.0.0.0/8",
+			"-m", "conntrack", "!", "--ctstate", "RELATED,ESTABLISHED,DNAT",
+			"-m", "comment", "--comment", comment, "-j", "DROP"},
+	}
+}
+
+// ensureChain creates chain in table if needed and makes sure the built-in
+// chain parent jumps to it for packets matching match.
+func ensureChain(table, chain, parent string, match ...string) error {
+	if iptables("-t", table, "-L", chain, "-n") != nil {
+		if err := iptables("-t", table, "-N", chain); err != nil {
+			return err
+		}
+	}
+	jump := append(append([]string{}, match...), "-j", chain)
+	if iptables(append([]string{"-t", table, "-C", parent}, jump...)...) != nil {
+		if err := iptables(append([]string{"-t", table, "-I", parent}, jump...)...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ensureRule appends a rule to a chain unless it is there already.
+func ensureRule(table string, spec ...string) error {
+	chain, rule := spec[0], spec[1:]
+	if iptables(append([]string{"-t", table, "-C", chain}, rule...)...) == nil {
+		return nil
+	}
+	return iptables(append([]string{"-t", table, "-A", chain}, rule...)...)
+}
+
+// deleteRule removes a rule from a chain if it is there.
+func deleteRule(table string, spec ...string) error {
+	chain, rule := spec[0], spec[1:]
+	if iptables(append([]string{"-t", table, "-C", chain}, rule...)...) != nil {
+		return nil
+	}
+	return iptables(append([]string{"-t", table, "-D", chain}, rule...)...)
+}
+
+// iptables runs iptables, waiting for the xtables lock, and turns a failure
+// into an error carrying its output.
+func iptables(args ...string) error {
+	out, err := exec.Command("iptables", append([]string{"-w"}, args...)...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("iptables %s failed: %v: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// portRules lists the rules of one published port, each as table, chain
+// and rule spec.
+func portRules(owner, bridge, containerIP string, pm PortMapping) [][]string {
+	comment := []string{"-m", "comment", "--comment", "mydocker:" + owner}
+	proto := pm.Proto()
+	hostPort := strconv.Itoa(pm.HostPort)
+	containerPort := strconv.Itoa(pm.ContainerPort)
+
+	dnat := []string{"nat", dnatChain, "-p", proto}
+	if pm.HostIP != "" && pm.HostIP != "0.0.0.0" {
+		dnat = append(dnat, "-d", pm.HostIP+"/32")
+	}
+	dnat = append(dnat, "--dport", hostPort)
+	dnat = append(dnat, comment...)
+	dnat = append(dnat, "-j", "DNAT", "--to-destination", net.JoinHostPort(containerIP, containerPort))
+
+	hairpin := []string{"nat", natChain, "-p", proto, "-s", containerIP + "/32", "-d", containerIP + "/32", "--dport", containerPort}
+	hairpin = append(hairpin, comment...)
+	hairpin = append(hairpin, "-j", "MASQUERADE")
+
+	accept := []string{"filter", forwardChain, "-p", proto, "-d", containerIP + "/32", "!", "-i", bridge, "-o", bridge, "--dport", containerPort}
+	accept = append(accept, comment...)
+	accept = append(accept, "-j", "ACCEPT")
+
+	return [][]string{dnat, hairpin, accept}
+}
@@ -0,0 +1,76 @@
+package network
+
+import (
+	"fmt"
+	"os"
+
+	"mydocker/config"
+)
+
+// EnableForwarding turns on IPv4 forwarding so containers can reach beyond
+// their bridge.
+func EnableForwarding() error {
+	if err := os.WriteFile("/proc/sys/net/ipv4/ip_forward", []byte("1\n"), 0644); err != nil {
+		return fmt.Errorf("failed to enable IP forwarding: %v", err)
+	}
+	return nil
+}
+
+// SetupNAT lets the containers of a network reach other hosts: traffic from
+// its subnet leaving through any other interface is masqueraded and
+// forwarded. It is safe to call again for a network that is set up.
+func SetupNAT(n *Network) error {
+	if err := EnableForwarding(); err != nil {
+		return err
+	}
+	fw, err := firewall()
+	if err != nil {
+		return err
+	}
+	if err := fw.SetupNetwork(n); err != nil {
+		return err
+	}
+	return enableRouteLocalnet(n.Bridge)
+}
+
+// TrySetupNAT runs SetupNAT. With the daemon config's userland proxy,
+// published ports do not depend on the firewall, so a failure, e.g. on a
+// host without a working iptables or nftables, only costs the network its
+// outbound NAT and is reported as a warning.
+func TrySetupNAT(n *Network) error {
+	err := SetupNAT(n)
+	if err == nil {
+		return nil
+	}
+	cfg, cfgErr := config.Load()
+	if cfgErr != nil || !cfg.UserlandProxy {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Warning: %v; containers on network %s cannot reach other hosts\n", err, n.Name)
+	return nil
+}
+
+// TeardownNAT removes the rules SetupNAT installed for a network.
+func TeardownNAT(n *Network) error {
+	fw, err := firewall()
+	if err != nil {
+		return err
+	}
+	return fw.TeardownNetwork(n)
+}
+
+// TryTeardownNAT runs TeardownNAT, with the same tolerance as TrySetupNAT:
+// under the userland proxy a firewall that cannot be reached is reported as
+// a warning, as it may never have had rules for the network.
+func TryTeardownNAT(n *Network) error {
+	err := TeardownNAT(n)
+	if err == nil {
+		return nil
+	}
+	cfg, cfgErr := config.Load()
+	if cfgErr != nil || !cfg.UserlandProxy {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Warning: %v; firewall rules of network %s may be left behind\n", err, n.Name)
+	return nil
+}
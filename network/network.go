@@ -1,83 +1,112 @@
 package network
 
 import (
+	"errors"
 	"fmt"
 	"net"
+	"syscall"
 
 	"github.com/vishvananda/netlink"
 	"github.com/vishvananda/netns"
 )
 
-const bridgeName = "br0"
-
-/*
-/// Example code to set up a bridge network interface
-
-func SetupBridge() error {
-    // Check if bridge exists
-    br, err := netlink.LinkByName(bridgeName)
-    if err == nil {
-        return nil // Bridge already exists
-    }
-
-    // Create bridge
-    br = &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: bridgeName}}
-    if err := netlink.LinkAdd(br); err != nil {
-        return fmt.Errorf("failed to create bridge: %v", err)
-    }
+// DefaultBridge is the bridge device of DefaultNetwork.
+const DefaultBridge = "mydocker0"
+
+// Endpoint describes how a container is attached to a bridge.
+type Endpoint struct {
+	// Bridge is the host bridge the veth pair is plugged into.
+	Bridge string
+	// HostIface is the host end of the veth pair.
+	HostIface string
+	// Iface is the name of the interface inside the container, e.g. "eth0".
+	Iface   string
+	Address *net.IPNet
+	MAC     net.HardwareAddr
+	// Gateway, when set, becomes the container's default route.
+	Gateway net.IP
+}
 
-    // Assign IP to bridge
-    addr, _ := netlink.ParseAddr("10.0.0.1/24")
-    if err := netlink.AddrAdd(br, addr); err != nil {
-        return fmt.Errorf("failed to assign IP to bridge: %v", err)
-    }
+// SetupBridge creates the bridge if it does not exist yet, gives it the
+// gateway address and brings it up.
+func SetupBridge(name string, gateway *net.IPNet) error {
+	br, err := netlink.LinkByName(name)
+	if err != nil {
+		var notFound netlink.LinkNotFoundError
+		if !errors.As(err, &notFound) {
+			return fmt.Errorf("failed to look up bridge %s: %v", name, err)
+		}
+		la := netlink.NewLinkAttrs()
+		la.Name = name
+		br = &netlink.Bridge{LinkAttrs: la}
+		if err := netlink.LinkAdd(br); err != nil {
+			return fmt.Errorf("failed to create bridge %s: %v", name, err)
+		}
+	}
 
-    // Bring up the bridge
-    if err := netlink.LinkSetUp(br); err != nil {
-        return fmt.Errorf("failed to bring up bridge: %v", err)
-    }
+	// Assign the gateway address unless the bridge has it already
+	addrs, err := netlink.AddrList(br, netlink.FAMILY_V4)
+	if err != nil {
+		return fmt.Errorf("failed to list addresses of bridge %s: %v", name, err)
+	}
+	assigned := false
+	for _, addr := range addrs {
+		if addr.IPNet.String() == gateway.String() {
+			assigned = true
+		}
+	}
+	if !assigned {
+		if err := netlink.AddrAdd(br, &netlink.Addr{IPNet: gateway}); err != nil {
+			return fmt.Errorf("failed to assign %s to bridge %s: %v", gateway, name, err)
+		}
+	}
 
-    return nil
+	// Bring up the bridge
+	if err := netlink.LinkSetUp(br); err != nil {
+		return fmt.Errorf("failed to bring up bridge %s: %v", name, err)
+	}
+	return nil
 }
 
-*/
-
-// Setup sets up network namespace and veth pair
-func SetupNetwork(containerPid int, vethHost, vethContainer string) error {
+// SetupNetwork connects the network namespace of containerPid to ep's
+// bridge through a veth pair and configures the container end.
+func SetupNetwork(containerPid int, ep Endpoint) error {
+	br, err := netlink.LinkByName(ep.Bridge)
+	if err != nil {
+		return fmt.Errorf("failed to get bridge %s: %v", ep.Bridge, err)
+	}
 
+	// The container end is created under a temporary name, as the host may
+	// have an interface called ep.Iface itself, and renamed once moved.
+	peerName := "c" + ep.HostIface
+	if len(peerName) > 15 {
+		peerName = peerName[:15]
+	}
 	la := netlink.NewLinkAttrs()
-	la.Name = vethHost
+	la.Name = ep.HostIface
+	la.MasterIndex = br.Attrs().Index
 	veth := &netlink.Veth{
 		LinkAttrs: la,
-		PeerName:  vethContainer,
+		PeerName:  peerName,
 	}
-
 	if err := netlink.LinkAdd(veth); err != nil {
 		return fmt.Errorf("could not add veth pair: %v", err)
 	}
 
-	// Attach host end to bridge
-	br, err := netlink.LinkByName(bridgeName)
-	if err != nil {
-		return fmt.Errorf("failed to get bridge: %v", err)
+	if err := attach(containerPid, ep, peerName); err != nil {
+		netlink.LinkDel(veth)
+		return err
 	}
+	return nil
+}
 
-	// Get link for vethHost
-	hostLink, err := netlink.LinkByName(vethHost)
+// attach brings up the host end of the veth pair and moves the peer into
+// the container's namespace.
+func attach(containerPid int, ep Endpoint, peerName string) error {
+	hostLink, err := netlink.LinkByName(ep.HostIface)
 	if err != nil {
 		return fmt.Errorf("could not get host veth link: %v", err)
 	}
-
-	if err := netlink.LinkSetMaster(hostLink, br); err != nil {
-		return fmt.Errorf("could not set master for host veth: %v", err)
-	}
-
-	// bring up host veth
-	if err := netlink.LinkSetUp(hostLink); err != nil {
-		return fmt.Errorf("could not bring up host veth: %v", err)
-	}
-
-	// Bring up host end of veth
 	if err := netlink.LinkSetUp(hostLink); err != nil {
 		return fmt.Errorf("could not bring up host veth: %v", err)
 	}
@@ -89,93 +118,114 @@ func SetupNetwork(containerPid int, vethHost, vethContainer string) error {
 	}
 	defer nsHandle.Close()
 
-	// Get link for vethContainer
-	containerLink, err := netlink.LinkByName(vethContainer)
+	// Move container end of veth to container's netns
+	peer, err := netlink.LinkByName(peerName)
 	if err != nil {
 		return fmt.Errorf("could not get container veth link: %v", err)
 	}
-
-	// Move container end of veth to container's netns
-	if err := netlink.LinkSetNsFd(containerLink, int(nsHandle)); err != nil {
+	if err := netlink.LinkSetNsFd(peer, int(nsHandle)); err != nil {
 		return fmt.Errorf("could not set netns for container veth: %v", err)
 	}
 
-	// Configure container's network interface inside its namespace
-	err = configureContainerInterface(containerPid, vethContainer)
-	if err != nil {
+	if err := configureContainerInterface(nsHandle, peerName, ep); err != nil {
 		return fmt.Errorf("could not configure container interface: %v", err)
 	}
-
 	return nil
 }
 
-// configureContainerInterface configures the container's network interface
-func configureContainerInterface(pid int, ifName string) error {
-	// Open container's network namespace
-	nsHandle, err := netns.GetFromPid(pid)
-	if err != nil {
-		return fmt.Errorf("could not get netns for pid %d: %v", pid, err)
-	}
-	defer nsHandle.Close()
-
-	// Save current network namespace
-	origNS, err := netns.Get()
+// configureContainerInterface names, addresses and brings up the
+// container's interface and its loopback, and installs the default route.
+func configureContainerInterface(nsHandle netns.NsHandle, peerName string, ep Endpoint) error {
+	// A handle bound to the container's namespace avoids switching the
+	// namespace of the calling thread.
+	h, err := netlink.NewHandleAt(nsHandle)
 	if err != nil {
-		return fmt.Errorf("could not get current netns: %v", err)
+		return fmt.Errorf("could not open netlink handle in container netns: %v", err)
 	}
-	defer origNS.Close()
+	defer h.Close()
 
-	// Set to container's network namespace
-	if err := netns.Set(nsHandle); err != nil {
-		return fmt.Errorf("could not set netns: %v", err)
+	if err := loopbackUp(h); err != nil {
+		return err
 	}
-	defer netns.Set(origNS)
 
-	// Now in container's netns
-	link, err := netlink.LinkByName(ifName)
+	link, err := h.LinkByName(peerName)
 	if err != nil {
-		return fmt.Errorf("could not get link %s: %v", ifName, err)
+		return fmt.Errorf("could not get link %s: %v", peerName, err)
 	}
-
-	// Assign IP address
-	addr, err := netlink.ParseAddr("10.0.0.2/24")
-	if err != nil {
-		return fmt.Errorf("could not parse IP address: %v", err)
+	if err := h.LinkSetName(link, ep.Iface); err != nil {
+		return fmt.Errorf("could not rename %s to %s: %v", peerName, ep.Iface, err)
 	}
 
-	if err := netlink.AddrAdd(link, addr); err != nil {
+	// Assign MAC and IP address
+	if ep.MAC != nil {
+		if err := h.LinkSetHardwareAddr(link, ep.MAC); err != nil {
+			return fmt.Errorf("could not set MAC address: %v", err)
+		}
+	}
+	if err := h.AddrAdd(link, &netlink.Addr{IPNet: ep.Address}); err != nil {
 		return fmt.Errorf("could not add IP address: %v", err)
 	}
 
 	// Bring up interface
-	if err := netlink.LinkSetUp(link); err != nil {
+	if err := h.LinkSetUp(link); err != nil {
 		return fmt.Errorf("could not bring up interface: %v", err)
 	}
 
 	// Add default route
-	gw := net.ParseIP("10.0.0.1")
-	route := &netlink.Route{
-		LinkIndex: link.Attrs().Index,
-		Gw:        gw,
+	if ep.Gateway != nil {
+		route := &netlink.Route{
+			LinkIndex: link.Attrs().Index,
+			Gw:        ep.Gateway,
+		}
+		if err := h.RouteAdd(route); err != nil {
+			return fmt.Errorf("could not add route: %v", err)
+		}
 	}
 
-	if err := netlink.RouteAdd(route); err != nil {
-		return fmt.Errorf("could not add route: %v", err)
+	return nil
+}
+
+// SetupLoopback brings up the loopback interface in the network namespace
+// of containerPid, for containers that get no other interface.
+func SetupLoopback(containerPid int) error {
+	nsHandle, err := netns.GetFromPid(containerPid)
+	if err != nil {
+		return fmt.Errorf("could not get netns for pid %d: %v", containerPid, err)
 	}
+	defer nsHandle.Close()
+	h, err := netlink.NewHandleAt(nsHandle)
+	if err != nil {
+		return fmt.Errorf("could not open netlink handle in container netns: %v", err)
+	}
+	defer h.Close()
+	return loopbackUp(h)
+}
 
+func loopbackUp(h *netlink.Handle) error {
+	lo, err := h.LinkByName("lo")
+	if err != nil {
+		return fmt.Errorf("could not get loopback: %v", err)
+	}
+	if err := h.LinkSetUp(lo); err != nil {
+		return fmt.Errorf("could not bring up loopback: %v", err)
+	}
 	return nil
 }
 
-func Cleanup(vethHost, vethContainer string) error {
-	// Delete host-side veth interface
-	link, err := netlink.LinkByName(vethHost)
-	if err == nil {
-		if err := netlink.LinkDel(link); err != nil {
-			return fmt.Errorf("failed to delete host veth %s: %v", vethHost, err)
+// Cleanup deletes the host end of a container's veth pair, which removes
+// the container end with it. A missing interface is not an error: it goes
+// away on its own when the container's namespace is destroyed.
+func Cleanup(hostIface string) error {
+	link, err := netlink.LinkByName(hostIface)
+	if err != nil {
+		var notFound netlink.LinkNotFoundError
+		if errors.As(err, &notFound) {
+			return nil
 		}
+		return fmt.Errorf("failed to look up host veth %s: %v", hostIface, err)
+	}
+	if err := netlink.LinkDel(link); err != nil && !errors.Is(err, syscall.ENODEV) {
+		return fmt.Errorf("failed to delete host veth %s: %v", hostIface, err)
 	}
-
-	// Note: Deleting one end of the veth pair removes both ends
-
 	return nil
 }
@@ -0,0 +1,375 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/google/nftables/userdata"
+	"golang.org/x/sys/unix"
+)
+
+// nftTable is the nftables table mydocker owns. Everything it installs
+// lives there, so `nft delete table ip mydocker` undoes all of it.
+const nftTable = "mydocker"
+
+// Chains of nftTable. prerouting and output jump to ports for traffic
+// addressed to the host itself.
+const (
+	nftPrerouting  = "prerouting"
+	nftOutput      = "output"
+	nftPorts       = "ports"
+	nftPostrouting = "postrouting"
+	nftForward     = "forward"
+	nftInput       = "input"
+)
+
+// nftLock serializes mydocker processes changing nftTable, which otherwise
+// could both find a rule missing and add it twice.
+const nftLock = "/var/lib/mydocker/network/nftables.lock"
+
+// nftablesFirewall installs the rules over netlink in nftTable.
+type nftablesFirewall struct{}
+
+// nftRule is a rule of nftTable. Its comment identifies it: a rule whose
+// comment is already in its chain is not added again.
+type nftRule struct {
+	chain   string
+	comment string
+	exprs   []expr.Any
+}
+
+// SetupNetwork installs the network's rules. An accept verdict only ends
+// the evaluation of its own table: a forward chain of another table, such as
+// the one of firewalld or iptables-nft, that drops by default still drops
+// the traffic nftTable accepts. SetupNetwork cannot change that and warns
+// about such chains instead.
+func (nftablesFirewall) SetupNetwork(n *Network) error {
+	rules, err := nftNetworkRules(n)
+	if err != nil {
+		return err
+	}
+	if err := nftApply(rules, nil); err != nil {
+		return err
+	}
+	nftWarnForeignDrops(n)
+	return nil
+}
+
+func (nftablesFirewall) TeardownNetwork(n *Network) error {
+	rules, err := nftNetworkRules(n)
+	if err != nil {
+		return err
+	}
+	return nftApply(nil, rules)
+}
+
+func (nftablesFirewall) Flush() error {
+	return withLock(nftLock, func() error {
+		conn, err := nftables.New()
+		if err != nil {
+			return fmt.Errorf("failed to open nftables connection: %v", err)
+		}
+		if _, err := conn.ListTableOfFamily(nftTable, nftables.TableFamilyIPv4); errors.Is(err, unix.ENOENT) {
+			return nil
+		}
+		conn.DelTable(&nftables.Table{Family: nftables.TableFamilyIPv4, Name: nftTable})
+		if err := conn.Flush(); err != nil {
+			return fmt.Errorf("failed to delete nftables table %s: %v", nftTable, err)
+		}
+		return nil
+	})
+}
+
+// nftWarnForeignDrops warns about forward chains outside nftTable that drop
+// by default, which would drop the traffic of n too.
+func nftWarnForeignDrops(n *Network) {
+	conn, err := nftables.New()
+	if err != nil {
+		return
+	}
+	chains, err := conn.ListChains()
+	if err != nil {
+		return
+	}
+	for _, c := range chains {
+		if c.Table == nil || c.Table.Name == nftTable || c.Hooknum == nil || *c.Hooknum != *nftables.ChainHookForward {
+			continue
+		}
+		if c.Policy != nil && *c.Policy == nftables.ChainPolicyDrop {
+			fmt.Fprintf(os.Stderr, "Warning: nftables chain %s of table %s drops forwarded traffic by default; "+
+				"accept traffic from and to bridge %s there for containers on network %s to reach other hosts\n",
+				c.Name, c.Table.Name, n.Bridge, n.Name)
+		}
+	}
+}
+
+func (nftablesFirewall) PublishPorts(owner, bridge, containerIP string, ports []PortMapping) error {
+	rules, err := nftPortRules(owner, bridge, containerIP, ports)
+	if err != nil {
+		return err
+	}
+	return nftApply(rules, nil)
+}
+
+func (nftablesFirewall) UnpublishPorts(owner, bridge, containerIP string, ports []PortMapping) error {
+	rules, err := nftPortRules(owner, bridge, containerIP, ports)
+	if err != nil {
+		return err
+	}
+	return nftApply(nil, rules)
+}
+
+// nftNetworkRules mirrors natRules.
+func nftNetworkRules(n *Network) ([]nftRule, error) {
+	_, subnet, err := net.ParseCIDR(n.Subnet)
+	if err != nil {
+		return nil, fmt.Errorf("invalid subnet %q of network %s: %v", n.Subnet, n.Name, err)
+	}
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	comment := "mydocker:" + n.Name
+	return []nftRule{
+		{nftPostrouting, comment + " masquerade", nftExprs(
+			nftAddr(12, subnet), nftIface(expr.MetaKeyOIFNAME, expr.CmpOpNeq, n.Bridge), &expr.Masq{})},
+		// Published ports reached through localhost need a source the
+		// container can answer.
+		{nftPostrouting, comment + " masquerade-localhost", nftExprs(
+			nftAddr(12, loopback), nftIface(expr.MetaKeyOIFNAME, expr.CmpOpEq, n.Bridge), &expr.Masq{})},
+		{nftForward, comment + " accept-out", nftExprs(
+			nftIface(expr.MetaKeyIIFNAME, expr.CmpOpEq, n.Bridge), nftVerdict(expr.VerdictAccept))},
+		{nftForward, comment + " accept-established", nftExprs(
+			nftIface(expr.MetaKeyOIFNAME, expr.CmpOpEq, n.Bridge), nftEstablished(), nftVerdict(expr.VerdictAccept))},
+		{nftInput, comment + " drop-localhost", nftExprs(
+			nftIface(expr.MetaKeyIIFNAME, expr.CmpOpEq, n.Bridge), nftAddr(16, loopback),
+			nftNotReplyOrDNAT(), nftVerdict(expr.VerdictDrop))},
+	}, nil
+}
+
+// nftPortRules mirrors portRules for every mapping.
+func nftPortRules(owner, bridge, containerIP string, ports []PortMapping) ([]nftRule, error) {
+	ip := net.ParseIP(containerIP).To4()
+	if ip == nil {
+		return nil, fmt.Errorf("invalid container IP %q", containerIP)
+	}
+	container := &net.IPNet{IP: ip, Mask: net.CIDRMask(32, 32)}
+
+	var rules []nftRule
+	for _, pm := range ports {
+		proto := byte(unix.IPPROTO_TCP)
+		if pm.Proto() == "udp" {
+			proto = unix.IPPROTO_UDP
+		}
+		comment := fmt.Sprintf("mydocker:%s %s/%s", owner, pm.HostAddr(), pm.Proto())
+
+		var hostAddr []expr.Any
+		if pm.HostIP != "" && pm.HostIP != "0.0.0.0" {
+			hostIP := net.ParseIP(pm.HostIP).To4()
+			if hostIP == nil {
+				return nil, fmt.Errorf("invalid host IP %q", pm.HostIP)
+			}
+			hostAddr = nftAddr(16, &net.IPNet{IP: hostIP, Mask: net.CIDRMask(32, 32)})
+		}
+		dnat := []expr.Any{
+			&expr.Immediate{Register: 1, Data: ip},
+			&expr.Immediate{Register: 2, Data: binaryutil.BigEndian.PutUint16(uint16(pm.ContainerPort))},
+			&expr.NAT{Type: expr.NATTypeDestNAT, Family: unix.NFPROTO_IPV4, RegAddrMin: 1, RegProtoMin: 2, Specified: true},
+		}
+
+		rules = append(rules,
+			nftRule{nftPorts, comment + " dnat", nftExprs(
+				hostAddr, nftPort(proto, pm.HostPort), dnat)},
+			nftRule{nftPostrouting, comment + " hairpin", nftExprs(
+				nftAddr(12, container), nftAddr(16, container), nftPort(proto, pm.ContainerPort), &expr.Masq{})},
+			nftRule{nftForward, comment + " accept", nftExprs(
+				nftAddr(16, container), nftIface(expr.MetaKeyIIFNAME, expr.CmpOpNeq, bridge),
+				nftIface(expr.MetaKeyOIFNAME, expr.CmpOpEq, bridge), nftPort(proto, pm.ContainerPort),
+				nftVerdict(expr.VerdictAccept))},
+		)
+	}
+	return rules, nil
+}
+
+// nftApply creates nftTable and its chains if needed, then adds the rules of
+// add that are missing and deletes those of del that are present, all in one
+// transaction.
+func nftApply(add, del []nftRule) error {
+	return withLock(nftLock, func() error {
+		conn, err := nftables.New()
+		if err != nil {
+			return fmt.Errorf("failed to open nftables connection: %v", err)
+		}
+		table := &nftables.Table{Family: nftables.TableFamilyIPv4, Name: nftTable}
+
+		if len(add) == 0 {
+			// Nothing to delete from a table that was never created
+			if _, err := conn.ListTableOfFamily(nftTable, nftables.TableFamilyIPv4); errors.Is(err, unix.ENOENT) {
+				return nil
+			}
+		} else {
+			nftChains(conn, table)
+			if err := conn.Flush(); err != nil {
+				return fmt.Errorf("failed to create nftables table %s: %v", nftTable, err)
+			}
+			local := nftExprs(
+				&expr.Fib{Register: 1, FlagDADDR: true, ResultADDRTYPE: true},
+				&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.NativeEndian.PutUint32(unix.RTN_LOCAL)},
+				&expr.Verdict{Kind: expr.VerdictJump, Chain: nftPorts},
+			)
+			add = append([]nftRule{
+				{nftPrerouting, "mydocker:ports", local},
+				{nftOutput, "mydocker:ports", local},
+			}, add...)
+		}
+
+		existing := map[string][]*nftables.Rule{}
+		for _, name := range []string{nftPrerouting, nftOutput, nftPorts, nftPostrouting, nftForward, nftInput} {
+			rules, err := conn.GetRules(table, &nftables.Chain{Name: name, Table: table})
+			if errors.Is(err, unix.ENOENT) {
+				// A table created by an older mydocker may lack the chain
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("failed to list nftables chain %s: %v", name, err)
+			}
+			for _, r := range rules {
+				if comment, ok := userdata.GetString(r.UserData, userdata.TypeComment); ok {
+					existing[name+"/"+comment] = append(existing[name+"/"+comment], r)
+				}
+			}
+		}
+
+		for _, rule := range del {
+			for _, r := range existing[rule.chain+"/"+rule.comment] {
+				if err := conn.DelRule(r); err != nil {
+					return fmt.Errorf("failed to delete nftables rule %q: %v", rule.comment, err)
+				}
+			}
+		}
+		for _, rule := range add {
+			if len(existing[rule.chain+"/"+rule.comment]) > 0 {
+				continue
+			}
+			conn.AddRule(&nftables.Rule{
+				Table:    table,
+				Chain:    &nftables.Chain{Name: rule.chain, Table: table},
+				Exprs:    rule.exprs,
+				UserData: userdata.AppendString(nil, userdata.TypeComment, rule.comment),
+			})
+		}
+		if err := conn.Flush(); err != nil {
+			return fmt.Errorf("failed to update nftables table %s: %v", nftTable, err)
+		}
+		return nil
+	})
+}
+
+// nftChains queues the creation of nftTable and its chains. Adding them
+// again when they exist is harmless.
+func nftChains(conn *nftables.Conn, table *nftables.Table) {
+	conn.AddTable(table)
+	accept := nftables.ChainPolicyAccept
+	for _, c := range []*nftables.Chain{
+		{Name: nftPrerouting, Type: nftables.ChainTypeNAT, Hooknum: nftables.ChainHookPrerouting, Priority: nftables.ChainPriorityNATDest},
+		{Name: nftOutput, Type: nftables.ChainTypeNAT, Hooknum: nftables.ChainHookOutput, Priority: nftables.ChainPriorityNATDest},
+		{Name: nftPostrouting, Type: nftables.ChainTypeNAT, Hooknum: nftables.ChainHookPostrouting, Priority: nftables.ChainPriorityNATSource},
+		{Name: nftForward, Type: nftables.ChainTypeFilter, Hooknum: nftables.ChainHookForward, Priority: nftables.ChainPriorityFilter, Policy: &accept},
+		{Name: nftInput, Type: nftables.ChainTypeFilter, Hooknum: nftables.ChainHookInput, Priority: nftables.ChainPriorityFilter, Policy: &accept},
+		{Name: nftPorts},
+	} {
+		c.Table = table
+		conn.AddChain(c)
+	}
+}
+
+// nftExprs flattens expressions and lists of expressions into one list.
+func nftExprs(parts ...any) []expr.Any {
+	var exprs []expr.Any
+	for _, part := range parts {
+		switch e := part.(type) {
+		case []expr.Any:
+			exprs = append(exprs, e...)
+		case expr.Any:
+			exprs = append(exprs, e)
+		}
+	}
+	return exprs
+}
+
+// nftAddr matches the IPv4 source (offset 12) or destination (offset 16)
+// address against a subnet.
+func nftAddr(offset uint32, subnet *net.IPNet) []expr.Any {
+	exprs := []expr.Any{
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseNetworkHeader, Offset: offset, Len: 4},
+	}
+	if ones, _ := subnet.Mask.Size(); ones < 32 {
+		exprs = append(exprs, &expr.Bitwise{
+			SourceRegister: 1, DestRegister: 1, Len: 4,
+			Mask: []byte(subnet.Mask), Xor: make([]byte, 4),
+		})
+	}
+	return append(exprs, &expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: subnet.IP.Mask(subnet.Mask).To4()})
+}
+
+// nftIface compares the input or output interface name.
+func nftIface(key expr.MetaKey, op expr.CmpOp, name string) []expr.Any {
+	ifname := make([]byte, unix.IFNAMSIZ)
+	copy(ifname, name)
+	return []expr.Any{
+		&expr.Meta{Key: key, Register: 1},
+		&expr.Cmp{Op: op, Register: 1, Data: ifname},
+	}
+}
+
+// nftPort matches the transport protocol and destination port.
+func nftPort(proto byte, port int) []expr.Any {
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{proto}},
+		&expr.Payload{DestRegister: 1, Base: expr.PayloadBaseTransportHeader, Offset: 2, Len: 2},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.BigEndian.PutUint16(uint16(port))},
+	}
+}
+
+// nftEstablished matches packets of connections conntrack already knows.
+func nftEstablished() []expr.Any {
+	return []expr.Any{
+		&expr.Ct{Register: 1, Key: expr.CtKeySTATE},
+		&expr.Bitwise{
+			SourceRegister: 1, DestRegister: 1, Len: 4,
+			Mask: binaryutil.NativeEndian.PutUint32(expr.CtStateBitESTABLISHED | expr.CtStateBitRELATED),
+			Xor:  make([]byte, 4),
+		},
+		&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: make([]byte, 4)},
+	}
+}
+
+// nftNotReplyOrDNAT matches packets that neither belong to a connection
+// conntrack already knows nor had their destination rewritten by DNAT.
+func nftNotReplyOrDNAT() []expr.Any {
+	// IPS_DST_NAT in the conntrack status
+	const statusDNAT uint32 = 1 << 5
+	return []expr.Any{
+		&expr.Ct{Register: 1, Key: expr.CtKeySTATE},
+		&expr.Bitwise{
+			SourceRegister: 1, DestRegister: 1, Len: 4,
+			Mask: binaryutil.NativeEndian.PutUint32(expr.CtStateBitESTABLISHED | expr.CtStateBitRELATED),
+			Xor:  make([]byte, 4),
+		},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: make([]byte, 4)},
+		&expr.Ct{Register: 1, Key: expr.CtKeySTATUS},
+		&expr.Bitwise{
+			SourceRegister: 1, DestRegister: 1, Len: 4,
+			Mask: binaryutil.NativeEndian.PutUint32(statusDNAT),
+			Xor:  make([]byte, 4),
+		},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: make([]byte, 4)},
+	}
+}
+
+func nftVerdict(kind expr.VerdictKind) expr.Any {
+	return &expr.Verdict{Kind: kind}
+}
@@ -0,0 +1,200 @@
+package network
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// portsFile records which container holds each published host port.
+const portsFile = "/var/lib/mydocker/network/ports.json"
+
+// Used when /proc/sys/net/ipv4/ip_local_port_range cannot be read.
+const (
+	defaultEphemeralStart = 32768
+	defaultEphemeralEnd   = 60999
+)
+
+// portKey identifies an allocated host port, e.g. "tcp/0.0.0.0/8080".
+func portKey(proto, hostIP string, port int) string {
+	if hostIP == "" {
+		hostIP = "0.0.0.0"
+	}
+	return proto + "/" + hostIP + "/" + strconv.Itoa(port)
+}
+
+// AllocatePorts reserves the host ports of ports for owner and returns the
+// mappings with every host port decided: a port of 0 gets a random one from
+// the ephemeral range, a host range (HostPortEnd) its first free port. A
+// port another container holds, or that something on the host is already
+// listening on, is an error and nothing is reserved.
+func AllocatePorts(owner string, ports []PortMapping) ([]PortMapping, error) {
+	if len(ports) == 0 {
+		return nil, nil
+	}
+	allocated := make([]PortMapping, len(ports))
+	copy(allocated, ports)
+	err := updatePorts(func(held map[string]string) error {
+		var taken []string
+		fail := func(err error) error {
+			for _, key := range taken {
+				delete(held, key)
+			}
+			return err
+		}
+		for i, pm := range allocated {
+			var candidates []int
+			switch {
+			case pm.HostPort == 0:
+				candidates = ephemeralPorts()
+			case pm.HostPortEnd > pm.HostPort:
+				for p := pm.HostPort; p <= pm.HostPortEnd; p++ {
+					candidates = append(candidates, p)
+				}
+			default:
+				candidates = []int{pm.HostPort}
+			}
+
+			var lastErr error
+			port := 0
+			for _, p := range candidates {
+				if holder := heldBy(held, pm.Proto(), pm.HostIP, p); holder != "" {
+					lastErr = fmt.Errorf("bind for %s:%d failed: port is already allocated by container %s", hostIPOrAny(pm.HostIP), p, holder)
+					continue
+				}
+				if err := probePort(pm.Proto(), pm.HostIP, p); err != nil {
+					lastErr = err
+					continue
+				}
+				port = p
+				break
+			}
+			if port == 0 {
+				if len(candidates) > 1 {
+					return fail(fmt.Errorf("no free host port for %d/%s: %v", pm.ContainerPort, pm.Proto(), lastErr))
+				}
+				return fail(lastErr)
+			}
+			key := portKey(pm.Proto(), pm.HostIP, port)
+			held[key] = owner
+			taken = append(taken, key)
+			allocated[i].HostPort, allocated[i].HostPortEnd = port, 0
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return allocated, nil
+}
+
+// ReleasePorts frees every host port owner holds.
+func ReleasePorts(owner string) error {
+	return updatePorts(func(held map[string]string) error {
+		for key, holder := range held {
+			if holder == owner {
+				delete(held, key)
+			}
+		}
+		return nil
+	})
+}
+
+// heldBy returns the container holding port, if any. A port bound on all
+// addresses conflicts with the same port on any one address and vice versa.
+func heldBy(held map[string]string, proto, hostIP string, port int) string {
+	for key, holder := range held {
+		parts := strings.SplitN(key, "/", 3)
+		if len(parts) != 3 || parts[0] != proto || parts[2] != strconv.Itoa(port) {
+			continue
+		}
+		if ip := hostIPOrAny(hostIP); parts[1] == ip || parts[1] == "0.0.0.0" || ip == "0.0.0.0" {
+			return holder
+		}
+	}
+	return ""
+}
+
+// probePort checks nothing on the host listens on the port by binding it.
+func probePort(proto, hostIP string, port int) error {
+	addr := net.JoinHostPort(hostIPOrAny(hostIP), strconv.Itoa(port))
+	if proto == "udp" {
+		conn, err := net.ListenPacket("udp4", addr)
+		if err != nil {
+			return fmt.Errorf("failed to bind host port %s/udp: %v", addr, err)
+		}
+		return conn.Close()
+	}
+	l, err := net.Listen("tcp4", addr)
+	if err != nil {
+		return fmt.Errorf("failed to bind host port %s/tcp: %v", addr, err)
+	}
+	return l.Close()
+}
+
+// ephemeralPorts returns the kernel's local port range, starting at a
+// random port and wrapping around, so repeated runs spread out.
+func ephemeralPorts() []int {
+	start, end := defaultEphemeralStart, defaultEphemeralEnd
+	if data, err := os.ReadFile("/proc/sys/net/ipv4/ip_local_port_range"); err == nil {
+		if f := strings.Fields(string(data)); len(f) == 2 {
+			s, err1 := strconv.Atoi(f[0])
+			e, err2 := strconv.Atoi(f[1])
+			if err1 == nil && err2 == nil && s > 0 && s <= e {
+				start, end = s, e
+			}
+		}
+	}
+	n := end - start + 1
+	offset := rand.Intn(n)
+	ports := make([]int, n)
+	for i := range ports {
+		ports[i] = start + (offset+i)%n
+	}
+	return ports
+}
+
+func hostIPOrAny(hostIP string) string {
+	if hostIP == "" {
+		return "0.0.0.0"
+	}
+	return hostIP
+}
+
+// updatePorts applies fn to the host port allocations under an exclusive
+// lock.
+func updatePorts(fn func(map[string]string) error) error {
+	return withLock(portsFile+".lock", func() error {
+		held := map[string]string{}
+		data, err := os.ReadFile(portsFile)
+		switch {
+		case err == nil:
+			if err := json.Unmarshal(data, &held); err != nil {
+				return fmt.Errorf("failed to parse %s: %v", portsFile, err)
+			}
+		case !os.IsNotExist(err):
+			return fmt.Errorf("failed to read port allocations: %v", err)
+		}
+
+		if err := fn(held); err != nil {
+			return err
+		}
+
+		data, err = json.MarshalIndent(held, "", "    ")
+		if err != nil {
+			return err
+		}
+		tmp := portsFile + ".tmp"
+		if err := os.WriteFile(tmp, data, 0644); err != nil {
+			return fmt.Errorf("failed to write port allocations: %v", err)
+		}
+		if err := os.Rename(tmp, portsFile); err != nil {
+			return fmt.Errorf("failed to write port allocations: %v", err)
+		}
+		return nil
+	})
+}
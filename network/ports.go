@@ -0,0 +1,86 @@
+package network
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+// PortMapping publishes a container port on the host.
+type PortMapping struct {
+	// HostIP restricts the mapping to one host address; empty means all.
+	HostIP   string `json:"hostIp,omitempty"`
+	HostPort int    `json:"hostPort"`
+	// HostPortEnd, when above HostPort, asks AllocatePorts for any free
+	// port in HostPort-HostPortEnd.
+	HostPortEnd   int `json:"-"`
+	ContainerPort int `json:"containerPort"`
+	// Protocol is "tcp" or "udp"; empty means tcp.
+	Protocol string `json:"protocol,omitempty"`
+}
+
+// Proto returns the mapping's protocol, defaulting to tcp.
+func (p PortMapping) Proto() string {
+	if p.Protocol == "" {
+		return "tcp"
+	}
+	return p.Protocol
+}
+
+// HostAddr returns the host address the port is published on, e.g.
+// "0.0.0.0:8080".
+func (p PortMapping) HostAddr() string {
+	hostIP := p.HostIP
+	if hostIP == "" {
+		hostIP = "0.0.0.0"
+	}
+	return net.JoinHostPort(hostIP, strconv.Itoa(p.HostPort))
+}
+
+// String formats the mapping the way `mydocker port` prints it, e.g.
+// "80/tcp -> 0.0.0.0:8080".
+func (p PortMapping) String() string {
+	return fmt.Sprintf("%d/%s -> %s", p.ContainerPort, p.Proto(), p.HostAddr())
+}
+
+// PublishPorts forwards the host ports of ports to containerIP on bridge.
+// Connections from the host itself, including to localhost, are forwarded
+// too, as are containers reaching their own published ports. On failure the
+// rules installed so far are removed again.
+func PublishPorts(owner, bridge, containerIP string, ports []PortMapping) error {
+	if len(ports) == 0 {
+		return nil
+	}
+	fw, err := firewall()
+	if err != nil {
+		return err
+	}
+	return fw.PublishPorts(owner, bridge, containerIP, ports)
+}
+
+// UnpublishPorts removes the rules PublishPorts installed. Rules that are
+// already gone are skipped.
+func UnpublishPorts(owner, bridge, containerIP string, ports []PortMapping) error {
+	if len(ports) == 0 {
+		return nil
+	}
+	fw, err := firewall()
+	if err != nil {
+		return err
+	}
+	return fw.UnpublishPorts(owner, bridge, containerIP, ports)
+}
+
+// enableRouteLocalnet lets traffic to 127.0.0.0/8 be routed out of the
+// bridge once DNAT has rewritten its destination, which is what makes
+// published ports reachable through localhost. Firewall.SetupNetwork drops
+// anything else arriving from the bridge for 127.0.0.0/8, which the setting
+// would otherwise let containers send to the host's loopback services.
+func enableRouteLocalnet(bridge string) error {
+	p := fmt.Sprintf("/proc/sys/net/ipv4/conf/%s/route_localnet", bridge)
+	if err := os.WriteFile(p, []byte("1\n"), 0644); err != nil {
+		return fmt.Errorf("failed to enable route_localnet on %s: %v", bridge, err)
+	}
+	return nil
+}
@@ -0,0 +1,206 @@
+package network
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// udpIdleTimeout is how long a UDP client may stay silent before its flow
+// to the container is dropped.
+const udpIdleTimeout = 90 * time.Second
+
+// Proxy forwards a published host port to the container in-process, for
+// hosts where the port cannot or should not be published with DNAT rules.
+// Unlike DNAT it also serves connections through localhost and from the
+// container itself without further help.
+type Proxy struct {
+	backend  string
+	listener net.Listener   // tcp
+	conn     net.PacketConn // udp
+	done     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// StartProxies starts a Proxy for every mapping. On failure the proxies
+// started so far are closed again.
+func StartProxies(containerIP string, ports []PortMapping) ([]*Proxy, error) {
+	var proxies []*Proxy
+	for _, pm := range ports {
+		p, err := StartProxy(containerIP, pm)
+		if err != nil {
+			for _, started := range proxies {
+				started.Close()
+			}
+			return nil, err
+		}
+		proxies = append(proxies, p)
+	}
+	return proxies, nil
+}
+
+// StartProxy listens on the mapping's host port and forwards what arrives to
+// containerIP.
+func StartProxy(containerIP string, pm PortMapping) (*Proxy, error) {
+	p := &Proxy{
+		backend: net.JoinHostPort(containerIP, strconv.Itoa(pm.ContainerPort)),
+		done:    make(chan struct{}),
+	}
+	var err error
+	if pm.Proto() == "udp" {
+		if p.conn, err = net.ListenPacket("udp4", pm.HostAddr()); err != nil {
+			return nil, fmt.Errorf("failed to start proxy for %s: %v", pm, err)
+		}
+		p.wg.Add(1)
+		go p.serveUDP()
+		return p, nil
+	}
+	if p.listener, err = net.Listen("tcp4", pm.HostAddr()); err != nil {
+		return nil, fmt.Errorf("failed to start proxy for %s: %v", pm, err)
+	}
+	p.wg.Add(1)
+	go p.serveTCP()
+	return p, nil
+}
+
+// Close stops accepting traffic and waits for forwarded flows to end.
+func (p *Proxy) Close() error {
+	close(p.done)
+	var err error
+	if p.listener != nil {
+		err = p.listener.Close()
+	}
+	if p.conn != nil {
+		err = p.conn.Close()
+	}
+	p.wg.Wait()
+	return err
+}
+
+func (p *Proxy) serveTCP() {
+	defer p.wg.Done()
+	for {
+		client, err := p.listener.Accept()
+		if err != nil {
+			select {
+			case <-p.done:
+				return
+			default:
+			}
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			return
+		}
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			p.forwardTCP(client.(*net.TCPConn))
+		}()
+	}
+}
+
+// forwardTCP copies one connection both ways, passing on half-closes so
+// request/response protocols see the end of the request.
+func (p *Proxy) forwardTCP(client *net.TCPConn) {
+	defer client.Close()
+	conn, err := net.Dial("tcp4", p.backend)
+	if err != nil {
+		return
+	}
+	backend := conn.(*net.TCPConn)
+	defer backend.Close()
+
+	// Closing both ends when the proxy stops unblocks the copies
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-p.done:
+			client.Close()
+			backend.Close()
+		case <-stop:
+		}
+	}()
+
+	var wg sync.WaitGroup
+	pipe := func(dst, src *net.TCPConn) {
+		defer wg.Done()
+		io.Copy(dst, src)
+		dst.CloseWrite()
+		src.CloseRead()
+	}
+	wg.Add(2)
+	go pipe(backend, client)
+	go pipe(client, backend)
+	wg.Wait()
+}
+
+// serveUDP relays datagrams, keeping one backend socket per client address
+// so replies find their way back.
+func (p *Proxy) serveUDP() {
+	defer p.wg.Done()
+	var mu sync.Mutex
+	flows := map[string]*net.UDPConn{}
+	defer func() {
+		mu.Lock()
+		for _, c := range flows {
+			c.Close()
+		}
+		mu.Unlock()
+	}()
+
+	buf := make([]byte, 65535)
+	for {
+		n, client, err := p.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		key := client.String()
+		mu.Lock()
+		backend, ok := flows[key]
+		if !ok {
+			addr, err := net.ResolveUDPAddr("udp4", p.backend)
+			if err == nil {
+				backend, err = net.DialUDP("udp4", nil, addr)
+			}
+			if err != nil {
+				mu.Unlock()
+				continue
+			}
+			flows[key] = backend
+			p.wg.Add(1)
+			go func() {
+				defer p.wg.Done()
+				p.replyUDP(backend, client)
+				mu.Lock()
+				if flows[key] == backend {
+					delete(flows, key)
+				}
+				mu.Unlock()
+				backend.Close()
+			}()
+		}
+		mu.Unlock()
+		backend.Write(buf[:n])
+	}
+}
+
+// replyUDP sends the container's replies on one flow back to the client
+// until the flow goes idle or the proxy stops.
+func (p *Proxy) replyUDP(backend *net.UDPConn, client net.Addr) {
+	buf := make([]byte, 65535)
+	for {
+		backend.SetReadDeadline(time.Now().Add(udpIdleTimeout))
+		n, err := backend.Read(buf)
+		if err != nil {
+			return
+		}
+		if _, err := p.conn.WriteTo(buf[:n], client); err != nil {
+			return
+		}
+	}
+}
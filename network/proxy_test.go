@@ -0,0 +1,180 @@
+package network
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// freePort returns a port of proto on 127.0.0.1 that nothing listens on.
+func freePort(t *testing.T, proto string) int {
+	t.Helper()
+	if proto == "udp" {
+		c, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		return c.LocalAddr().(*net.UDPAddr).Port
+	}
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// startProxy publishes backendPort on a free port of 127.0.0.1 and returns
+// the proxy's address.
+func startProxy(t *testing.T, proto string, backendPort int) string {
+	t.Helper()
+	pm := PortMapping{HostIP: "127.0.0.1", HostPort: freePort(t, proto), ContainerPort: backendPort, Protocol: proto}
+	p, err := StartProxy("127.0.0.1", pm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { p.Close() })
+	return pm.HostAddr()
+}
+
+func TestProxyTCP(t *testing.T) {
+	backend, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	// The backend answers only once the request is complete, which it
+	// learns from the client's half-close
+	go func() {
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				req, err := io.ReadAll(conn)
+				if err != nil {
+					return
+				}
+				conn.Write(append([]byte("got "), req...))
+			}()
+		}
+	}()
+	addr := startProxy(t, "tcp", backend.Addr().(*net.TCPAddr).Port)
+
+	for _, req := range []string{"ping", "a second connection"} {
+		conn, err := net.Dial("tcp4", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Write([]byte(req)); err != nil {
+			t.Fatal(err)
+		}
+		if err := conn.(*net.TCPConn).CloseWrite(); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := io.ReadAll(conn)
+		conn.Close()
+		if err != nil {
+			t.Fatalf("reading the response to %q: %v", req, err)
+		}
+		if want := "got " + req; string(resp) != want {
+			t.Errorf("response = %q, want %q", resp, want)
+		}
+	}
+}
+
+func TestProxyTCPClose(t *testing.T) {
+	backend, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	go func() {
+		for {
+			conn, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			// Keeps the connection open, unanswered, until the test ends
+			defer conn.Close()
+		}
+	}()
+	pm := PortMapping{HostIP: "127.0.0.1", HostPort: freePort(t, "tcp"), ContainerPort: backend.Addr().(*net.TCPAddr).Port}
+	p, err := StartProxy("127.0.0.1", pm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp4", pm.HostAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("hello"))
+
+	// Close must end the open connection rather than wait for it
+	closed := make(chan struct{})
+	go func() {
+		p.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close did not return with a connection open")
+	}
+	if _, err := net.Dial("tcp4", pm.HostAddr()); err == nil {
+		t.Error("proxy still accepts connections after Close")
+	}
+}
+
+func TestProxyUDP(t *testing.T) {
+	backend, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, from, err := backend.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			backend.WriteTo(append([]byte("got "), buf[:n]...), from)
+		}
+	}()
+	addr := startProxy(t, "udp", backend.LocalAddr().(*net.UDPAddr).Port)
+
+	// Each client gets its own flow, so replies go back to the right one
+	var clients []net.Conn
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("udp4", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		clients = append(clients, conn)
+	}
+	for round := 0; round < 2; round++ {
+		for i, conn := range clients {
+			req := []byte{byte('a' + i), byte('0' + round)}
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			if _, err := conn.Write(req); err != nil {
+				t.Fatal(err)
+			}
+			buf := make([]byte, 64)
+			n, err := conn.Read(buf)
+			if err != nil {
+				t.Fatalf("client %d: reading the reply to %q: %v", i, req, err)
+			}
+			if want := "got " + string(req); string(buf[:n]) != want {
+				t.Errorf("client %d: reply = %q, want %q", i, buf[:n], want)
+			}
+		}
+	}
+}
@@ -0,0 +1,411 @@
+package network
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"mydocker/config"
+
+	"github.com/vishvananda/netlink"
+)
+
+// networksDir holds one file per user-defined network.
+const networksDir = "/var/lib/mydocker/network/networks"
+
+// validName is what network names may look like.
+var validName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// reservedNames cannot be used for user-defined networks.
+var reservedNames = map[string]bool{DefaultNetwork: true, "host": true, "none": true}
+
+// Network is a bridge network containers can be attached to.
+type Network struct {
+	ID      string    `json:"id"`
+	Name    string    `json:"name"`
+	Driver  string    `json:"driver"`
+	Subnet  string    `json:"subnet"`
+	Gateway string    `json:"gateway"`
+	Bridge  string    `json:"bridge"`
+	Created time.Time `json:"created"`
+}
+
+// CreateOptions are the settings of a new network. Empty fields are chosen
+// automatically.
+type CreateOptions struct {
+	Subnet  string
+	Gateway string
+}
+
+// Pool returns the address pool of the network's subnet.
+func (n *Network) Pool() (Pool, error) {
+	_, subnet, err := net.ParseCIDR(n.Subnet)
+	if err != nil {
+		return Pool{}, fmt.Errorf("invalid subnet %q of network %s: %v", n.Subnet, n.Name, err)
+	}
+	gw := net.ParseIP(n.Gateway).To4()
+	if gw == nil {
+		return Pool{}, fmt.Errorf("invalid gateway %q of network %s", n.Gateway, n.Name)
+	}
+	return Pool{Network: n.Name, Bridge: n.Bridge, Subnet: subnet, Gateway: gw}, nil
+}
+
+// defaultNetwork describes DefaultNetwork from the daemon config's "bip"
+// (the bridge address in CIDR form, e.g. "10.0.0.1/24").
+func defaultNetwork() (*Network, error) {
+	cfg, err := config.Load()
+	if err != nil {
+		return nil, err
+	}
+	bip := cfg.BridgeIP
+	if bip == "" {
+		bip = defaultBridgeIP
+	}
+	gw, subnet, err := net.ParseCIDR(bip)
+	if err != nil {
+		return nil, fmt.Errorf("invalid bip %q: %v", bip, err)
+	}
+	if gw.To4() == nil {
+		return nil, fmt.Errorf("invalid bip %q: only IPv4 is supported", bip)
+	}
+	sum := sha256.Sum256([]byte(DefaultNetwork))
+	return &Network{
+		ID:      hex.EncodeToString(sum[:]),
+		Name:    DefaultNetwork,
+		Driver:  "bridge",
+		Subnet:  subnet.String(),
+		Gateway: gw.String(),
+		Bridge:  DefaultBridge,
+	}, nil
+}
+
+// List returns the default network followed by the user-defined ones in
+// name order.
+func List() ([]*Network, error) {
+	def, err := defaultNetwork()
+	if err != nil {
+		return nil, err
+	}
+	networks := []*Network{def}
+	files, err := os.ReadDir(networksDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return networks, nil
+		}
+		return nil, fmt.Errorf("failed to read networks directory: %v", err)
+	}
+	var user []*Network
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		n, err := readNetwork(filepath.Join(networksDir, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		user = append(user, n)
+	}
+	sort.Slice(user, func(i, j int) bool { return user[i].Name < user[j].Name })
+	return append(networks, user...), nil
+}
+
+// Get finds a network by name, ID or unambiguous ID prefix.
+func Get(nameOrID string) (*Network, error) {
+	networks, err := List()
+	if err != nil {
+		return nil, err
+	}
+	var matches []*Network
+	for _, n := range networks {
+		if n.Name == nameOrID || n.ID == nameOrID {
+			return n, nil
+		}
+		if nameOrID != "" && strings.HasPrefix(n.ID, nameOrID) {
+			matches = append(matches, n)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("network %s not found", nameOrID)
+	case 1:
+		return matches[0], nil
+	default:
+		return nil, fmt.Errorf("network ID %s is ambiguous", nameOrID)
+	}
+}
+
+// Create defines a new bridge network, brings up its bridge and sets up
+// outbound NAT for its subnet. Without a subnet the first free /16 of
+// 172.18.0.0–172.31.0.0 is used; the gateway defaults to the subnet's first
+// address.
+func Create(name string, opts CreateOptions) (*Network, error) {
+	if !validName.MatchString(name) {
+		return nil, fmt.Errorf("invalid network name %q", name)
+	}
+	if reservedNames[name] {
+		return nil, fmt.Errorf("network name %s is reserved", name)
+	}
+
+	var n *Network
+	err := withLock(filepath.Join(networksDir, ".lock"), func() error {
+		existing, err := List()
+		if err != nil {
+			return err
+		}
+		for _, e := range existing {
+			if e.Name == name {
+				return fmt.Errorf("network with name %s already exists", name)
+			}
+		}
+
+		routes, err := hostRoutes()
+		if err != nil {
+			return err
+		}
+		subnet, err := chooseSubnet(opts.Subnet, existing, routes)
+		if err != nil {
+			return err
+		}
+		gw, err := chooseGateway(opts.Gateway, subnet)
+		if err != nil {
+			return err
+		}
+		id, err := randomID()
+		if err != nil {
+			return err
+		}
+		n = &Network{
+			ID:      id,
+			Name:    name,
+			Driver:  "bridge",
+			Subnet:  subnet.String(),
+			Gateway: gw.String(),
+			Bridge:  "br-" + id[:12],
+			Created: time.Now().UTC(),
+		}
+		return writeNetwork(n)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	pool, err := n.Pool()
+	if err == nil {
+		err = SetupBridge(pool.Bridge, pool.GatewayAddr())
+	}
+	if err == nil {
+		err = TrySetupNAT(n)
+	}
+	if err != nil {
+		TeardownNAT(n)
+		deleteBridge(n.Bridge)
+		os.Remove(filepath.Join(networksDir, n.Name+".json"))
+		return nil, err
+	}
+	return n, nil
+}
+
+// Remove deletes a user-defined network, its NAT rules and its bridge.
+// Networks that still have containers attached are refused.
+func Remove(nameOrID string) (*Network, error) {
+	n, err := Get(nameOrID)
+	if err != nil {
+		return nil, err
+	}
+	if n.Name == DefaultNetwork {
+		return nil, fmt.Errorf("%s is a pre-defined network and cannot be removed", n.Name)
+	}
+	err = withLock(filepath.Join(networksDir, ".lock"), func() error {
+		// Holding the IPAM lock keeps a concurrent connect from being given
+		// an address while the network goes away. The lock file stays: a
+		// connect may already have it open and be waiting for it.
+		return withLock(filepath.Join(ipamDir, n.Name+".lock"), func() error {
+			a, err := readAllocations(n.Name)
+			if err != nil {
+				return err
+			}
+			if len(a.IPs) > 0 {
+				return fmt.Errorf("network %s has active endpoints", n.Name)
+			}
+			if err := TryTeardownNAT(n); err != nil {
+				return err
+			}
+			if err := deleteBridge(n.Bridge); err != nil {
+				return err
+			}
+			for _, p := range []string{
+				filepath.Join(ipamDir, n.Name+".json"),
+				filepath.Join(networksDir, n.Name+".json"),
+			} {
+				if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+					return fmt.Errorf("failed to remove %s: %v", p, err)
+				}
+			}
+			return nil
+		})
+	})
+	return n, err
+}
+
+// deleteBridge removes a bridge device; a missing one is not an error.
+func deleteBridge(name string) error {
+	br, err := netlink.LinkByName(name)
+	if err != nil {
+		var notFound netlink.LinkNotFoundError
+		if errors.As(err, &notFound) {
+			return nil
+		}
+		return fmt.Errorf("failed to look up bridge %s: %v", name, err)
+	}
+	if err := netlink.LinkDel(br); err != nil {
+		return fmt.Errorf("failed to delete bridge %s: %v", name, err)
+	}
+	return nil
+}
+
+// hostRoutes returns the destinations of the host's IPv4 routes other than
+// the default route.
+func hostRoutes() ([]*net.IPNet, error) {
+	routes, err := netlink.RouteList(nil, netlink.FAMILY_V4)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list host routes: %v", err)
+	}
+	var dsts []*net.IPNet
+	for _, r := range routes {
+		if r.Dst != nil {
+			if ones, _ := r.Dst.Mask.Size(); ones > 0 {
+				dsts = append(dsts, r.Dst)
+			}
+		}
+	}
+	return dsts, nil
+}
+
+// chooseSubnet validates the requested subnet, or picks a free one, so that
+// it overlaps neither an existing network nor a subnet the host already
+// routes, such as a LAN or VPN.
+func chooseSubnet(requested string, existing []*Network, routes []*net.IPNet) (*net.IPNet, error) {
+	overlaps := func(subnet *net.IPNet) (string, bool) {
+		for _, e := range existing {
+			_, other, err := net.ParseCIDR(e.Subnet)
+			if err != nil {
+				continue
+			}
+			if other.Contains(subnet.IP) || subnet.Contains(other.IP) {
+				return "network " + e.Name, true
+			}
+		}
+		for _, r := range routes {
+			if r.Contains(subnet.IP) || subnet.Contains(r.IP) {
+				return "host route " + r.String(), true
+			}
+		}
+		return "", false
+	}
+
+	if requested != "" {
+		ip, subnet, err := net.ParseCIDR(requested)
+		if err != nil {
+			return nil, fmt.Errorf("invalid subnet %q: %v", requested, err)
+		}
+		if ip.To4() == nil {
+			return nil, fmt.Errorf("invalid subnet %q: only IPv4 is supported", requested)
+		}
+		if ones, _ := subnet.Mask.Size(); ones > 30 {
+			return nil, fmt.Errorf("subnet %s is too small", subnet)
+		}
+		if what, ok := overlaps(subnet); ok {
+			return nil, fmt.Errorf("subnet %s overlaps with %s", subnet, what)
+		}
+		return subnet, nil
+	}
+
+	for second := 18; second <= 31; second++ {
+		subnet := &net.IPNet{IP: net.IPv4(172, byte(second), 0, 0).To4(), Mask: net.CIDRMask(16, 32)}
+		if _, ok := overlaps(subnet); !ok {
+			return subnet, nil
+		}
+	}
+	return nil, fmt.Errorf("no free subnet left; pass --subnet")
+}
+
+// chooseGateway validates the requested gateway or defaults to the
+// subnet's first address.
+func chooseGateway(requested string, subnet *net.IPNet) (net.IP, error) {
+	if requested == "" {
+		gw := make(net.IP, 4)
+		binary.BigEndian.PutUint32(gw, binary.BigEndian.Uint32(subnet.IP.To4())+1)
+		return gw, nil
+	}
+	gw := net.ParseIP(requested).To4()
+	if gw == nil || !subnet.Contains(gw) {
+		return nil, fmt.Errorf("gateway %s is not an IPv4 address in %s", requested, subnet)
+	}
+	return gw, nil
+}
+
+func readNetwork(path string) (*Network, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read network %s: %v", path, err)
+	}
+	var n Network
+	if err := json.Unmarshal(data, &n); err != nil {
+		return nil, fmt.Errorf("failed to parse network %s: %v", path, err)
+	}
+	return &n, nil
+}
+
+func writeNetwork(n *Network) error {
+	data, err := json.MarshalIndent(n, "", "    ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(networksDir, n.Name+".json")
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write network %s: %v", n.Name, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to write network %s: %v", n.Name, err)
+	}
+	return nil
+}
+
+// withLock runs fn while holding an exclusive lock on the file at path,
+// creating its directory if needed.
+func withLock(path string, fn func() error) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %v", filepath.Dir(path), err)
+	}
+	lock, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open lock %s: %v", path, err)
+	}
+	defer lock.Close()
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return fmt.Errorf("failed to lock %s: %v", path, err)
+	}
+	defer syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+	return fn()
+}
+
+func randomID() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate network ID: %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
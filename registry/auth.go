@@ -0,0 +1,288 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// AuthConfig holds the credentials for one registry.
+type AuthConfig struct {
+	Username      string
+	Password      string
+	IdentityToken string
+}
+
+// Empty reports whether no credentials are set.
+func (a AuthConfig) Empty() bool {
+	return a.Username == "" && a.Password == "" && a.IdentityToken == ""
+}
+
+// authEntry is an "auths" entry of a Docker config.json.
+type authEntry struct {
+	Auth          string `json:"auth,omitempty"`
+	IdentityToken string `json:"identitytoken,omitempty"`
+}
+
+// ConfigFile is a Docker-compatible config.json holding registry credentials,
+// either inline as base64 "auth" entries or delegated to credential helpers.
+type ConfigFile struct {
+	Auths       map[string]authEntry `json:"auths"`
+	CredsStore  string               `json:"credsStore,omitempty"`
+	CredHelpers map[string]string    `json:"credHelpers,omitempty"`
+
+	path string
+	// other preserves keys mydocker does not use so Save does not drop them.
+	other map[string]json.RawMessage
+}
+
+// ConfigPath returns the location of the credential file:
+// $MYDOCKER_CONFIG/config.json, or ~/.mydocker/config.json by default.
+func ConfigPath() string {
+	if dir := os.Getenv("MYDOCKER_CONFIG"); dir != "" {
+		return filepath.Join(dir, "config.json")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		home = "/root"
+	}
+	return filepath.Join(home, ".mydocker", "config.json")
+}
+
+// LoadConfig reads the credential file. A missing file yields an empty config.
+func LoadConfig() (*ConfigFile, error) {
+	cfg := &ConfigFile{Auths: map[string]authEntry{}, path: ConfigPath()}
+	data, err := os.ReadFile(cfg.path)
+	if os.IsNotExist(err) {
+		return cfg, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", cfg.path, err)
+	}
+	if err := json.Unmarshal(data, &cfg.other); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", cfg.path, err)
+	}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", cfg.path, err)
+	}
+	if cfg.Auths == nil {
+		cfg.Auths = map[string]authEntry{}
+	}
+	return cfg, nil
+}
+
+// Save writes the config back with owner-only permissions.
+func (c *ConfigFile) Save() error {
+	out := map[string]interface{}{}
+	for k, v := range c.other {
+		out[k] = v
+	}
+	out["auths"] = c.Auths
+	delete(out, "credsStore")
+	delete(out, "credHelpers")
+	if c.CredsStore != "" {
+		out["credsStore"] = c.CredsStore
+	}
+	if len(c.CredHelpers) > 0 {
+		out["credHelpers"] = c.CredHelpers
+	}
+	data, err := json.MarshalIndent(out, "", "\t")
+	if err != nil {
+		return fmt.Errorf("failed to encode %s: %v", c.path, err)
+	}
+	if err := os.MkdirAll(filepath.Dir(c.path), 0700); err != nil {
+		return fmt.Errorf("failed to create %s: %v", filepath.Dir(c.path), err)
+	}
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write %s: %v", c.path, err)
+	}
+	if err := os.Rename(tmp, c.path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write %s: %v", c.path, err)
+	}
+	return nil
+}
+
+// Get returns the stored credentials for a registry host, or an empty
+// AuthConfig when there are none.
+func (c *ConfigFile) Get(host string) (AuthConfig, error) {
+	host = NormalizeHost(host)
+	if helper := c.helperFor(host); helper != "" {
+		return helperGet(helper, serverAddress(host))
+	}
+	for key, entry := range c.Auths {
+		if NormalizeHost(key) != host {
+			continue
+		}
+		auth := AuthConfig{IdentityToken: entry.IdentityToken}
+		if entry.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+			if err != nil {
+				return AuthConfig{}, fmt.Errorf("invalid auth entry for %s: %v", key, err)
+			}
+			user, pass, ok := strings.Cut(string(decoded), ":")
+			if !ok {
+				return AuthConfig{}, fmt.Errorf("invalid auth entry for %s", key)
+			}
+			auth.Username, auth.Password = user, pass
+		}
+		return auth, nil
+	}
+	return AuthConfig{}, nil
+}
+
+// Store saves credentials for a registry host, through its credential helper
+// when one is configured.
+func (c *ConfigFile) Store(host string, auth AuthConfig) error {
+	host = NormalizeHost(host)
+	c.removeEntries(host)
+	if helper := c.helperFor(host); helper != "" {
+		if err := helperStore(helper, serverAddress(host), auth); err != nil {
+			return err
+		}
+		// Docker keeps an empty entry so `logout` knows the host was used.
+		c.Auths[serverAddress(host)] = authEntry{}
+		return c.Save()
+	}
+	entry := authEntry{IdentityToken: auth.IdentityToken}
+	if auth.Username != "" || auth.Password != "" {
+		entry.Auth = base64.StdEncoding.EncodeToString([]byte(auth.Username + ":" + auth.Password))
+	}
+	c.Auths[serverAddress(host)] = entry
+	return c.Save()
+}
+
+// Erase removes the credentials for a registry host. It reports false when
+// nothing was stored for it.
+func (c *ConfigFile) Erase(host string) (bool, error) {
+	host = NormalizeHost(host)
+	found := c.removeEntries(host)
+	if helper := c.helperFor(host); helper != "" {
+		if err := helperErase(helper, serverAddress(host)); err != nil {
+			return found, err
+		}
+		found = true
+	}
+	if !found {
+		return false, nil
+	}
+	return true, c.Save()
+}
+
+// removeEntries deletes every inline entry for host, whatever its spelling.
+func (c *ConfigFile) removeEntries(host string) bool {
+	found := false
+	for key := range c.Auths {
+		if NormalizeHost(key) == host {
+			delete(c.Auths, key)
+			found = true
+		}
+	}
+	return found
+}
+
+// helperFor returns the credential helper responsible for host, if any.
+func (c *ConfigFile) helperFor(host string) string {
+	for key, helper := range c.CredHelpers {
+		if NormalizeHost(key) == host {
+			return helper
+		}
+	}
+	return c.CredsStore
+}
+
+// serverAddress is the key Docker uses for a host in config.json.
+func serverAddress(host string) string {
+	if host == DefaultHost {
+		return "https://index.docker.io/v1/"
+	}
+	return host
+}
+
+// WriteAuthFile writes a minimal config.json holding only the credentials for
+// host, for tools such as skopeo that read them from an --authfile.
+func WriteAuthFile(path, host string, auth AuthConfig) error {
+	entry := authEntry{IdentityToken: auth.IdentityToken}
+	if auth.Username != "" || auth.Password != "" {
+		entry.Auth = base64.StdEncoding.EncodeToString([]byte(auth.Username + ":" + auth.Password))
+	}
+	data, err := json.Marshal(map[string]interface{}{
+		"auths": map[string]authEntry{NormalizeHost(host): entry},
+	})
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return fmt.Errorf("failed to write auth file: %v", err)
+	}
+	return nil
+}
+
+/* ───────────────────────────  Credential helpers  ────────────────────────── */
+
+// helperCredentials is the JSON exchanged with docker-credential-* programs.
+type helperCredentials struct {
+	ServerURL string `json:"ServerURL,omitempty"`
+	Username  string `json:"Username"`
+	Secret    string `json:"Secret"`
+}
+
+// identityTokenUser is the username helpers use to mark a stored token.
+const identityTokenUser = "<token>"
+
+// runHelper invokes docker-credential-<helper> <action> with input on stdin.
+func runHelper(helper, action string, input []byte) ([]byte, error) {
+	cmd := exec.Command("docker-credential-"+helper, action)
+	cmd.Stdin = bytes.NewReader(input)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		msg := strings.TrimSpace(string(out) + stderr.String())
+		return out, fmt.Errorf("credential helper %s %s failed: %v: %s", helper, action, err, msg)
+	}
+	return out, nil
+}
+
+func helperGet(helper, server string) (AuthConfig, error) {
+	out, err := runHelper(helper, "get", []byte(server))
+	if err != nil {
+		// Helpers report a missing entry as an error with this message.
+		if strings.Contains(string(out), "credentials not found") || strings.Contains(err.Error(), "credentials not found") {
+			return AuthConfig{}, nil
+		}
+		return AuthConfig{}, err
+	}
+	var creds helperCredentials
+	if err := json.Unmarshal(out, &creds); err != nil {
+		return AuthConfig{}, fmt.Errorf("credential helper %s returned invalid output: %v", helper, err)
+	}
+	if creds.Username == identityTokenUser {
+		return AuthConfig{IdentityToken: creds.Secret}, nil
+	}
+	return AuthConfig{Username: creds.Username, Password: creds.Secret}, nil
+}
+
+func helperStore(helper, server string, auth AuthConfig) error {
+	creds := helperCredentials{ServerURL: server, Username: auth.Username, Secret: auth.Password}
+	if auth.IdentityToken != "" {
+		creds.Username, creds.Secret = identityTokenUser, auth.IdentityToken
+	}
+	input, err := json.Marshal(creds)
+	if err != nil {
+		return err
+	}
+	_, err = runHelper(helper, "store", input)
+	return err
+}
+
+func helperErase(helper, server string) error {
+	_, err := runHelper(helper, "erase", []byte(server))
+	return err
+}
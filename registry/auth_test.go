@@ -0,0 +1,236 @@
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// The test binary doubles as a credential helper: run as
+// docker-credential-test, it keeps credentials in $MYDOCKER_TEST_CREDS.
+func TestMain(m *testing.M) {
+	if filepath.Base(os.Args[0]) == "docker-credential-test" {
+		os.Exit(fakeHelper(os.Args[1]))
+	}
+	os.Exit(m.Run())
+}
+
+func fakeHelper(action string) int {
+	path := os.Getenv("MYDOCKER_TEST_CREDS")
+	store := map[string]helperCredentials{}
+	if data, err := os.ReadFile(path); err == nil {
+		json.Unmarshal(data, &store)
+	}
+	input, _ := io.ReadAll(os.Stdin)
+	switch action {
+	case "store":
+		var creds helperCredentials
+		if err := json.Unmarshal(input, &creds); err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		store[creds.ServerURL] = creds
+	case "get", "erase":
+		server := strings.TrimSpace(string(input))
+		creds, ok := store[server]
+		if !ok {
+			fmt.Println("credentials not found in native keychain")
+			return 1
+		}
+		if action == "get" {
+			json.NewEncoder(os.Stdout).Encode(creds)
+			return 0
+		}
+		delete(store, server)
+	default:
+		fmt.Println("unknown action", action)
+		return 1
+	}
+	data, _ := json.Marshal(store)
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	return 0
+}
+
+// setupConfig points ConfigPath at a fresh directory holding config.json
+// with content, unless it is empty, and returns the file's path.
+func setupConfig(t *testing.T, content string) string {
+	t.Helper()
+	dir := t.TempDir()
+	t.Setenv("MYDOCKER_CONFIG", dir)
+	path := filepath.Join(dir, "config.json")
+	if content != "" {
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return path
+}
+
+// setupHelper installs the test binary as docker-credential-test on PATH
+// and returns the file the helper keeps its credentials in.
+func setupHelper(t *testing.T) string {
+	t.Helper()
+	self, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := os.Symlink(self, filepath.Join(dir, "docker-credential-test")); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	creds := filepath.Join(dir, "creds.json")
+	t.Setenv("MYDOCKER_TEST_CREDS", creds)
+	return creds
+}
+
+func loadConfig(t *testing.T) *ConfigFile {
+	t.Helper()
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func TestConfigFileGet(t *testing.T) {
+	setupConfig(t, `{
+		"auths": {
+			"https://index.docker.io/v1/": {"auth": "YWxpY2U6c2VjcmV0"},
+			"localhost:5000": {"identitytoken": "refresh"},
+			"https://broken.test": {"auth": "bm8tY29sb24="}
+		}
+	}`)
+	cfg := loadConfig(t)
+	tests := []struct {
+		host    string
+		want    AuthConfig
+		wantErr bool
+	}{
+		{host: "docker.io", want: AuthConfig{Username: "alice", Password: "secret"}},
+		{host: "registry-1.docker.io", want: AuthConfig{Username: "alice", Password: "secret"}},
+		{host: "https://index.docker.io/v1/", want: AuthConfig{Username: "alice", Password: "secret"}},
+		{host: "localhost:5000", want: AuthConfig{IdentityToken: "refresh"}},
+		{host: "quay.io", want: AuthConfig{}},
+		{host: "broken.test", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := cfg.Get(tt.host)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("Get(%q) = %+v, want an error", tt.host, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Get(%q) failed: %v", tt.host, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("Get(%q) = %+v, want %+v", tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestConfigFileStoreErase(t *testing.T) {
+	path := setupConfig(t, `{"auths": {"index.docker.io": {"auth": "b2xkOm9sZA=="}}, "psFormat": "table {{.ID}}"}`)
+	cfg := loadConfig(t)
+	if err := cfg.Store("docker.io", AuthConfig{Username: "alice", Password: "secret"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.Store("localhost:5000", AuthConfig{IdentityToken: "refresh"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var saved map[string]json.RawMessage
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, &saved); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(saved["psFormat"]); got != `"table {{.ID}}"` {
+		t.Errorf("psFormat = %s after Store, want it kept", got)
+	}
+	// The old spelling of the Docker Hub entry is replaced, not duplicated
+	if got := loadConfig(t).Auths; !reflect.DeepEqual(got, map[string]authEntry{
+		"https://index.docker.io/v1/": {Auth: "YWxpY2U6c2VjcmV0"},
+		"localhost:5000":              {IdentityToken: "refresh"},
+	}) {
+		t.Errorf("auths = %+v after Store", got)
+	}
+
+	cfg = loadConfig(t)
+	if found, err := cfg.Erase("registry-1.docker.io"); err != nil || !found {
+		t.Errorf("Erase(docker.io) = %v, %v, want true", found, err)
+	}
+	if found, err := cfg.Erase("docker.io"); err != nil || found {
+		t.Errorf("second Erase(docker.io) = %v, %v, want false", found, err)
+	}
+	if got, _ := loadConfig(t).Get("docker.io"); !got.Empty() {
+		t.Errorf("Get(docker.io) = %+v after Erase, want no credentials", got)
+	}
+}
+
+func TestCredentialHelper(t *testing.T) {
+	setupConfig(t, `{"credHelpers": {"docker.io": "test", "localhost:5000": "test"}}`)
+	creds := setupHelper(t)
+	cfg := loadConfig(t)
+
+	if got, err := cfg.Get("docker.io"); err != nil || !got.Empty() {
+		t.Errorf("Get(docker.io) = %+v, %v before Store, want no credentials", got, err)
+	}
+	if err := cfg.Store("docker.io", AuthConfig{Username: "alice", Password: "secret"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.Store("localhost:5000", AuthConfig{IdentityToken: "refresh"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The helper holds the secrets; config.json only records the hosts
+	data, err := os.ReadFile(creds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stored map[string]helperCredentials
+	if err := json.Unmarshal(data, &stored); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]helperCredentials{
+		"https://index.docker.io/v1/": {ServerURL: "https://index.docker.io/v1/", Username: "alice", Secret: "secret"},
+		"localhost:5000":              {ServerURL: "localhost:5000", Username: identityTokenUser, Secret: "refresh"},
+	}
+	if !reflect.DeepEqual(stored, want) {
+		t.Errorf("helper store = %+v, want %+v", stored, want)
+	}
+	cfg = loadConfig(t)
+	if want := map[string]authEntry{"https://index.docker.io/v1/": {}, "localhost:5000": {}}; !reflect.DeepEqual(cfg.Auths, want) {
+		t.Errorf("auths = %+v, want %+v", cfg.Auths, want)
+	}
+
+	if got, err := cfg.Get("index.docker.io"); err != nil || got != (AuthConfig{Username: "alice", Password: "secret"}) {
+		t.Errorf("Get(docker.io) = %+v, %v", got, err)
+	}
+	if got, err := cfg.Get("localhost:5000"); err != nil || got != (AuthConfig{IdentityToken: "refresh"}) {
+		t.Errorf("Get(localhost:5000) = %+v, %v", got, err)
+	}
+
+	if found, err := cfg.Erase("docker.io"); err != nil || !found {
+		t.Errorf("Erase(docker.io) = %v, %v, want true", found, err)
+	}
+	if got, err := loadConfig(t).Get("docker.io"); err != nil || !got.Empty() {
+		t.Errorf("Get(docker.io) = %+v, %v after Erase, want no credentials", got, err)
+	}
+	if _, err := cfg.Erase("docker.io"); err == nil {
+		t.Error("Erase(docker.io) of erased credentials succeeded, want the helper's error")
+	}
+}
@@ -0,0 +1,312 @@
+package registry
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"mydocker/config"
+)
+
+// ErrUnauthorized is returned when the registry rejects the credentials.
+var ErrUnauthorized = errors.New("unauthorized: incorrect username or password")
+
+// Client talks the distribution (registry v2) protocol to one registry,
+// answering Basic and Bearer token challenges with the configured credentials.
+type Client struct {
+	// Host is the normalised registry host, e.g. "docker.io" or "localhost:5000".
+	Host string
+
+	auth     AuthConfig
+	http     *http.Client
+	endpoint string // host[:port] actually contacted: the registry or a mirror
+	scheme   string // fixed scheme for mirrors given as URLs, else negotiated
+	insecure bool   // plain HTTP and unverified TLS are allowed
+
+	mu     sync.Mutex
+	base   string            // scheme://host once the registry has been reached
+	basic  bool              // registry asked for Basic auth
+	tokens map[string]string // bearer tokens by scope
+}
+
+// NewClient returns a client for host using auth, which may be empty for
+// anonymous access. TLS and insecure settings come from the daemon config.
+func NewClient(host string, auth AuthConfig) (*Client, error) {
+	cfg, err := config.Load()
+	if err != nil {
+		return nil, err
+	}
+	return newEndpointClient(cfg, NormalizeHost(host), "", auth)
+}
+
+// ClientFor returns a client for host with the credentials stored for it.
+func ClientFor(host string) (*Client, error) {
+	creds, err := LoadConfig()
+	if err != nil {
+		return nil, err
+	}
+	auth, err := creds.Get(host)
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(host, auth)
+}
+
+// Ping checks the registry's /v2/ endpoint, authenticating if it asks to.
+// It is what `mydocker login` uses to validate credentials.
+func (c *Client) Ping() error {
+	req, err := c.NewRequest(http.MethodGet, "/v2/", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.Do(req, "")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusUnauthorized:
+		return ErrUnauthorized
+	}
+	return fmt.Errorf("registry %s returned %s", c.Host, resp.Status)
+}
+
+// NewRequest builds a request against the registry's API for path.
+func (c *Client) NewRequest(method, path string, body io.Reader) (*http.Request, error) {
+	base, err := c.baseURL()
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(method, base+path, body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build request: %v", err)
+	}
+	return req, nil
+}
+
+// Do sends req, retrying once with credentials if the registry challenges
+// it. scope is the token scope, e.g. "repository:library/ubuntu:pull".
+func (c *Client) Do(req *http.Request, scope string) (*http.Response, error) {
+	c.authorize(req, scope)
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("request to %s failed: %v", c.endpoint, err)
+	}
+	if resp.StatusCode != http.StatusUnauthorized {
+		return resp, nil
+	}
+	if req.Body != nil && req.GetBody == nil {
+		// The body was consumed and cannot be replayed.
+		return resp, nil
+	}
+
+	ch := parseChallenge(resp.Header.Get("WWW-Authenticate"))
+	if ch == nil {
+		return resp, nil
+	}
+	if err := c.answer(ch, scope); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+
+	retry := req.Clone(req.Context())
+	if req.GetBody != nil {
+		if retry.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+	c.authorize(retry, scope)
+	resp, err = c.http.Do(retry)
+	if err != nil {
+		return nil, fmt.Errorf("request to %s failed: %v", c.endpoint, err)
+	}
+	return resp, nil
+}
+
+// authorize adds whatever credentials earlier challenges asked for.
+func (c *Client) authorize(req *http.Request, scope string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if token, ok := c.tokens[scope]; ok {
+		req.Header.Set("Authorization", "Bearer "+token)
+	} else if c.basic && c.auth.Username != "" {
+		req.SetBasicAuth(c.auth.Username, c.auth.Password)
+	}
+}
+
+// answer prepares credentials for a challenge: Basic just needs the
+// username/password, Bearer needs a token from the auth service.
+func (c *Client) answer(ch *challenge, scope string) error {
+	switch ch.scheme {
+	case "basic":
+		if c.auth.Username == "" {
+			return ErrUnauthorized
+		}
+		c.mu.Lock()
+		c.basic = true
+		c.mu.Unlock()
+		return nil
+	case "bearer":
+		token, err := c.fetchToken(ch, scope)
+		if err != nil {
+			return err
+		}
+		c.mu.Lock()
+		c.tokens[scope] = token
+		c.mu.Unlock()
+		return nil
+	}
+	return fmt.Errorf("unsupported authentication scheme %q from %s", ch.scheme, c.Host)
+}
+
+// fetchToken obtains a bearer token from the challenge's realm.
+func (c *Client) fetchToken(ch *challenge, scope string) (string, error) {
+	realm := ch.params["realm"]
+	if realm == "" {
+		return "", fmt.Errorf("bearer challenge from %s has no realm", c.Host)
+	}
+	params := url.Values{}
+	if service := ch.params["service"]; service != "" {
+		params.Set("service", service)
+	}
+	if scope != "" {
+		// Several space-separated scopes become repeated scope parameters.
+		for _, s := range strings.Fields(scope) {
+			params.Add("scope", s)
+		}
+	} else if s := ch.params["scope"]; s != "" {
+		params.Set("scope", s)
+	}
+
+	var req *http.Request
+	var err error
+	if c.auth.IdentityToken != "" {
+		// OAuth2 refresh token flow, as used by identity tokens.
+		params.Set("grant_type", "refresh_token")
+		params.Set("refresh_token", c.auth.IdentityToken)
+		params.Set("client_id", "mydocker")
+		req, err = http.NewRequest(http.MethodPost, realm, strings.NewReader(params.Encode()))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+	} else {
+		if c.auth.Username != "" {
+			params.Set("account", c.auth.Username)
+		}
+		req, err = http.NewRequest(http.MethodGet, realm+"?"+params.Encode(), nil)
+		if err == nil && c.auth.Username != "" {
+			req.SetBasicAuth(c.auth.Username, c.auth.Password)
+		}
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to build token request: %v", err)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("token request to %s failed: %v", realm, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return "", ErrUnauthorized
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token request to %s returned %s", realm, resp.Status)
+	}
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("invalid token response from %s: %v", realm, err)
+	}
+	if body.Token != "" {
+		return body.Token, nil
+	}
+	if body.AccessToken != "" {
+		return body.AccessToken, nil
+	}
+	return "", fmt.Errorf("token response from %s contained no token", realm)
+}
+
+// baseURL works out whether the endpoint speaks HTTPS or, for insecure and
+// loopback registries only, plain HTTP. Mirrors configured as URLs keep the
+// scheme they were given.
+func (c *Client) baseURL() (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.base != "" {
+		return c.base, nil
+	}
+	if c.scheme != "" {
+		// A mirror URL spells out its scheme, so it is used as given.
+		c.base = c.scheme + "://" + c.endpoint
+		return c.base, nil
+	}
+	probe := &http.Client{Timeout: 30 * time.Second, Transport: c.http.Transport}
+	resp, err := probe.Get("https://" + c.endpoint + "/v2/")
+	if err == nil {
+		resp.Body.Close()
+		c.base = "https://" + c.endpoint
+		return c.base, nil
+	}
+	if !c.insecure && !isLocalhost(c.endpoint) {
+		return "", fmt.Errorf("failed to reach registry %s: %v", c.endpoint, err)
+	}
+	resp, httpErr := probe.Get("http://" + c.endpoint + "/v2/")
+	if httpErr != nil {
+		return "", fmt.Errorf("failed to reach registry %s: %v", c.endpoint, err)
+	}
+	resp.Body.Close()
+	c.base = "http://" + c.endpoint
+	return c.base, nil
+}
+
+/* ───────────────────────────  WWW-Authenticate  ────────────────────────── */
+
+type challenge struct {
+	scheme string
+	params map[string]string
+}
+
+// parseChallenge parses a WWW-Authenticate header such as
+// `Bearer realm="https://auth.docker.io/token",service="registry.docker.io"`.
+func parseChallenge(header string) *challenge {
+	header = strings.TrimSpace(header)
+	if header == "" {
+		return nil
+	}
+	scheme, rest, _ := strings.Cut(header, " ")
+	ch := &challenge{scheme: strings.ToLower(scheme), params: map[string]string{}}
+	for rest = strings.TrimSpace(rest); rest != ""; rest = strings.TrimLeft(strings.TrimSpace(rest), ",") {
+		key, value, ok := strings.Cut(rest, "=")
+		if !ok {
+			break
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+		if strings.HasPrefix(value, `"`) {
+			end := strings.Index(value[1:], `"`)
+			if end == -1 {
+				ch.params[key] = value[1:]
+				break
+			}
+			ch.params[key] = value[1 : end+1]
+			rest = value[end+2:]
+		} else {
+			v, r, _ := strings.Cut(value, ",")
+			ch.params[key] = strings.TrimSpace(v)
+			rest = r
+		}
+	}
+	return ch
+}
@@ -0,0 +1,248 @@
+package registry
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"mydocker/config"
+)
+
+// testClient returns a client for a registry served by srv, reached the way
+// a mirror given as a URL is.
+func testClient(t *testing.T, srv *httptest.Server, auth AuthConfig) *Client {
+	t.Helper()
+	c, err := newEndpointClient(&config.Config{}, "registry.test", srv.URL, auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// get sends a GET for path with scope and returns the status code.
+func get(t *testing.T, c *Client, path, scope string) int {
+	t.Helper()
+	req, err := c.NewRequest(http.MethodGet, path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := c.Do(req, scope)
+	if err != nil {
+		t.Fatalf("GET %s: %v", path, err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+// counter counts requests by path.
+type counter struct {
+	mu sync.Mutex
+	n  map[string]int
+}
+
+func (c *counter) add(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.n == nil {
+		c.n = map[string]int{}
+	}
+	c.n[path]++
+}
+
+func (c *counter) get(path string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.n[path]
+}
+
+func TestBasicChallenge(t *testing.T) {
+	var requests counter
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.add(r.URL.Path)
+		if user, pass, ok := r.BasicAuth(); !ok || user != "alice" || pass != "secret" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="registry"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+	}))
+	defer srv.Close()
+
+	c := testClient(t, srv, AuthConfig{Username: "alice", Password: "secret"})
+	if err := c.Ping(); err != nil {
+		t.Fatalf("Ping failed: %v", err)
+	}
+	if n := requests.get("/v2/"); n != 2 {
+		t.Errorf("first Ping sent %d requests, want 2: the challenged one and its retry", n)
+	}
+	// Once challenged, the client sends the credentials straight away
+	if code := get(t, c, "/v2/a/manifests/latest", "repository:a:pull"); code != http.StatusOK {
+		t.Errorf("GET with Basic credentials returned %d", code)
+	}
+	if n := requests.get("/v2/a/manifests/latest"); n != 1 {
+		t.Errorf("GET after the challenge sent %d requests, want 1", n)
+	}
+
+	if err := testClient(t, srv, AuthConfig{Username: "alice", Password: "wrong"}).Ping(); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("Ping with a wrong password = %v, want ErrUnauthorized", err)
+	}
+	if err := testClient(t, srv, AuthConfig{}).Ping(); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("Ping without credentials = %v, want ErrUnauthorized", err)
+	}
+}
+
+// tokenServer is a registry whose token service issues one token per scope
+// set, "token:" followed by the scopes, and checks the credentials it gets.
+type tokenServer struct {
+	*httptest.Server
+	tokens  counter // token requests by scope set
+	forms   []string
+	formsMu sync.Mutex
+}
+
+func newTokenServer(t *testing.T) *tokenServer {
+	s := &tokenServer{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if r.Form.Get("service") != "registry.test" {
+			http.Error(w, "wrong service", http.StatusBadRequest)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			user, pass, ok := r.BasicAuth()
+			if ok && (user != "alice" || pass != "secret" || r.Form.Get("account") != "alice") {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+		case http.MethodPost:
+			if r.PostForm.Get("grant_type") != "refresh_token" || r.PostForm.Get("refresh_token") != "refresh" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+		}
+		scopes := strings.Join(r.Form["scope"], " ")
+		s.tokens.add(scopes)
+		s.formsMu.Lock()
+		s.forms = append(s.forms, r.Method+" "+scopes)
+		s.formsMu.Unlock()
+		w.Write([]byte(`{"token": "token:` + scopes + `"}`))
+	})
+	mux.HandleFunc("/v2/", func(w http.ResponseWriter, r *http.Request) {
+		scope := r.URL.Query().Get("scope")
+		if r.Header.Get("Authorization") != "Bearer token:"+scope {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+s.URL+`/token",service="registry.test",scope="`+scope+`"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+	})
+	s.Server = httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestBearerChallenge(t *testing.T) {
+	srv := newTokenServer(t)
+	c := testClient(t, srv.Server, AuthConfig{Username: "alice", Password: "secret"})
+
+	pull := "repository:a:pull"
+	for i := 0; i < 2; i++ {
+		if code := get(t, c, "/v2/a/tags/list?scope="+pull, pull); code != http.StatusOK {
+			t.Fatalf("GET %d with scope %q returned %d", i, pull, code)
+		}
+	}
+	if n := srv.tokens.get(pull); n != 1 {
+		t.Errorf("fetched %d tokens for %q, want 1 reused for the second request", n, pull)
+	}
+
+	// A token is only used for the scope it was issued for
+	push := "repository:a:pull,push repository:b:pull"
+	if code := get(t, c, "/v2/a/blobs/uploads/?scope="+url.QueryEscape(push), push); code != http.StatusOK {
+		t.Fatalf("GET with scope %q returned %d", push, code)
+	}
+	if n := srv.tokens.get(push); n != 1 {
+		t.Errorf("fetched %d tokens for %q, want 1", n, push)
+	}
+	if code := get(t, c, "/v2/a/tags/list?scope="+pull, pull); code != http.StatusOK {
+		t.Errorf("GET with scope %q after another scope returned %d", pull, code)
+	}
+	if n := srv.tokens.get(pull); n != 1 {
+		t.Errorf("fetched %d tokens for %q, want the cached one kept", n, pull)
+	}
+
+	want := []string{"GET " + pull, "GET " + push}
+	if !reflect.DeepEqual(srv.forms, want) {
+		t.Errorf("token requests = %q, want %q", srv.forms, want)
+	}
+}
+
+func TestBearerChallengeCredentials(t *testing.T) {
+	srv := newTokenServer(t)
+	scope := "repository:a:pull"
+	path := "/v2/a/tags/list?scope=" + scope
+
+	// An identity token is exchanged through the OAuth2 refresh flow
+	c := testClient(t, srv.Server, AuthConfig{IdentityToken: "refresh"})
+	if code := get(t, c, path, scope); code != http.StatusOK {
+		t.Errorf("GET with an identity token returned %d", code)
+	}
+	if want := []string{"POST " + scope}; !reflect.DeepEqual(srv.forms, want) {
+		t.Errorf("token requests = %q, want %q", srv.forms, want)
+	}
+
+	// Anonymous access asks for a token without credentials
+	if code := get(t, testClient(t, srv.Server, AuthConfig{}), path, scope); code != http.StatusOK {
+		t.Errorf("anonymous GET returned %d", code)
+	}
+
+	c = testClient(t, srv.Server, AuthConfig{Username: "alice", Password: "wrong"})
+	req, err := c.NewRequest(http.MethodGet, path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp, err := c.Do(req, scope); !errors.Is(err, ErrUnauthorized) {
+		if err == nil {
+			resp.Body.Close()
+		}
+		t.Errorf("GET with a wrong password = %v, want ErrUnauthorized", err)
+	}
+}
+
+func TestParseChallenge(t *testing.T) {
+	tests := []struct {
+		in   string
+		want *challenge
+	}{
+		{in: "", want: nil},
+		{in: `Basic realm="registry"`, want: &challenge{scheme: "basic", params: map[string]string{"realm": "registry"}}},
+		{
+			in: `Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:library/ubuntu:pull"`,
+			want: &challenge{scheme: "bearer", params: map[string]string{
+				"realm":   "https://auth.docker.io/token",
+				"service": "registry.docker.io",
+				"scope":   "repository:library/ubuntu:pull",
+			}},
+		},
+		{
+			in: `Bearer realm="https://auth.example/token", scope="repository:a:pull,push", error=insufficient_scope`,
+			want: &challenge{scheme: "bearer", params: map[string]string{
+				"realm": "https://auth.example/token",
+				"scope": "repository:a:pull,push",
+				"error": "insufficient_scope",
+			}},
+		},
+	}
+	for _, tt := range tests {
+		if got := parseChallenge(tt.in); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseChallenge(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+}
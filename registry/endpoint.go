@@ -0,0 +1,163 @@
+package registry
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"mydocker/config"
+)
+
+// CertsDir holds per-registry TLS material in the Docker layout:
+// certs.d/<host:port>/*.crt for CAs and client.cert/client.key for mutual TLS.
+const CertsDir = "/etc/mydocker/certs.d"
+
+// settings merges the daemon configuration that applies to host.
+func settings(cfg *config.Config, host string) config.Registry {
+	var s config.Registry
+	for key, r := range cfg.Registries {
+		if NormalizeHost(key) == host {
+			s = r
+		}
+	}
+	if host == DefaultHost && len(s.Mirrors) == 0 {
+		s.Mirrors = cfg.RegistryMirrors
+	}
+	if !s.Insecure {
+		s.Insecure = insecureListed(cfg.InsecureRegistries, host)
+	}
+	return s
+}
+
+// insecureListed matches host against insecure-registries entries, which may
+// be host names or CIDR ranges.
+func insecureListed(entries []string, host string) bool {
+	name := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		name = h
+	}
+	ip := net.ParseIP(name)
+	for _, entry := range entries {
+		if NormalizeHost(entry) == host || entry == name {
+			return true
+		}
+		if _, cidr, err := net.ParseCIDR(entry); err == nil && ip != nil && cidr.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// transport builds the HTTP transport for a registry host, trusting the
+// configured CA bundle and any certs.d material, and skipping verification
+// for insecure registries.
+func transport(host string, s config.Registry) (*http.Transport, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: s.Insecure}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	var caFiles []string
+	if s.CA != "" {
+		caFiles = append(caFiles, s.CA)
+	}
+	certsDir := filepath.Join(CertsDir, host)
+	if matches, err := filepath.Glob(filepath.Join(certsDir, "*.crt")); err == nil {
+		caFiles = append(caFiles, matches...)
+	}
+	for _, file := range caFiles {
+		pem, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA bundle for %s: %v", host, err)
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %s", file)
+		}
+	}
+	tlsConfig.RootCAs = pool
+
+	certFile, keyFile := filepath.Join(certsDir, "client.cert"), filepath.Join(certsDir, "client.key")
+	if _, err := os.Stat(certFile); err == nil {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate for %s: %v", host, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.TLSClientConfig = tlsConfig
+	return t, nil
+}
+
+// newEndpointClient returns a client for host that talks to endpoint, which
+// is either the registry itself or a mirror URL.
+func newEndpointClient(cfg *config.Config, host, endpoint string, auth AuthConfig) (*Client, error) {
+	c := &Client{
+		Host:     host,
+		auth:     auth,
+		endpoint: apiHost(host),
+		tokens:   map[string]string{},
+	}
+	s := settings(cfg, host)
+	if endpoint != "" {
+		u, err := url.Parse(endpoint)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid mirror %q for %s", endpoint, host)
+		}
+		c.endpoint, c.scheme = u.Host, u.Scheme
+		// The mirror's own entry decides its TLS settings.
+		s = settings(cfg, NormalizeHost(u.Host))
+	}
+	c.insecure = s.Insecure
+	t, err := transport(NormalizeHost(c.endpoint), s)
+	if err != nil {
+		return nil, err
+	}
+	c.http = &http.Client{Transport: t}
+	return c, nil
+}
+
+// pullClients returns clients for every configured mirror of host, in
+// order, followed by the registry itself. Mirrors use the credentials stored
+// for their own host.
+func pullClients(host string) ([]*Client, error) {
+	cfg, err := config.Load()
+	if err != nil {
+		return nil, err
+	}
+	creds, err := LoadConfig()
+	if err != nil {
+		return nil, err
+	}
+	var clients []*Client
+	for _, mirror := range settings(cfg, host).Mirrors {
+		if !strings.Contains(mirror, "://") {
+			mirror = "https://" + mirror
+		}
+		auth, err := creds.Get(NormalizeHost(mirror))
+		if err != nil {
+			return nil, err
+		}
+		c, err := newEndpointClient(cfg, host, mirror, auth)
+		if err != nil {
+			return nil, err
+		}
+		clients = append(clients, c)
+	}
+	auth, err := creds.Get(host)
+	if err != nil {
+		return nil, err
+	}
+	c, err := newEndpointClient(cfg, host, "", auth)
+	if err != nil {
+		return nil, err
+	}
+	return append(clients, c), nil
+}
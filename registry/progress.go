@@ -0,0 +1,36 @@
+package registry
+
+import "io"
+
+// Progress receives updates about blob transfers. id is a short blob
+// identifier; total is -1 when unknown. Message reports a line that is not
+// about one blob, such as a mirror being skipped.
+type Progress interface {
+	Update(id, action string, current, total int64)
+	Done(id, message string)
+	Message(line string)
+}
+
+// discardProgress is used when the caller passes a nil Progress.
+type discardProgress struct{}
+
+func (discardProgress) Update(string, string, int64, int64) {}
+func (discardProgress) Done(string, string)                 {}
+func (discardProgress) Message(string)                      {}
+
+// progressReader reports bytes read through it to a Progress.
+type progressReader struct {
+	r        io.Reader
+	progress Progress
+	id       string
+	action   string
+	current  int64
+	total    int64
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.current += int64(n)
+	p.progress.Update(p.id, p.action, p.current, p.total)
+	return n, err
+}
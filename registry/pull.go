@@ -0,0 +1,554 @@
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"mydocker/image"
+
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// DownloadDir holds partially downloaded blobs so an interrupted pull can
+// resume them with an HTTP range request.
+const DownloadDir = "/var/lib/mydocker/tmp/downloads"
+
+// DefaultMaxConcurrentDownloads is the number of blobs fetched in parallel
+// when PullOptions does not say otherwise.
+const DefaultMaxConcurrentDownloads = 3
+
+// Docker v2 media types, converted to their OCI equivalents on pull so the
+// stored layout is plain OCI.
+const (
+	mediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	mediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	mediaTypeDockerConfig       = "application/vnd.docker.container.image.v1+json"
+	mediaTypeDockerLayer        = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+	mediaTypeDockerForeignLayer = "application/vnd.docker.image.rootfs.foreign.diff.tar.gzip"
+)
+
+// manifestAccept lists every manifest type the puller understands.
+var manifestAccept = strings.Join([]string{
+	ocispec.MediaTypeImageIndex,
+	ocispec.MediaTypeImageManifest,
+	mediaTypeDockerManifestList,
+	mediaTypeDockerManifest,
+}, ", ")
+
+// PullOptions controls how an image is pulled.
+type PullOptions struct {
+	// Platform selects the entry of a multi-arch image.
+	Platform ocispec.Platform
+	// StrictPlatform makes a single-arch image for another platform an error
+	// rather than a warning; it is set when --platform was given explicitly.
+	StrictPlatform bool
+	// MaxConcurrentDownloads bounds the number of parallel blob fetches.
+	MaxConcurrentDownloads int
+}
+
+// Pull fetches ref from its registry into the local OCI layout for its
+// repository and returns the stored index entry.
+func Pull(ref image.Reference, opts PullOptions, progress Progress) (_ ocispec.Descriptor, err error) {
+	if progress == nil {
+		progress = discardProgress{}
+	}
+	if opts.MaxConcurrentDownloads <= 0 {
+		opts.MaxConcurrentDownloads = DefaultMaxConcurrentDownloads
+	}
+	host, name := SplitRepository(ref.Repository)
+	clients, err := pullClients(host)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	// The layout is only created once every blob is downloaded, so a failed
+	// pull leaves nothing in the store; its verified downloads stay in
+	// DownloadDir for the next attempt.
+	l := &image.Layout{Repository: ref.Repository, Path: filepath.Join(image.Root, filepath.FromSlash(ref.Repository))}
+	p := &puller{layout: l, name: name, progress: progress, opts: opts, sources: map[digest.Digest]*image.Layout{}}
+
+	reference := ref.Tag
+	if ref.Digest != "" {
+		reference = ref.Digest.String()
+	}
+	// Mirrors come first; manifests come from the first endpoint that can
+	// serve them, and blobs fall back from there to the endpoints after it.
+	var mediaType string
+	var data []byte
+	for i, c := range clients {
+		p.client, p.fallbacks = c, clients[i+1:]
+		if mediaType, data, err = p.fetchManifest(reference); err == nil {
+			break
+		}
+		if c.endpoint != apiHost(host) {
+			p.progress.Message(fmt.Sprintf("Mirror %s failed, trying next endpoint: %v", c.endpoint, err))
+		}
+	}
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	if ref.Digest != "" && digest.FromBytes(data) != ref.Digest {
+		return ocispec.Descriptor{}, fmt.Errorf("manifest for %s does not match its digest", ref)
+	}
+
+	// Pick the manifest for the requested platform from a manifest list.
+	if mediaType == ocispec.MediaTypeImageIndex || mediaType == mediaTypeDockerManifestList {
+		var idx ocispec.Index
+		if err := json.Unmarshal(data, &idx); err != nil {
+			return ocispec.Descriptor{}, fmt.Errorf("failed to parse manifest list of %s: %v", ref, err)
+		}
+		desc, err := image.SelectManifest(&idx, opts.Platform)
+		if err != nil {
+			return ocispec.Descriptor{}, fmt.Errorf("%s: %v", ref, err)
+		}
+		if mediaType, data, err = p.fetchManifest(desc.Digest.String()); err != nil {
+			return ocispec.Descriptor{}, err
+		}
+		if digest.FromBytes(data) != desc.Digest {
+			return ocispec.Descriptor{}, fmt.Errorf("manifest %s does not match its digest", desc.Digest)
+		}
+	}
+	if mediaType != ocispec.MediaTypeImageManifest && mediaType != mediaTypeDockerManifest {
+		return ocispec.Descriptor{}, fmt.Errorf("unsupported manifest type %q for %s", mediaType, ref)
+	}
+	var m ocispec.Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("failed to parse manifest of %s: %v", ref, err)
+	}
+	converted := convertManifest(&m)
+
+	// The config comes first so a platform mismatch fails before the layers
+	// are downloaded.
+	if err := p.fetchBlobs([]ocispec.Descriptor{m.Config}, false); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	var cfg ocispec.Image
+	cfgData, err := os.ReadFile(p.blobPath(m.Config.Digest))
+	if err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("failed to read config of %s: %v", ref, err)
+	}
+	if err := json.Unmarshal(cfgData, &cfg); err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("failed to parse config of %s: %v", ref, err)
+	}
+	platform := image.PlatformOf(&cfg)
+	if !image.MatchPlatform(opts.Platform, platform) {
+		msg := fmt.Sprintf("image %s is %s and does not match the requested platform %s",
+			ref, image.FormatPlatform(platform), image.FormatPlatform(opts.Platform))
+		if opts.StrictPlatform {
+			return ocispec.Descriptor{}, fmt.Errorf("%s", msg)
+		}
+		progress.Message("WARNING: " + msg)
+	}
+	if err := p.fetchBlobs(m.Layers, true); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	if l, err = image.CreateLayout(ref.Repository); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	p.layout = l
+	for _, desc := range append([]ocispec.Descriptor{m.Config}, m.Layers...) {
+		if err := p.storeBlob(desc); err != nil {
+			return ocispec.Descriptor{}, err
+		}
+	}
+
+	// Keep the registry's bytes, and so its digest, unless the manifest had
+	// to be converted from the Docker format.
+	manifest := data
+	if converted {
+		if manifest, err = json.Marshal(m); err != nil {
+			return ocispec.Descriptor{}, fmt.Errorf("failed to encode manifest: %v", err)
+		}
+	}
+	d, err := l.WriteBlob(manifest)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	desc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Digest:    d,
+		Size:      int64(len(manifest)),
+		Platform:  &platform,
+	}
+	if ref.Tag != "" {
+		err = l.SetTag(ref.Tag, desc)
+	} else {
+		err = l.AddManifest(desc)
+	}
+	return desc, err
+}
+
+type puller struct {
+	client *Client
+	// fallbacks are the endpoints after client, tried in turn for blobs
+	// client fails to serve.
+	fallbacks []*Client
+	layout    *image.Layout
+	name      string
+	progress  Progress
+	opts      PullOptions
+
+	mu sync.Mutex
+	// sources holds the other local layouts blobs are linked from.
+	sources map[digest.Digest]*image.Layout
+}
+
+func (p *puller) scope() string {
+	return "repository:" + p.name + ":pull"
+}
+
+// fetchManifest GETs a manifest by tag or digest.
+func (p *puller) fetchManifest(reference string) (string, []byte, error) {
+	req, err := p.client.NewRequest(http.MethodGet, "/v2/"+p.name+"/manifests/"+reference, nil)
+	if err != nil {
+		return "", nil, err
+	}
+	req.Header.Set("Accept", manifestAccept)
+	resp, err := p.client.Do(req, p.scope())
+	if err != nil {
+		return "", nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized:
+		return "", nil, ErrUnauthorized
+	case http.StatusNotFound:
+		sep := ":"
+		if strings.Contains(reference, ":") {
+			sep = "@"
+		}
+		return "", nil, fmt.Errorf("manifest for %s%s%s not found", p.name, sep, reference)
+	default:
+		return "", nil, fmt.Errorf("fetching manifest %s failed: %s", reference, responseError(resp))
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 4<<20))
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to read manifest %s: %v", reference, err)
+	}
+	mediaType, _, _ := strings.Cut(resp.Header.Get("Content-Type"), ";")
+	var probe struct {
+		MediaType string          `json:"mediaType"`
+		Manifests json.RawMessage `json:"manifests"`
+	}
+	if json.Unmarshal(data, &probe) == nil {
+		if probe.MediaType != "" {
+			mediaType = probe.MediaType
+		} else if probe.Manifests != nil && mediaType != mediaTypeDockerManifestList {
+			mediaType = ocispec.MediaTypeImageIndex
+		}
+	}
+	return strings.TrimSpace(mediaType), data, nil
+}
+
+// fetchBlobs downloads blobs with up to MaxConcurrentDownloads in flight.
+// Blobs already in the layout, or in any other local layout, are not fetched.
+func (p *puller) fetchBlobs(blobs []ocispec.Descriptor, report bool) error {
+	sem := make(chan struct{}, p.opts.MaxConcurrentDownloads)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error
+	seen := map[digest.Digest]bool{}
+	for _, desc := range blobs {
+		// A manifest may list the same layer twice; fetch it once
+		if seen[desc.Digest] {
+			continue
+		}
+		seen[desc.Digest] = true
+		id := shortID(desc.Digest)
+		if p.layout.HasBlob(desc.Digest) {
+			if report {
+				p.progress.Done(id, "Already exists")
+			}
+			continue
+		}
+		if other := p.layout.FindBlob(desc.Digest); other != nil {
+			p.mu.Lock()
+			p.sources[desc.Digest] = other
+			p.mu.Unlock()
+			if report {
+				p.progress.Done(id, "Already exists")
+			}
+			continue
+		}
+		if report {
+			p.progress.Update(id, "Waiting", 0, desc.Size)
+		}
+
+		wg.Add(1)
+		go func(desc ocispec.Descriptor) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			mu.Lock()
+			failed := firstErr != nil
+			mu.Unlock()
+			if failed {
+				return
+			}
+			if err := p.fetchBlob(desc, report); err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+			}
+		}(desc)
+	}
+	wg.Wait()
+	return firstErr
+}
+
+// partialPath is where blob d is downloaded to before it is stored.
+func partialPath(d digest.Digest) string {
+	return filepath.Join(DownloadDir, d.Encoded()+".partial")
+}
+
+// blobPath returns where blob d can be read during the pull.
+func (p *puller) blobPath(d digest.Digest) string {
+	if p.layout.HasBlob(d) {
+		return p.layout.BlobPath(d)
+	}
+	p.mu.Lock()
+	other := p.sources[d]
+	p.mu.Unlock()
+	if other != nil {
+		return other.BlobPath(d)
+	}
+	return partialPath(d)
+}
+
+// fetchBlob downloads one blob into DownloadDir, resuming a partial download
+// left by an earlier attempt, and verifies its digest. The partial file is
+// locked so concurrent pulls of the same blob take turns, and a pull that
+// waited finds the blob downloaded or already stored.
+func (p *puller) fetchBlob(desc ocispec.Descriptor, report bool) error {
+	id := shortID(desc.Digest)
+	if err := os.MkdirAll(DownloadDir, 0755); err != nil {
+		return fmt.Errorf("failed to create download directory: %v", err)
+	}
+	partial := partialPath(desc.Digest)
+	lock, err := lockPartial(partial)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if other := p.layout.FindBlob(desc.Digest); p.layout.HasBlob(desc.Digest) || other != nil {
+		os.Remove(partial)
+		if other != nil {
+			p.mu.Lock()
+			p.sources[desc.Digest] = other
+			p.mu.Unlock()
+		}
+		if report {
+			p.progress.Done(id, "Already exists")
+		}
+		return nil
+	}
+
+	// A mirror gets one attempt before the next endpoint is tried; the last
+	// endpoint, the registry itself, is retried with a growing delay.
+	endpoints := append([]*Client{p.client}, p.fallbacks...)
+	for i, c := range endpoints {
+		attempts := 1
+		if i == len(endpoints)-1 {
+			attempts = 5
+		}
+		for attempt := 1; attempt <= attempts; attempt++ {
+			if err = p.download(c, desc, partial, report); err == nil {
+				break
+			}
+			if attempt < attempts {
+				if report {
+					p.progress.Update(id, fmt.Sprintf("Retrying in %ds", attempt), 0, -1)
+				}
+				time.Sleep(time.Duration(attempt) * time.Second)
+			}
+		}
+		if err == nil {
+			break
+		}
+		if i < len(endpoints)-1 {
+			p.progress.Message(fmt.Sprintf("Mirror %s failed for %s, trying next endpoint: %v", c.endpoint, id, err))
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to download %s: %v", desc.Digest, err)
+	}
+
+	if report {
+		p.progress.Update(id, "Verifying", desc.Size, desc.Size)
+	}
+	f, err := os.Open(partial)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %v", partial, err)
+	}
+	verifier := desc.Digest.Verifier()
+	_, err = io.Copy(verifier, f)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("failed to verify %s: %v", desc.Digest, err)
+	}
+	if !verifier.Verified() {
+		os.Remove(partial)
+		return fmt.Errorf("downloaded blob %s failed digest verification", desc.Digest)
+	}
+	if report {
+		p.progress.Done(id, "Pull complete")
+	}
+	return nil
+}
+
+// storeBlob moves a fetched blob into the layout, or links it from the
+// local layout that already had it.
+func (p *puller) storeBlob(desc ocispec.Descriptor) error {
+	partial := partialPath(desc.Digest)
+	lock, err := lockPartial(partial)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if p.layout.HasBlob(desc.Digest) {
+		os.Remove(partial)
+		return nil
+	}
+	// Another pull may have stored the download in its layout meanwhile
+	p.mu.Lock()
+	other := p.sources[desc.Digest]
+	p.mu.Unlock()
+	if other == nil {
+		other = p.layout.FindBlob(desc.Digest)
+	}
+	if other != nil {
+		os.Remove(partial)
+		return p.layout.LinkBlob(other, desc.Digest)
+	}
+
+	fi, err := lock.Stat()
+	if err != nil || fi.Size() != desc.Size {
+		os.Remove(partial)
+		return fmt.Errorf("download of blob %s was lost; pull again", desc.Digest)
+	}
+	dst := p.layout.BlobPath(desc.Digest)
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return fmt.Errorf("failed to create blob directory: %v", err)
+	}
+	if err := os.Rename(partial, dst); err != nil {
+		return fmt.Errorf("failed to store blob %s: %v", desc.Digest, err)
+	}
+	return nil
+}
+
+// lockPartial opens and exclusively locks a partial download, creating it if
+// needed. When another pull renamed or removed the file while this one
+// waited for the lock, the file now at the path is locked instead.
+func lockPartial(partial string) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(partial), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create download directory: %v", err)
+	}
+	for {
+		f, err := os.OpenFile(partial, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open %s: %v", partial, err)
+		}
+		if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to lock %s: %v", partial, err)
+		}
+		locked, err1 := f.Stat()
+		current, err2 := os.Stat(partial)
+		if err1 == nil && err2 == nil && os.SameFile(locked, current) {
+			return f, nil
+		}
+		f.Close()
+	}
+}
+
+// download appends the rest of the blob to partial, asking the endpoint c
+// for only the missing range when some of it is already on disk.
+func (p *puller) download(c *Client, desc ocispec.Descriptor, partial string, report bool) error {
+	f, err := os.OpenFile(partial, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if desc.Size > 0 && offset >= desc.Size {
+		return f.Truncate(desc.Size)
+	}
+
+	req, err := c.NewRequest(http.MethodGet, "/v2/"+p.name+"/blobs/"+desc.Digest.String(), nil)
+	if err != nil {
+		return err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := c.Do(req, p.scope())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// The registry ignored the range; start over.
+		if err := f.Truncate(0); err != nil {
+			return err
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		offset = 0
+	case http.StatusRequestedRangeNotSatisfiable:
+		f.Truncate(0)
+		return fmt.Errorf("registry rejected resume at offset %d", offset)
+	case http.StatusUnauthorized:
+		return ErrUnauthorized
+	default:
+		return fmt.Errorf("registry returned %s", resp.Status)
+	}
+
+	var body io.Reader = resp.Body
+	if report {
+		body = &progressReader{r: resp.Body, progress: p.progress, id: shortID(desc.Digest),
+			action: "Downloading", current: offset, total: desc.Size}
+	}
+	if _, err := io.Copy(f, body); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// convertManifest rewrites Docker v2 media types to OCI ones and reports
+// whether anything changed. Blob contents are identical between the two
+// formats, only the labels differ.
+func convertManifest(m *ocispec.Manifest) bool {
+	if m.MediaType != mediaTypeDockerManifest {
+		return false
+	}
+	m.MediaType = ocispec.MediaTypeImageManifest
+	if m.Config.MediaType == mediaTypeDockerConfig {
+		m.Config.MediaType = ocispec.MediaTypeImageConfig
+	}
+	for i := range m.Layers {
+		switch m.Layers[i].MediaType {
+		case mediaTypeDockerLayer:
+			m.Layers[i].MediaType = ocispec.MediaTypeImageLayerGzip
+		case mediaTypeDockerForeignLayer:
+			m.Layers[i].MediaType = ocispec.MediaTypeImageLayerNonDistributableGzip
+		}
+	}
+	return true
+}
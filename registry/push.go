@@ -0,0 +1,292 @@
+package registry
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"mydocker/image"
+
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Push uploads the local image ref to its registry: every missing blob, then
+// the manifest under ref's tag. Blobs already on the registry are skipped and
+// blobs known to live in another repository there are cross-mounted.
+func Push(ref image.Reference, progress Progress) (digest.Digest, error) {
+	if progress == nil {
+		progress = discardProgress{}
+	}
+	l, desc, err := image.Resolve(ref)
+	if err != nil {
+		return "", err
+	}
+	host, name := SplitRepository(ref.Repository)
+	c, err := ClientFor(host)
+	if err != nil {
+		return "", err
+	}
+	p := &pusher{client: c, layout: l, name: name, repository: ref.Repository, progress: progress}
+	if err := p.pushManifest(desc); err != nil {
+		return "", err
+	}
+
+	tag := ref.Tag
+	if tag == "" {
+		tag = desc.Digest.String()
+	}
+	if err := p.putManifest(desc, tag); err != nil {
+		return "", err
+	}
+	return desc.Digest, nil
+}
+
+type pusher struct {
+	client     *Client
+	layout     *image.Layout
+	name       string // repository path on the registry
+	repository string // local repository name
+	progress   Progress
+}
+
+// scope is the token scope needed to push to the repository.
+func (p *pusher) scope() string {
+	return "repository:" + p.name + ":pull,push"
+}
+
+// pushManifest uploads everything desc refers to. For an index, child
+// manifests are pushed by digest first.
+func (p *pusher) pushManifest(desc ocispec.Descriptor) error {
+	switch desc.MediaType {
+	case ocispec.MediaTypeImageIndex, "application/vnd.docker.distribution.manifest.list.v2+json":
+		var idx ocispec.Index
+		if err := p.layout.ReadJSON(desc.Digest, &idx); err != nil {
+			return err
+		}
+		for _, child := range idx.Manifests {
+			if err := p.pushManifest(child); err != nil {
+				return err
+			}
+			if err := p.putManifest(child, child.Digest.String()); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	var m ocispec.Manifest
+	if err := p.layout.ReadJSON(desc.Digest, &m); err != nil {
+		return err
+	}
+	for _, layer := range append(m.Layers, m.Config) {
+		if err := p.pushBlob(layer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pushBlob uploads one blob unless the registry already has it.
+func (p *pusher) pushBlob(desc ocispec.Descriptor) error {
+	id := shortID(desc.Digest)
+	exists, err := p.blobExists(desc.Digest)
+	if err != nil {
+		return err
+	}
+	if exists {
+		p.progress.Done(id, "Layer already exists")
+		return nil
+	}
+
+	from := p.mountSource(desc.Digest)
+	location, mounted, err := p.startUpload(desc.Digest, from)
+	if err != nil {
+		return err
+	}
+	if mounted {
+		p.progress.Done(id, "Mounted from "+from)
+		return nil
+	}
+
+	u, err := url.Parse(location)
+	if err != nil {
+		return fmt.Errorf("invalid upload location %q: %v", location, err)
+	}
+	q := u.Query()
+	q.Set("digest", desc.Digest.String())
+	u.RawQuery = q.Encode()
+
+	open := func() (io.ReadCloser, error) {
+		f, err := os.Open(p.layout.BlobPath(desc.Digest))
+		if err != nil {
+			return nil, fmt.Errorf("failed to open blob %s: %v", desc.Digest, err)
+		}
+		return struct {
+			io.Reader
+			io.Closer
+		}{&progressReader{r: f, progress: p.progress, id: id, action: "Pushing", total: desc.Size}, f}, nil
+	}
+	body, err := open()
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPut, u.String(), body)
+	if err != nil {
+		body.Close()
+		return fmt.Errorf("failed to build upload request: %v", err)
+	}
+	req.ContentLength = desc.Size
+	req.GetBody = open
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := p.client.Do(req, p.scope())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("upload of %s failed: %s", desc.Digest, responseError(resp))
+	}
+	p.progress.Done(id, "Pushed")
+	return nil
+}
+
+// blobExists checks for a blob with HEAD /v2/<name>/blobs/<digest>.
+func (p *pusher) blobExists(d digest.Digest) (bool, error) {
+	req, err := p.client.NewRequest(http.MethodHead, "/v2/"+p.name+"/blobs/"+d.String(), nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := p.client.Do(req, p.scope())
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	case http.StatusUnauthorized:
+		return false, ErrUnauthorized
+	}
+	return false, fmt.Errorf("checking blob %s failed: %s", d, resp.Status)
+}
+
+// startUpload opens an upload session, first trying to mount the blob from
+// repository from when it is set. It returns the upload location, or
+// mounted=true when the mount succeeded.
+func (p *pusher) startUpload(d digest.Digest, from string) (location string, mounted bool, err error) {
+	path := "/v2/" + p.name + "/blobs/uploads/"
+	scope := p.scope()
+	if from != "" {
+		path += "?mount=" + url.QueryEscape(d.String()) + "&from=" + url.QueryEscape(from)
+		scope += " repository:" + from + ":pull"
+	}
+	req, err := p.client.NewRequest(http.MethodPost, path, nil)
+	if err != nil {
+		return "", false, err
+	}
+	resp, err := p.client.Do(req, scope)
+	if err != nil {
+		return "", false, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusCreated:
+		return "", true, nil
+	case http.StatusAccepted:
+		loc, err := p.client.resolve(resp.Header.Get("Location"))
+		return loc, false, err
+	case http.StatusUnauthorized:
+		return "", false, ErrUnauthorized
+	}
+	return "", false, fmt.Errorf("starting upload of %s failed: %s", d, responseError(resp))
+}
+
+// mountSource returns the registry path of another local repository from the
+// same registry that holds blob d, or "" if there is none.
+func (p *pusher) mountSource(d digest.Digest) string {
+	layouts, err := image.Layouts()
+	if err != nil {
+		return ""
+	}
+	for _, l := range layouts {
+		host, name := SplitRepository(l.Repository)
+		if host != p.client.Host || name == p.name {
+			continue
+		}
+		if _, err := os.Stat(l.BlobPath(d)); err == nil {
+			return name
+		}
+	}
+	return ""
+}
+
+// putManifest uploads a manifest or index under reference (a tag or digest).
+func (p *pusher) putManifest(desc ocispec.Descriptor, reference string) error {
+	data, err := p.layout.ReadBlob(desc.Digest)
+	if err != nil {
+		return err
+	}
+	mediaType := desc.MediaType
+	if mediaType == "" {
+		mediaType = ocispec.MediaTypeImageManifest
+	}
+	req, err := p.client.NewRequest(http.MethodPut, "/v2/"+p.name+"/manifests/"+reference, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", mediaType)
+	resp, err := p.client.Do(req, p.scope())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("pushing manifest %s failed: %s", reference, responseError(resp))
+	}
+	return nil
+}
+
+// resolve turns a Location header, which may be relative, into an absolute URL.
+func (c *Client) resolve(location string) (string, error) {
+	if location == "" {
+		return "", fmt.Errorf("registry %s returned no upload location", c.Host)
+	}
+	base, err := c.baseURL()
+	if err != nil {
+		return "", err
+	}
+	b, err := url.Parse(base + "/")
+	if err != nil {
+		return "", err
+	}
+	u, err := b.Parse(location)
+	if err != nil {
+		return "", fmt.Errorf("invalid location %q: %v", location, err)
+	}
+	return u.String(), nil
+}
+
+// responseError summarises a failed registry response, including the body of
+// a distribution error document when there is one.
+func responseError(resp *http.Response) string {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if msg := strings.TrimSpace(string(body)); msg != "" {
+		return resp.Status + ": " + msg
+	}
+	return resp.Status
+}
+
+// shortID is the 12-character form of a digest used in progress output.
+func shortID(d digest.Digest) string {
+	enc := d.Encoded()
+	if len(enc) > 12 {
+		enc = enc[:12]
+	}
+	return enc
+}
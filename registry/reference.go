@@ -0,0 +1,53 @@
+package registry
+
+import "strings"
+
+// DefaultHost is the registry used for references without a registry part.
+const DefaultHost = "docker.io"
+
+// SplitRepository splits a repository such as "quay.io/org/app" or "ubuntu"
+// into the registry host and the repository path on that registry. Docker Hub
+// single-component names gain the implicit "library/" prefix.
+func SplitRepository(repository string) (host, path string) {
+	first, rest, found := strings.Cut(repository, "/")
+	if found && (strings.ContainsAny(first, ".:") || first == "localhost") {
+		host, path = first, rest
+	} else {
+		host, path = DefaultHost, repository
+	}
+	host = NormalizeHost(host)
+	if host == DefaultHost && !strings.Contains(path, "/") {
+		path = "library/" + path
+	}
+	return host, path
+}
+
+// NormalizeHost maps the various spellings of Docker Hub onto DefaultHost and
+// strips any scheme or trailing path from a server address.
+func NormalizeHost(server string) string {
+	server = strings.TrimPrefix(strings.TrimPrefix(server, "https://"), "http://")
+	server, _, _ = strings.Cut(server, "/")
+	switch server {
+	case "", "index.docker.io", "registry-1.docker.io", "registry.hub.docker.com":
+		return DefaultHost
+	}
+	return server
+}
+
+// apiHost returns the host serving the distribution API for host.
+func apiHost(host string) string {
+	if host == DefaultHost {
+		return "registry-1.docker.io"
+	}
+	return host
+}
+
+// isLocalhost reports whether host is a loopback registry, which may be
+// reached over plain HTTP without further configuration.
+func isLocalhost(host string) bool {
+	name := host
+	if i := strings.LastIndex(host, ":"); i != -1 && !strings.HasSuffix(host, "]") {
+		name = host[:i]
+	}
+	return name == "localhost" || strings.HasPrefix(name, "127.") || name == "[::1]"
+}